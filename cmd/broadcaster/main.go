@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/meshlink/church-streaming/internal/cli"
 	"github.com/meshlink/church-streaming/internal/config"
 	"github.com/meshlink/church-streaming/internal/p2p"
 	"github.com/meshlink/church-streaming/internal/ui"
@@ -23,33 +24,65 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Initialize P2P node with config
-	node, err := p2p.NewNode(ctx)
+	// Manage the node's persistent identity, e.g. "broadcaster identity show"
+	identityPath := p2p.IdentityPath(&cfg.Network, "broadcaster")
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := cli.RunIdentity("broadcaster", identityPath, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	identity, err := p2p.LoadIdentity(identityPath)
+	if err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+
+	// Every stream starts at the broadcaster, so it always forwards
+	if cfg.Network.Leaf {
+		log.Println("Ignoring leaf mode: a broadcaster always forwards")
+		cfg.Network.Leaf = false
+	}
+
+	// Initialize P2P node; it only meets others configured with the same
+	// discovery key
+	namespace := streaming.NewNamespace(cfg.Network.DiscoveryKey)
+	node, err := p2p.NewNode(ctx, &cfg.Network, namespace.ServiceTag(), identity)
 	if err != nil {
 		log.Fatalf("Failed to create P2P node: %v", err)
 	}
 	defer node.Close()
 
 	log.Printf("Broadcaster started with ID: %s", node.Host.ID())
+	log.Printf("Listening on %v", node.Host.Addrs())
 	log.Printf("Using quality: %s, bitrate: %d", cfg.Media.VideoCodec, cfg.Media.Bitrate)
+	if cfg.Media.AudioOnly {
+		log.Printf("Audio-only mode: %s at %d kbps", cfg.Media.AudioCodec, cfg.Media.AudioBitrate)
+	}
 
 	// Initialize broadcaster with config
-	broadcaster, err := streaming.NewBroadcasterWithConfig(ctx, node.PubSub, cfg)
+	broadcaster, err := streaming.NewBroadcasterWithHost(ctx, node.Host, node.PubSub, cfg)
 	if err != nil {
 		log.Fatalf("Failed to create broadcaster: %v", err)
 	}
+	if broadcaster.IsEncrypted() {
+		log.Println("Stream is encrypted with the congregation's key")
+	}
+	if cfg.Network.Transport == "direct" {
+		log.Println("Sending the stream to viewers over direct streams")
+	}
+	log.Printf("Announcing %q from %s on %s", cfg.Stream.Title, cfg.Stream.ChurchName, namespace.StreamTopic(broadcaster.GetStreamID()))
 
 	// Check if running in headless mode
 	if os.Getenv("DISPLAY_MODE") == "headless" {
 		// Headless mode for Docker
 		headlessUI := ui.NewHeadlessUI("Broadcaster")
 		headlessUI.Start()
-		
+
 		// Auto-start broadcasting
 		if err := broadcaster.StartStreaming(); err != nil {
 			log.Fatalf("Failed to start streaming: %v", err)
 		}
-		
+
 		// Handle graceful shutdown
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -68,12 +101,17 @@ func main() {
 				broadcaster.Stop()
 			},
 		)
-		
+
 		// Set quality change callback
 		broadcasterUI.SetOnQualityChange(func(quality string) error {
 			return broadcaster.SetQuality(quality)
 		})
-		
+
+		broadcasterUI.SetOnAudioOnlyChange(func(audioOnly bool) error {
+			return broadcaster.SetAudioOnly(audioOnly)
+		})
+		broadcasterUI.SetAudioOnly(broadcaster.IsAudioOnly())
+
 		// Connect real statistics
 		broadcasterUI.SetStatsCallbacks(
 			func() (uint64, uint64, bool) {
@@ -96,4 +134,4 @@ func main() {
 		// Run UI (blocking)
 		broadcasterUI.Run()
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/cli"
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/p2p"
+	"github.com/meshlink/church-streaming/pkg/streaming"
+)
+
+// The relay is a headless node that extends the mesh, for example a
+// Raspberry Pi in the balcony or a server with a public address that
+// homebound members connect through. It forwards every live stream and
+// relays connections for peers that cannot reach each other directly.
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Load configuration
+	cfg, err := config.LoadConfig("config.json")
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Manage the node's persistent identity, e.g. "relay identity show";
+	// other nodes list the relay by its peer ID
+	identityPath := p2p.IdentityPath(&cfg.Network, "relay")
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := cli.RunIdentity("relay", identityPath, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	identity, err := p2p.LoadIdentity(identityPath)
+	if err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+
+	// A relay is a natural bootstrap peer, so it serves the DHT unless
+	// configured otherwise, and forwarding is its purpose
+	if cfg.Network.DHTMode == "" {
+		cfg.Network.DHTMode = "server"
+	}
+	if cfg.Network.Leaf {
+		log.Println("Ignoring leaf mode: a relay always forwards")
+		cfg.Network.Leaf = false
+	}
+
+	namespace := streaming.NewNamespace(cfg.Network.DiscoveryKey)
+	node, err := p2p.NewNode(ctx, &cfg.Network, namespace.ServiceTag(), identity)
+	if err != nil {
+		log.Fatalf("Failed to create P2P node: %v", err)
+	}
+	defer node.Close()
+
+	if err := node.EnableRelayService(&cfg.Relay); err != nil {
+		log.Fatalf("Failed to enable relay service: %v", err)
+	}
+
+	log.Printf("Relay started with ID: %s", node.Host.ID())
+	for _, addr := range node.Host.Addrs() {
+		log.Printf("Listening on %s/p2p/%s", addr, node.Host.ID())
+	}
+
+	relay, err := streaming.NewRelay(ctx, node.Host, node.PubSub, cfg)
+	if err != nil {
+		log.Fatalf("Failed to create relay: %v", err)
+	}
+	defer relay.Close()
+	if cfg.Network.Transport == "direct" {
+		log.Println("Sending streams on to viewers over direct streams")
+	}
+	if cfg.Relay.CacheGOPs {
+		log.Println("Caching GOPs for late joiners")
+	}
+
+	go logStats(ctx, node, relay, time.Duration(cfg.Relay.StatsInterval)*time.Second)
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	log.Println("Shutting down relay...")
+}
+
+// logStats logs the relay's stats every interval, 30 seconds by default.
+func logStats(ctx context.Context, node *p2p.Node, relay *streaming.Relay, interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := relay.GetStats()
+			log.Printf("Peers: %d connected, %d in stream meshes | Streams: %d on %d topics | Relayed: %d chunks, %.1f MB | Cached frames: %d | GOPs served: %d",
+				len(node.Host.Network().Peers()), stats.MeshPeers, stats.Streams, stats.Topics,
+				stats.MessagesRelayed, float64(stats.BytesRelayed)/(1<<20), stats.CachedFrames, stats.GOPsServed)
+		}
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/meshlink/church-streaming/internal/cli"
 	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
 	"github.com/meshlink/church-streaming/internal/p2p"
 	"github.com/meshlink/church-streaming/internal/ui"
 	"github.com/meshlink/church-streaming/pkg/streaming"
@@ -23,15 +27,39 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Initialize P2P node
-	node, err := p2p.NewNode(ctx)
+	// Manage the node's persistent identity, e.g. "viewer identity show"
+	identityPath := p2p.IdentityPath(&cfg.Network, "viewer")
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := cli.RunIdentity("viewer", identityPath, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	identity, err := p2p.LoadIdentity(identityPath)
+	if err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+
+	// Initialize P2P node; it only meets others configured with the same
+	// discovery key
+	namespace := streaming.NewNamespace(cfg.Network.DiscoveryKey)
+	node, err := p2p.NewNode(ctx, &cfg.Network, namespace.ServiceTag(), identity)
 	if err != nil {
 		log.Fatalf("Failed to create P2P node: %v", err)
 	}
 	defer node.Close()
 
 	log.Printf("Viewer started with ID: %s", node.Host.ID())
+	log.Printf("Listening on %v", node.Host.Addrs())
+	if cfg.Network.Leaf {
+		log.Println("Leaf mode: receiving streams without forwarding them")
+	} else if cfg.Network.UploadKbps > 0 {
+		log.Printf("Forwarding streams to other viewers with %d kbit/s to spare", cfg.Network.UploadKbps)
+	}
 	log.Printf("Expecting quality: %s, resolution: %s", cfg.Media.VideoCodec, cfg.Media.Resolution)
+	if cfg.Network.Transport == "direct" {
+		log.Println("Receiving streams over direct streams from the broadcaster or a relay")
+	}
 
 	// Check if running in headless mode
 	if os.Getenv("DISPLAY_MODE") == "headless" {
@@ -40,16 +68,40 @@ func main() {
 		headlessUI.Start()
 		
 		// Auto-connect to stream
-		viewer, err := streaming.NewViewer(ctx, node.PubSub, func(data []byte) {
+		viewer, err := streaming.NewViewerWithHost(ctx, node.Host, node.PubSub, cfg, func(data []byte) {
 			log.Printf("Received stream data: %d bytes", len(data))
 		})
 		if err != nil {
 			log.Fatalf("Failed to create viewer: %v", err)
 		}
+		viewer.SetOnRenditionChange(func(rendition string) {
+			log.Printf("Watching rendition %s", rendition)
+		})
+		viewer.SetOnParamChange(func(header *media.FrameHeader) {
+			log.Printf("Broadcaster changed stream quality at frame %d", header.FrameID)
+		})
+		viewer.SetOnKeyError(func(err error) {
+			if err != nil {
+				log.Printf("Cannot decrypt stream: %v", err)
+			}
+		})
+
+		// Watch the most recently started stream once one is announced
+		log.Println("Waiting for a stream to be announced...")
+		for len(viewer.ListStreams()) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
 		
 		if err := viewer.StartViewing(); err != nil {
 			log.Fatalf("Failed to start viewing: %v", err)
 		}
+		if stream, ok := viewer.GetStream(); ok {
+			log.Printf("Watching %q from %s", stream.Title, stream.ChurchName)
+		}
 		
 		// Handle graceful shutdown
 		sigChan := make(chan os.Signal, 1)
@@ -62,26 +114,33 @@ func main() {
 		// GUI mode
 		viewerUI := ui.NewViewerUI()
 		
-		var viewer *streaming.Viewer
-		
-		viewerUI.SetOnConnect(func() error {
-			if viewer == nil {
-				v, err := streaming.NewViewer(ctx, node.PubSub, func(data []byte) {
-					viewerUI.UpdateVideoFrame(data)
-				})
-				if err != nil {
-					return err
-				}
-				viewer = v
+		// The viewer collects stream announcements from the start, so that
+		// the picker fills in as broadcasts are found
+		viewer, err := streaming.NewViewerWithHost(ctx, node.Host, node.PubSub, cfg, func(data []byte) {
+			viewerUI.UpdateVideoFrame(data)
+		})
+		if err != nil {
+			log.Fatalf("Failed to create viewer: %v", err)
+		}
+		viewer.SetOnRenditionChange(viewerUI.SetRendition)
+		viewer.SetOnParamChange(func(*media.FrameHeader) {
+			viewerUI.ShowNotice("Broadcast quality changed")
+		})
+		viewer.SetOnKeyError(viewerUI.SetKeyError)
+		viewer.SetOnStreamsChange(func() {
+			viewerUI.SetStreams(streamOptions(viewer.ListStreams()))
+		})
+
+		viewerUI.SetOnConnect(func(streamID uint32) error {
+			if err := viewer.SelectStream(streamID); err != nil {
+				return err
 			}
 			return viewer.StartViewing()
 		})
 		
-		viewerUI.SetOnDisconnect(func() {
-			if viewer != nil {
-				viewer.Stop()
-			}
-		})
+		viewerUI.SetFECStatsCallback(viewer.GetFECStats)
+
+		viewerUI.SetOnDisconnect(viewer.Stop)
 
 		// Handle graceful shutdown
 		go func() {
@@ -89,13 +148,30 @@ func main() {
 			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 			<-sigChan
 			log.Println("Shutting down viewer...")
-			if viewer != nil {
-				viewer.Stop()
-			}
+			viewer.Stop()
 			cancel()
 		}()
 
 		// Run UI (blocking)
 		viewerUI.Run()
 	}
-}
\ No newline at end of file
+}
+
+// streamOptions lists live streams for the stream picker.
+func streamOptions(streams []streaming.StreamDescriptor) []ui.StreamOption {
+	options := make([]ui.StreamOption, len(streams))
+	for i, stream := range streams {
+		label := stream.Title
+		if stream.ChurchName != "" {
+			label = fmt.Sprintf("%s - %s", stream.ChurchName, stream.Title)
+		}
+		if stream.VideoCodec == "" {
+			label += " (audio only)"
+		}
+		if stream.Encrypted {
+			label = "🔒 " + label
+		}
+		options[i] = ui.StreamOption{ID: stream.StreamID, Label: label}
+	}
+	return options
+}
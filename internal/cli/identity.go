@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/meshlink/church-streaming/internal/p2p"
+)
+
+const identityUsage = `usage: %s identity <command>
+
+commands:
+  show           print the node's peer ID, creating the identity if needed
+  export [file]  write the private key, base64-encoded, to file or stdout
+  rotate         replace the identity with a new one, keeping the old file
+`
+
+// RunIdentity runs an identity subcommand on the identity file at path.
+func RunIdentity(program string, path string, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf(identityUsage, program)
+	}
+
+	switch args[0] {
+	case "show":
+		key, err := p2p.LoadIdentity(path)
+		if err != nil {
+			return err
+		}
+		return printIdentity(out, path, key)
+	case "export":
+		key, err := p2p.ReadIdentity(path)
+		if err != nil {
+			return err
+		}
+		data, err := crypto.MarshalPrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("failed to encode identity: %w", err)
+		}
+		encoded := base64.StdEncoding.EncodeToString(data) + "\n"
+		if len(args) > 1 {
+			return os.WriteFile(args[1], []byte(encoded), 0600)
+		}
+		_, err = io.WriteString(out, encoded)
+		return err
+	case "rotate":
+		old, next, err := p2p.RotateIdentity(path)
+		if err != nil {
+			return err
+		}
+		oldID, err := peer.IDFromPrivateKey(old)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Old peer ID: %s (kept in %s.old)\n", oldID, path)
+		if err := printIdentity(out, path, next); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Update any config that pins the old peer ID.")
+		return nil
+	default:
+		return fmt.Errorf(identityUsage, program)
+	}
+}
+
+func printIdentity(out io.Writer, path string, key crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Peer ID:  %s\n", id)
+	fmt.Fprintf(out, "Key type: %s\n", key.Type())
+	fmt.Fprintf(out, "File:     %s\n", path)
+	return nil
+}
@@ -6,23 +6,172 @@ import (
 )
 
 type Config struct {
-	Network NetworkConfig `json:"network"`
-	Media   MediaConfig   `json:"media"`
-	UI      UIConfig      `json:"ui"`
+	Network  NetworkConfig  `json:"network"`
+	Media    MediaConfig    `json:"media"`
+	Stream   StreamConfig   `json:"stream"`
+	Security SecurityConfig `json:"security"`
+	Relay    RelayConfig    `json:"relay"`
+	UI       UIConfig       `json:"ui"`
 }
 
 type NetworkConfig struct {
-	Port         int    `json:"port"`
+	// Port is listened on for TCP and QUIC, over IPv4 and IPv6. Zero picks
+	// a free port
+	Port int `json:"port"`
+	// DiscoveryKey namespaces peer discovery, topics and protocols; nodes
+	// with different keys never see each other's streams
 	DiscoveryKey string `json:"discovery_key"`
-	MaxPeers     int    `json:"max_peers"`
+	// MaxPeers is how many connections a node keeps; beyond it the least
+	// useful are closed
+	MaxPeers int `json:"max_peers"`
+	// IdentityFile holds the node's private key, which fixes its peer ID.
+	// Empty uses a file named after the program in the working directory.
+	IdentityFile string `json:"identity_file,omitempty"`
+	// ChunkSize is the largest pubsub message a frame is split into, in bytes
+	ChunkSize int `json:"chunk_size"`
+
+	// BootstrapPeers are nodes with public addresses, such as a seed node,
+	// as multiaddrs ending in /p2p/<peer ID>. Nodes stay connected to them
+	// to reach peers beyond the local network
+	BootstrapPeers []string `json:"bootstrap_peers,omitempty"`
+	// Relays are circuit relays, in the same form, through which a node
+	// that cannot be reached directly accepts connections
+	Relays []string `json:"relays,omitempty"`
+	// DHTMode enables finding peers through a Kademlia DHT joined via the
+	// bootstrap peers: "auto", "client" or "server". Empty disables it
+	DHTMode string `json:"dht_mode,omitempty"`
+
+	// UploadKbps is the upload a node can spare for forwarding streams to
+	// other viewers, in kbit/s, advertised to its peers so that streams
+	// flow through those that spare the most. Zero leaves it unknown
+	UploadKbps int `json:"upload_kbps,omitempty"`
+	// Leaf opts a viewer out of forwarding, as for a phone on a battery or
+	// a metered connection. It still receives streams from a single peer
+	Leaf bool `json:"leaf,omitempty"`
+
+	// Transport carries streams from broadcaster to viewers: "pubsub", the
+	// default, through the GossipSub mesh, or "direct", over a stream each
+	// viewer opens to the broadcaster or, failing that, to one of the
+	// Relays. Every node of a congregation must use the same transport
+	Transport string `json:"transport,omitempty"`
+
+	Access    AccessConfig    `json:"access"`
+	GossipSub GossipSubConfig `json:"gossipsub"`
+}
+
+// GossipSubConfig tunes the GossipSub router streams are carried by. The
+// profile, "default" or "low-latency-video", sets every option; non-zero
+// options below override it. Nodes with different settings still
+// interoperate.
+type GossipSubConfig struct {
+	Profile string `json:"profile,omitempty"`
+
+	// D is how many peers a node aims to forward each topic to, kept
+	// between Dlo and Dhi
+	D   int `json:"d,omitempty"`
+	Dlo int `json:"dlo,omitempty"`
+	Dhi int `json:"dhi,omitempty"`
+	// HeartbeatInterval is how often meshes are repaired and missed
+	// messages gossiped about, in milliseconds
+	HeartbeatInterval int `json:"heartbeat_interval_ms,omitempty"`
+	// MaxMessageSize is the largest message accepted, in bytes; it must
+	// leave room for a chunk
+	MaxMessageSize int `json:"max_message_size,omitempty"`
+	// FloodPublish sends a node's own messages to every subscribed peer
+	// rather than only its mesh, trading upload for a hop. Unset keeps the
+	// profile's choice
+	FloodPublish *bool `json:"flood_publish,omitempty"`
+	// Queue sizes, in messages, of each peer's outgoing messages and of
+	// messages awaiting validation
+	OutboundQueueSize int `json:"outbound_queue_size,omitempty"`
+	ValidateQueueSize int `json:"validate_queue_size,omitempty"`
+}
+
+// AccessConfig restricts which peers a node connects to, in either
+// direction. Denied peers are always refused. A non-empty AllowedPeers
+// admits only the peers on it. With TrustedNetworkOnly set, only addresses
+// in TrustedNetworks, given as CIDR ranges, are dialled or accepted; with
+// no ranges given, the private and link-local ranges are trusted.
+type AccessConfig struct {
+	AllowedPeers       []string `json:"allowed_peers,omitempty"`
+	DeniedPeers        []string `json:"denied_peers,omitempty"`
+	TrustedNetworks    []string `json:"trusted_networks,omitempty"`
+	TrustedNetworkOnly bool     `json:"trusted_network_only"`
 }
 
 type MediaConfig struct {
+	VideoSource  string `json:"video_source"`
+	VideoDevice  string `json:"video_device,omitempty"`
 	VideoCodec   string `json:"video_codec"`
+	AudioSource  string `json:"audio_source"`
+	AudioDevice  string `json:"audio_device,omitempty"`
 	AudioCodec   string `json:"audio_codec"`
+	AudioBitrate int    `json:"audio_bitrate"`
+	SampleRate   int    `json:"sample_rate"`
+	Channels     int    `json:"channels"`
 	Bitrate      int    `json:"bitrate"`
 	Resolution   string `json:"resolution"`
 	FrameRate    int    `json:"frame_rate"`
+	GOPLength    int    `json:"gop_length"`
+	AudioOnly    bool   `json:"audio_only"`
+
+	// Playout on the viewer, in milliseconds. The jitter buffer holds at
+	// least PlayoutDelay and grows up to MaxPlayoutDelay on a jittery
+	// network. A positive lip-sync offset delays video to match audio that
+	// reaches the room late, for example through a PA system; a negative
+	// one delays audio instead.
+	PlayoutDelay    int `json:"playout_delay_ms"`
+	MaxPlayoutDelay int `json:"max_playout_delay_ms"`
+	LipSyncOffset   int `json:"lip_sync_offset_ms"`
+
+	// FECRatio is the share of parity chunks added for forward error
+	// correction, e.g. 0.2 for one parity chunk per five data chunks.
+	// Zero turns FEC off.
+	FECRatio float64 `json:"fec_ratio"`
+
+	// Renditions lists the simulcast renditions, e.g. "480p" and "720p",
+	// each encoded at its own standard bitrate and published on its own
+	// topic. Renditions above the source or the broadcast quality are
+	// skipped. Empty means a single rendition at Resolution and Bitrate.
+	Renditions []string `json:"renditions,omitempty"`
+}
+
+// StreamConfig describes the broadcast to viewers choosing a stream.
+type StreamConfig struct {
+	Title      string `json:"title"`
+	ChurchName string `json:"church_name"`
+}
+
+// SecurityConfig holds the congregation's shared stream key. With a
+// passphrase or key file set, stream payloads are encrypted end to end and
+// only viewers with the same key can watch; with neither they go out in the
+// clear. KeyFile takes precedence over Passphrase.
+type SecurityConfig struct {
+	Passphrase string `json:"passphrase,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	// KeyRotation is how often a broadcaster moves to a new stream key, in
+	// seconds
+	KeyRotation int `json:"key_rotation_s"`
+
+	// TrustedBroadcasters pins the peer IDs whose streams a viewer lists.
+	// Empty trusts any broadcaster whose announcement verifies; either way
+	// a stream only plays frames signed by the broadcaster announcing it.
+	TrustedBroadcasters []string `json:"trusted_broadcasters,omitempty"`
+}
+
+// RelayConfig configures a relay node, which forwards every live stream
+// without watching any.
+type RelayConfig struct {
+	// CacheGOPs keeps each stream's latest GOP for viewers joining through
+	// the relay
+	CacheGOPs bool `json:"cache_gops"`
+	// StatsInterval is how often the relay logs its stats, in seconds
+	StatsInterval int `json:"stats_interval_s"`
+	// CircuitDuration and CircuitDataMB limit each connection relayed for
+	// peers that cannot reach each other directly, in seconds and MiB.
+	// Zero keeps the defaults
+	CircuitDuration int `json:"circuit_duration_s,omitempty"`
+	CircuitDataMB   int `json:"circuit_data_mb,omitempty"`
 }
 
 type UIConfig struct {
@@ -37,13 +186,40 @@ func DefaultConfig() *Config {
 			Port:         8080,
 			DiscoveryKey: "meshlink-church",
 			MaxPeers:     50,
+			ChunkSize:    1200,
+			GossipSub: GossipSubConfig{
+				Profile: "low-latency-video",
+			},
 		},
 		Media: MediaConfig{
-			VideoCodec: "h264",
-			AudioCodec: "aac",
-			Bitrate:    2000,
-			Resolution: "1280x720",
-			FrameRate:  30,
+			VideoSource:     "camera",
+			VideoCodec:      "h264",
+			AudioSource:     "microphone",
+			AudioCodec:      "aac",
+			AudioBitrate:    96,
+			SampleRate:      48000,
+			Channels:        2,
+			Bitrate:         2000,
+			Resolution:      "1280x720",
+			FrameRate:       30,
+			GOPLength:       60,
+			PlayoutDelay:    200,
+			MaxPlayoutDelay: 2000,
+			FECRatio:        0.2,
+			Renditions:      []string{"480p", "720p", "1080p"},
+		},
+		Stream: StreamConfig{
+			Title:      "Sunday Service",
+			ChurchName: "MeshLink Church",
+		},
+		Security: SecurityConfig{
+			KeyRotation: 600,
+		},
+		Relay: RelayConfig{
+			CacheGOPs:       true,
+			StatsInterval:   30,
+			CircuitDuration: 600,
+			CircuitDataMB:   64,
 		},
 		UI: UIConfig{
 			Theme:      "dark",
@@ -63,12 +239,14 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
+	// Settings missing from the file, such as ones added since it was
+	// written, keep their defaults
+	config := DefaultConfig()
+	if err := json.Unmarshal(data, config); err != nil {
 		return nil, err
 	}
 
-	return &config, nil
+	return config, nil
 }
 
 func (c *Config) Save(path string) error {
@@ -78,4 +256,4 @@ func (c *Config) Save(path string) error {
 	}
 
 	return os.WriteFile(path, data, 0644)
-}
\ No newline at end of file
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigKeepsDefaultsForMissingSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	// A file from before the relay circuit limits and key rotation existed
+	data := `{"network":{"port":9000},"media":{"renditions":["720p"]},"relay":{"cache_gops":false,"stats_interval_s":30}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.Network.Port = 9000
+	want.Media.Renditions = []string{"720p"}
+	want.Relay.CacheGOPs = false
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("LoadConfig() = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	cfg, err := LoadConfig(filepath.Join(t.TempDir(), "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, DefaultConfig()) {
+		t.Errorf("LoadConfig() of a missing file = %+v, want the defaults", cfg)
+	}
+}
@@ -0,0 +1,121 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// H.264 NAL unit types used when splitting and classifying access units.
+const (
+	NALSlice = 1
+	NALIDR   = 5
+	NALSEI   = 6
+	NALSPS   = 7
+	NALPPS   = 8
+	NALAUD   = 9
+)
+
+// maxNALSize bounds a single NAL unit read from an encoder; a 1080p IDR
+// slice at high bitrate stays well below this.
+const maxNALSize = 8 << 20
+
+var startCode = []byte{0x00, 0x00, 0x01}
+
+// NALType returns the type of a NAL unit that starts with an Annex-B start code.
+func NALType(nal []byte) int {
+	i := bytes.Index(nal, startCode)
+	if i < 0 || i+3 >= len(nal) {
+		return -1
+	}
+	return int(nal[i+3] & 0x1F)
+}
+
+// ContainsIDR reports whether an Annex-B access unit holds an IDR slice.
+func ContainsIDR(au []byte) bool {
+	for len(au) > 0 {
+		i := bytes.Index(au, startCode)
+		if i < 0 || i+3 >= len(au) {
+			return false
+		}
+		if au[i+3]&0x1F == NALIDR {
+			return true
+		}
+		au = au[i+3:]
+	}
+	return false
+}
+
+// annexBReader splits an Annex-B byte stream into access units, using the
+// access unit delimiter NAL that starts each one. An access unit is only
+// known to be complete when the next delimiter or the end of stream is seen.
+type annexBReader struct {
+	scanner *bufio.Scanner
+	current []byte
+}
+
+func newAnnexBReader(r io.Reader) *annexBReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 256<<10), maxNALSize)
+	scanner.Split(splitNALUnits)
+	return &annexBReader{scanner: scanner}
+}
+
+// Next returns the next complete access unit, or io.EOF.
+func (r *annexBReader) Next() ([]byte, error) {
+	for r.scanner.Scan() {
+		nal := r.scanner.Bytes()
+		if NALType(nal) == NALAUD && len(r.current) > 0 {
+			au := r.current
+			r.current = append([]byte(nil), nal...)
+			return au, nil
+		}
+		r.current = append(r.current, nal...)
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(r.current) > 0 {
+		au := r.current
+		r.current = nil
+		return au, nil
+	}
+	return nil, io.EOF
+}
+
+// splitNALUnits is a bufio.SplitFunc that yields NAL units including their
+// leading start code.
+func splitNALUnits(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.Index(data, startCode)
+	if start < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		// Skip bytes that cannot be part of a start code
+		return max(0, len(data)-len(startCode)), nil, nil
+	}
+	// Keep the leading zero of a four-byte start code
+	if start > 0 && data[start-1] == 0 {
+		start--
+	}
+
+	if len(data) < start+4 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return start, nil, nil
+	}
+
+	next := bytes.Index(data[start+4:], startCode)
+	if next < 0 {
+		if atEOF {
+			return len(data), data[start:], nil
+		}
+		return start, nil, nil
+	}
+	end := start + 4 + next
+	if data[end-1] == 0 {
+		end--
+	}
+	return end, data[start:end], nil
+}
@@ -0,0 +1,114 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func nal(typ byte, payload ...byte) []byte {
+	return append([]byte{0, 0, 0, 1, typ}, payload...)
+}
+
+func TestSplitNALUnits(t *testing.T) {
+	short := []byte{0, 0, 1, NALSlice, 0xaa}
+	tests := []struct {
+		name  string
+		input []byte
+		want  [][]byte
+	}{
+		{"empty", nil, nil},
+		{"no start code", []byte{1, 2, 3, 4, 5}, nil},
+		{"one unit", nal(NALSPS, 1, 2), [][]byte{nal(NALSPS, 1, 2)}},
+		{"three-byte start code", short, [][]byte{short}},
+		{"leading garbage", append([]byte{7, 7}, nal(NALAUD, 0xf0)...), [][]byte{nal(NALAUD, 0xf0)}},
+		{
+			"several units",
+			bytes.Join([][]byte{nal(NALAUD, 0xf0), nal(NALSPS, 1), short, nal(NALIDR, 2, 3)}, nil),
+			[][]byte{nal(NALAUD, 0xf0), nal(NALSPS, 1), short, nal(NALIDR, 2, 3)},
+		},
+		{"start code without a header", []byte{7, 0, 0, 1}, nil},
+	}
+	for _, tt := range tests {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = bytes.NewReader(tt.input)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			scanner := bufio.NewScanner(r)
+			scanner.Split(splitNALUnits)
+			var got [][]byte
+			for scanner.Scan() {
+				got = append(got, append([]byte(nil), scanner.Bytes()...))
+			}
+			if err := scanner.Err(); err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("%s (one byte reads %t): got %x, want %x", tt.name, oneByte, got, tt.want)
+				continue
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], tt.want[i]) {
+					t.Errorf("%s (one byte reads %t): unit %d = %x, want %x", tt.name, oneByte, i, got[i], tt.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestContainsIDR(t *testing.T) {
+	tests := []struct {
+		name string
+		au   []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"slice", bytes.Join([][]byte{nal(NALAUD, 0xf0), nal(NALSlice, 1)}, nil), false},
+		{"IDR with parameter sets", bytes.Join([][]byte{nal(NALAUD, 0xf0), nal(NALSPS, 1), nal(NALPPS, 2), nal(NALIDR, 3)}, nil), true},
+		{"IDR after three-byte start code", []byte{0, 0, 1, 0x65, 0x88}, true},
+		{"IDR type in a payload", nal(NALSlice, 0x05, 0x65), false},
+		{"start code at the end", []byte{0, 0, 1}, false},
+	}
+	for _, tt := range tests {
+		if got := ContainsIDR(tt.au); got != tt.want {
+			t.Errorf("%s: ContainsIDR() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAnnexBReader(t *testing.T) {
+	aus := [][]byte{
+		bytes.Join([][]byte{nal(NALAUD, 0xf0), nal(NALSPS, 1), nal(NALPPS, 2), nal(NALIDR, 3, 4)}, nil),
+		bytes.Join([][]byte{nal(NALAUD, 0xf0), nal(NALSlice, 5)}, nil),
+		bytes.Join([][]byte{nal(NALAUD, 0xf0), nal(NALSlice, 6), nal(NALSlice, 7)}, nil),
+	}
+	r := newAnnexBReader(iotest.HalfReader(bytes.NewReader(bytes.Join(aus, nil))))
+	for i, want := range aus {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("access unit %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("access unit %d = %x, want %x", i, got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next() at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestAnnexBReaderRejectsOversizedNAL(t *testing.T) {
+	oversized := io.MultiReader(
+		bytes.NewReader(nal(NALAUD, 0xf0)),
+		strings.NewReader(strings.Repeat("\xff", maxNALSize+1)),
+	)
+	_, err := newAnnexBReader(oversized).Next()
+	if !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("Next() = %v, want %v", err, bufio.ErrTooLong)
+	}
+}
@@ -0,0 +1,227 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSampleRate = 48000
+	defaultChannels   = 2
+
+	// AudioBlockDuration is the length of each PCM block delivered by an
+	// AudioCapture.
+	AudioBlockDuration = 20 * time.Millisecond
+
+	// Audio blocks are small and gaps are far more noticeable than in video,
+	// so keep a deeper queue.
+	audioRingSlots      = 16
+	audioFrameQueueSize = audioRingSlots - 2
+
+	toneFrequency = 440.0
+)
+
+// AudioCapture runs one long-lived ffmpeg process that records from the
+// system microphone and delivers fixed-size blocks of s16le PCM.
+type AudioCapture struct {
+	device      string
+	sampleRate  int
+	channels    int
+	blockSize   int
+	isCapturing bool
+	simulated   bool
+	logger      *logrus.Logger
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	frames chan RawFrame
+	stats  captureStats
+}
+
+func NewAudioCapture() *AudioCapture {
+	a := &AudioCapture{
+		logger: logrus.New(),
+	}
+	a.configure(defaultSampleRate, defaultChannels)
+	return a
+}
+
+// NewAudioCaptureWithConfig creates a capture using the configured device,
+// sample rate and channel count.
+func NewAudioCaptureWithConfig(cfg *config.MediaConfig) *AudioCapture {
+	a := NewAudioCapture()
+	if cfg != nil {
+		a.configure(cfg.SampleRate, cfg.Channels)
+		a.device = cfg.AudioDevice
+	}
+	return a
+}
+
+func (a *AudioCapture) configure(sampleRate, channels int) {
+	if sampleRate <= 0 {
+		sampleRate = defaultSampleRate
+	}
+	if channels <= 0 {
+		channels = defaultChannels
+	}
+
+	a.sampleRate = sampleRate
+	a.channels = channels
+	samples := sampleRate * int(AudioBlockDuration/time.Millisecond) / 1000
+	a.blockSize = samples * channels * 2
+}
+
+// SetSimulated makes the capture generate a sine tone without ffmpeg or a
+// microphone, as AUDIO_SIMULATION=true does.
+func (a *AudioCapture) SetSimulated(simulated bool) {
+	a.simulated = simulated
+}
+
+func (a *AudioCapture) Start() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.isCapturing {
+		return fmt.Errorf("already capturing")
+	}
+
+	simulate := a.simulated || os.Getenv("AUDIO_SIMULATION") == "true"
+	if !simulate {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return fmt.Errorf("ffmpeg not found: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.done = make(chan struct{})
+	a.frames = make(chan RawFrame, audioFrameQueueSize)
+	a.stats.reset()
+	a.isCapturing = true
+
+	ring := newFrameRing(audioRingSlots, a.blockSize)
+	if simulate {
+		go a.toneLoop(ctx, ring, a.frames, a.done)
+	} else {
+		go superviseCapture(ctx, a.logger, "Audio capture", a.ffmpegArgs(), ring, a.frames, a.done, &a.stats)
+	}
+	return nil
+}
+
+func (a *AudioCapture) Stop() {
+	a.mu.Lock()
+	if !a.isCapturing {
+		a.mu.Unlock()
+		return
+	}
+	a.isCapturing = false
+	a.cancel()
+	done := a.done
+	a.mu.Unlock()
+
+	<-done
+}
+
+// Frames returns the channel that delivers PCM blocks for the current
+// session. It is closed when capture stops. Blocks are reused in the same way
+// as CameraCapture frames.
+func (a *AudioCapture) Frames() <-chan RawFrame {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.frames
+}
+
+// GetStats returns the blocks delivered, blocks dropped because the consumer
+// fell behind, and how many times ffmpeg had to be restarted.
+func (a *AudioCapture) GetStats() (captured uint64, dropped uint64, restarts uint64) {
+	return a.stats.get()
+}
+
+func (a *AudioCapture) GetSampleRate() int {
+	return a.sampleRate
+}
+
+func (a *AudioCapture) GetChannels() int {
+	return a.channels
+}
+
+func (a *AudioCapture) ffmpegArgs() []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	args = append(args, a.inputArgs()...)
+	return append(args,
+		"-vn",
+		"-f", "s16le",
+		"-ac", strconv.Itoa(a.channels),
+		"-ar", strconv.Itoa(a.sampleRate),
+		"-")
+}
+
+// inputArgs selects the platform capture backend. On Linux the device may be
+// prefixed with "pulse:" or "alsa:" to pick the backend explicitly.
+func (a *AudioCapture) inputArgs() []string {
+	switch runtime.GOOS {
+	case "windows":
+		device := a.device
+		if device == "" {
+			device = "Microphone (USB2.0 MIC)"
+		}
+		return []string{"-f", "dshow", "-i", "audio=" + device}
+	case "darwin":
+		device := a.device
+		if device == "" {
+			device = "0"
+		}
+		return []string{"-f", "avfoundation", "-i", ":" + device}
+	default:
+		backend, device := "alsa", a.device
+		if b, d, ok := strings.Cut(a.device, ":"); ok && (b == "pulse" || b == "alsa") {
+			backend, device = b, d
+		}
+		if device == "" {
+			device = "default"
+		}
+		return []string{"-f", backend, "-i", device}
+	}
+}
+
+// toneLoop produces a continuous sine tone in real time for environments
+// without a microphone or ffmpeg (AUDIO_SIMULATION=true).
+func (a *AudioCapture) toneLoop(ctx context.Context, ring *frameRing, frames chan RawFrame, done chan struct{}) {
+	defer close(done)
+	defer close(frames)
+
+	ticker := time.NewTicker(AudioBlockDuration)
+	defer ticker.Stop()
+
+	step := 2 * math.Pi * toneFrequency / float64(a.sampleRate)
+	var phase float64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			buf := ring.Next()
+			for i := 0; i+2*a.channels <= len(buf); i += 2 * a.channels {
+				sample := int16(math.Sin(phase) * 0.25 * math.MaxInt16)
+				for ch := 0; ch < a.channels; ch++ {
+					binary.LittleEndian.PutUint16(buf[i+2*ch:], uint16(sample))
+				}
+				phase = math.Mod(phase+step, 2*math.Pi)
+			}
+			deliverLatest(ring, frames, RawFrame{Data: buf, Captured: time.Now()}, &a.stats)
+		}
+	}
+}
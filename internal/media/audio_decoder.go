@@ -0,0 +1,48 @@
+package media
+
+import (
+	"fmt"
+)
+
+// AudioDecoder validates audio frames of one codec and hands their packets
+// to the playback path unchanged.
+type AudioDecoder struct {
+	codec      Codec
+	isDecoding bool
+}
+
+func NewAudioDecoder(codec Codec) *AudioDecoder {
+	return &AudioDecoder{codec: codec}
+}
+
+func (d *AudioDecoder) Start() error {
+	if d.isDecoding {
+		return fmt.Errorf("decoder already started")
+	}
+
+	d.isDecoding = true
+	return nil
+}
+
+func (d *AudioDecoder) Stop() {
+	d.isDecoding = false
+}
+
+func (d *AudioDecoder) DecodeFrame(encodedData []byte) (*DecodedFrame, error) {
+	if !d.isDecoding {
+		return nil, fmt.Errorf("decoder not started")
+	}
+
+	header, payload, err := UnmarshalFrame(encodedData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid frame data: %w", err)
+	}
+	if header.Codec != d.codec {
+		return nil, fmt.Errorf("unexpected codec %s for %s decoder", header.Codec, d.codec)
+	}
+
+	return &DecodedFrame{
+		Header: *header,
+		Data:   payload,
+	}, nil
+}
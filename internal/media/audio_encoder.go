@@ -0,0 +1,355 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAudioBitrate = 96000 // 96 kbps
+
+	// audioResyncThreshold is how far the sample count may fall behind the
+	// capture clock, for example after dropped blocks, before timestamps are
+	// re-anchored.
+	audioResyncThreshold = 100 * time.Millisecond
+)
+
+// AudioEncoder compresses s16le PCM to AAC (ADTS) or Opus by piping it
+// through a long-lived ffmpeg process, which is replaced on the next block if
+// it dies. Every audio packet is independently decodable and is flagged as a
+// keyframe.
+type AudioEncoder struct {
+	codec        Codec
+	bitrate      int
+	sampleRate   int
+	channels     int
+	frameSamples int
+	streamID     uint32
+	isEncoding   bool
+	logger       *logrus.Logger
+
+	mu sync.Mutex
+	// basePTS is the capture time of the first sample, adjusted whenever
+	// the capture clock and the sample count drift apart
+	basePTS   uint64
+	hasBase   bool
+	samplesIn uint64
+	ctx       context.Context
+	cancel    context.CancelFunc
+	proc      *encoderProcess
+	output    chan *EncodedFrame
+	// restartNeeded is set when the process died and must be replaced
+	restartNeeded bool
+}
+
+// NewAudioEncoder creates an encoder for CodecAAC or CodecOpus.
+func NewAudioEncoder(codec Codec, sampleRate, channels int) (*AudioEncoder, error) {
+	e := &AudioEncoder{
+		codec:      codec,
+		bitrate:    defaultAudioBitrate,
+		sampleRate: sampleRate,
+		channels:   channels,
+		logger:     logrus.New(),
+	}
+
+	switch codec {
+	case CodecAAC:
+		e.frameSamples = 1024
+	case CodecOpus:
+		// Opus only runs at 48 kHz; ffmpeg resamples the input
+		e.frameSamples = 960 // 20 ms
+	default:
+		return nil, fmt.Errorf("unsupported audio codec %s", codec)
+	}
+	return e, nil
+}
+
+// NewAudioEncoderWithConfig applies the configured audio bitrate (kbps).
+func NewAudioEncoderWithConfig(codec Codec, sampleRate, channels int, cfg *config.MediaConfig) (*AudioEncoder, error) {
+	e, err := NewAudioEncoder(codec, sampleRate, channels)
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil && cfg.AudioBitrate > 0 {
+		e.bitrate = cfg.AudioBitrate * 1000
+	}
+	return e, nil
+}
+
+// SetStreamID sets the stream ID written into every frame header.
+func (e *AudioEncoder) SetStreamID(streamID uint32) {
+	e.streamID = streamID
+}
+
+func (e *AudioEncoder) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.isEncoding {
+		return fmt.Errorf("encoder already started")
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("ffmpeg not found: %w", err)
+	}
+
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.output = make(chan *EncodedFrame, encoderQueueSize)
+	e.restartNeeded = false
+
+	proc, err := e.startProcess()
+	if err != nil {
+		e.cancel()
+		return err
+	}
+	e.proc = proc
+	e.isEncoding = true
+	return nil
+}
+
+func (e *AudioEncoder) Stop() {
+	e.mu.Lock()
+	if !e.isEncoding {
+		e.mu.Unlock()
+		return
+	}
+	e.isEncoding = false
+	e.cancel()
+	proc := e.proc
+	e.mu.Unlock()
+
+	proc.wait()
+	close(e.output)
+}
+
+func (e *AudioEncoder) Frames() <-chan *EncodedFrame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.output
+}
+
+// RequestKeyframe is a no-op: every audio packet is independently decodable.
+func (e *AudioEncoder) RequestKeyframe() {}
+
+// EncodeFrame submits a block of PCM samples captured at pts. The frame ID is
+// ignored since packet boundaries do not line up with input blocks.
+func (e *AudioEncoder) EncodeFrame(rawData []byte, frameID uint64, pts uint64) error {
+	e.mu.Lock()
+	if !e.isEncoding {
+		e.mu.Unlock()
+		return fmt.Errorf("encoder not started")
+	}
+	restart := e.restartNeeded
+	e.restartNeeded = false
+	proc := e.proc
+	e.mu.Unlock()
+
+	if restart {
+		var err error
+		if proc, err = e.restartProcess(proc); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	if !e.isEncoding || e.proc != proc {
+		// Stopped, and perhaps started again, meanwhile
+		e.mu.Unlock()
+		return fmt.Errorf("encoder not started")
+	}
+	e.anchor(pts)
+	e.samplesIn += uint64(len(rawData) / (2 * e.channels))
+	e.mu.Unlock()
+
+	if _, err := proc.stdin.Write(rawData); err != nil {
+		// Replace the dead process on the next block
+		e.mu.Lock()
+		if e.proc == proc {
+			e.restartNeeded = true
+		}
+		e.mu.Unlock()
+		return fmt.Errorf("failed to write samples to encoder: %w", err)
+	}
+	return nil
+}
+
+// restartProcess replaces old, which has died, with a new ffmpeg. Packet
+// timestamps count from the first block of each process, so the new one is
+// anchored afresh.
+func (e *AudioEncoder) restartProcess(old *encoderProcess) (*encoderProcess, error) {
+	old.stdin.Close()
+	if err := old.wait(); err != nil && e.ctx.Err() == nil {
+		e.logger.Warnf("Audio encoder process exited with error: %v", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.isEncoding || e.proc != old {
+		return nil, fmt.Errorf("encoder not started")
+	}
+
+	proc, err := e.startProcess()
+	if err != nil {
+		// Try again on the next block
+		e.restartNeeded = true
+		return nil, err
+	}
+	e.proc = proc
+	// The old readLoop may have flagged its own exit while draining
+	e.restartNeeded = false
+	return proc, nil
+}
+
+// startProcess launches ffmpeg and resets the timestamp anchor. Called with
+// mu held.
+func (e *AudioEncoder) startProcess() (*encoderProcess, error) {
+	cmd := exec.CommandContext(e.ctx, "ffmpeg", e.ffmpegArgs()...)
+	stderr := e.logger.WriterLevel(logrus.DebugLevel)
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		stderr.Close()
+		return nil, fmt.Errorf("failed to open encoder stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stderr.Close()
+		return nil, fmt.Errorf("failed to open encoder stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		stderr.Close()
+		return nil, fmt.Errorf("failed to start encoder: %w", err)
+	}
+
+	proc := &encoderProcess{
+		cmd:   cmd,
+		stdin: stdin,
+		done:  make(chan struct{}),
+	}
+	e.hasBase = false
+	e.samplesIn = 0
+
+	go func() {
+		defer stderr.Close()
+		e.readLoop(e.newPacketReader(stdout), proc)
+	}()
+	return proc, nil
+}
+
+// anchor ties the sample count to the capture clock. Called with mu held
+// before the block's samples are counted.
+func (e *AudioEncoder) anchor(pts uint64) {
+	if !e.hasBase {
+		e.basePTS = pts
+		e.hasBase = true
+		return
+	}
+
+	expected := e.basePTS + e.samplesIn*MediaClockRate/uint64(e.sampleRate)
+	if pts > expected && PTSToDuration(pts-expected) > audioResyncThreshold {
+		e.logger.Debugf("Audio capture fell %s behind the media clock, re-anchoring", PTSToDuration(pts-expected))
+		e.basePTS += pts - expected
+	}
+}
+
+func (e *AudioEncoder) newPacketReader(r io.Reader) packetReader {
+	if e.codec == CodecOpus {
+		return newOggPacketReader(r, 2) // OpusHead, OpusTags
+	}
+	return newADTSReader(r)
+}
+
+// readLoop stamps each packet with the capture time of the first sample plus
+// the number of samples encoded so far, which keeps audio timestamps free of
+// scheduling jitter. Output ends early only if ffmpeg died or wrote
+// something unparsable; the process is then killed and replaced on the next
+// block.
+func (e *AudioEncoder) readLoop(reader packetReader, proc *encoderProcess) {
+	defer close(proc.done)
+
+	clockRate := e.sampleRate
+	if e.codec == CodecOpus {
+		clockRate = 48000
+	}
+
+	var packets uint64
+	for {
+		packet, err := reader.Next()
+		if err != nil {
+			if e.ctx.Err() == nil {
+				if err != io.EOF {
+					e.logger.Errorf("Failed to read audio encoder output, restarting encoder: %v", err)
+				} else {
+					e.logger.Warn("Audio encoder exited, restarting encoder")
+				}
+				proc.cmd.Process.Kill()
+				e.mu.Lock()
+				if e.proc == proc {
+					e.restartNeeded = true
+				}
+				e.mu.Unlock()
+			}
+			return
+		}
+
+		e.mu.Lock()
+		basePTS := e.basePTS
+		e.mu.Unlock()
+
+		pts := basePTS + packets*uint64(e.frameSamples)*MediaClockRate/uint64(clockRate)
+		packets++
+
+		frame := &EncodedFrame{
+			Header: FrameHeader{
+				Flags:    FlagKeyframe,
+				StreamID: e.streamID,
+				FrameID:  packets,
+				PTS:      pts,
+				DTS:      pts,
+				Codec:    e.codec,
+			},
+			Data: packet,
+		}
+
+		select {
+		case e.output <- frame:
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *AudioEncoder) ffmpegArgs() []string {
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-f", "s16le",
+		"-ar", strconv.Itoa(e.sampleRate),
+		"-ac", strconv.Itoa(e.channels),
+		"-i", "-",
+		"-b:a", fmt.Sprintf("%dk", e.bitrate/1000),
+		"-flush_packets", "1",
+	}
+
+	if e.codec == CodecOpus {
+		return append(args,
+			"-c:a", "libopus",
+			"-ar", "48000",
+			"-frame_duration", "20",
+			"-application", "audio",
+			"-page_duration", "20000", // one packet per page keeps latency low
+			"-f", "ogg",
+			"-")
+	}
+	return append(args,
+		"-c:a", "aac",
+		"-f", "adts",
+		"-")
+}
@@ -0,0 +1,105 @@
+package media
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestAudioEncoderAnchor(t *testing.T) {
+	e, err := NewAudioEncoder(CodecAAC, 48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := func(pts uint64) uint64 {
+		e.anchor(pts)
+		e.samplesIn += 960 // 20 ms, 1800 ticks
+		return e.basePTS
+	}
+
+	if base := block(90000); base != 90000 {
+		t.Fatalf("first block anchored at %d, want 90000", base)
+	}
+	// Scheduling jitter and early blocks leave the anchor alone
+	if base := block(91800 + 4500); base != 90000 {
+		t.Errorf("block 50ms late moved the anchor to %d", base)
+	}
+	if base := block(93600 - 900); base != 90000 {
+		t.Errorf("early block moved the anchor to %d", base)
+	}
+	// Falling over audioResyncThreshold behind re-anchors by the gap
+	late := uint64(95400 + 18000)
+	if base := block(late); base != 90000+18000 {
+		t.Errorf("block 200ms late anchored at %d, want %d", base, 90000+18000)
+	}
+}
+
+// A dead audio encoder is replaced on the next block, and the replacement
+// is anchored to that block rather than to the old sample count.
+func TestAudioEncoderReplacesDeadProcess(t *testing.T) {
+	// The first process exits after reading a byte, later ones emit one
+	// ADTS frame once input arrives. The shell keeps stdout open, as
+	// ffmpeg would, while cat drains the input.
+	marker := t.TempDir() + "/started"
+	fakeFFmpeg(t, `if [ ! -e `+marker+` ]; then
+	touch `+marker+`
+	head -c 1 >/dev/null 2>/dev/null
+	exit 0
+fi
+head -c 1 >/dev/null 2>/dev/null
+printf '\377\361\120\200\001\137\374\252\273\314'
+cat >/dev/null 2>/dev/null
+`)
+
+	e, err := NewAudioEncoder(CodecAAC, 48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	block := make([]byte, 960*2)
+
+	e.mu.Lock()
+	first := e.proc
+	e.mu.Unlock()
+	e.EncodeFrame(block, 0, 0) // may fail once the process is gone
+	select {
+	case <-first.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the first process did not exit")
+	}
+	e.mu.Lock()
+	restart := e.restartNeeded
+	e.mu.Unlock()
+	if !restart {
+		t.Fatal("no restart scheduled after the process exited")
+	}
+
+	const pts = 5 * MediaClockRate
+	if err := e.EncodeFrame(block, 0, pts); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case frame := <-e.Frames():
+		if !bytes.Equal(frame.Data, adtsFrame) {
+			t.Errorf("packet = % x, want % x", frame.Data, adtsFrame)
+		}
+		if frame.Header.PTS != pts {
+			t.Errorf("first packet of the new process has PTS %d, want %d", frame.Header.PTS, pts)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the replacement process produced no packet")
+	}
+
+	e.mu.Lock()
+	replaced, restart := e.proc != first, e.restartNeeded
+	e.mu.Unlock()
+	if !replaced {
+		t.Error("the process was not replaced")
+	}
+	if restart {
+		t.Error("a second restart was scheduled for the replaced process")
+	}
+}
@@ -0,0 +1,209 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// packetReader splits an encoder's output stream into codec packets.
+type packetReader interface {
+	Next() ([]byte, error)
+}
+
+const adtsHeaderSize = 7
+
+// adtsReader splits an AAC ADTS stream into frames. Each frame keeps its
+// ADTS header so that it can be decoded on its own.
+type adtsReader struct {
+	r *bufio.Reader
+}
+
+func newADTSReader(r io.Reader) *adtsReader {
+	return &adtsReader{r: bufio.NewReader(r)}
+}
+
+func (a *adtsReader) Next() ([]byte, error) {
+	var header [adtsHeaderSize]byte
+	if _, err := io.ReadFull(a.r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0xFF || header[1]&0xF0 != 0xF0 {
+		return nil, fmt.Errorf("lost ADTS sync")
+	}
+
+	length := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+	if length < adtsHeaderSize {
+		return nil, fmt.Errorf("invalid ADTS frame length %d", length)
+	}
+
+	frame := make([]byte, length)
+	copy(frame, header[:])
+	if _, err := io.ReadFull(a.r, frame[adtsHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+const oggPageHeaderSize = 27
+
+var oggCapturePattern = []byte("OggS")
+
+// oggPacketReader extracts packets from an Ogg stream, skipping the leading
+// header packets (OpusHead and OpusTags for Opus).
+type oggPacketReader struct {
+	r       *bufio.Reader
+	skip    int
+	partial []byte
+	queue   [][]byte
+}
+
+func newOggPacketReader(r io.Reader, headerPackets int) *oggPacketReader {
+	return &oggPacketReader{
+		r:    bufio.NewReader(r),
+		skip: headerPackets,
+	}
+}
+
+func (o *oggPacketReader) Next() ([]byte, error) {
+	for len(o.queue) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := o.queue[0]
+	o.queue = o.queue[1:]
+	return packet, nil
+}
+
+func (o *oggPacketReader) readPage() error {
+	var header [oggPageHeaderSize]byte
+	if _, err := io.ReadFull(o.r, header[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[0:4], oggCapturePattern) {
+		return fmt.Errorf("lost Ogg sync")
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, segments); err != nil {
+		return err
+	}
+
+	for _, size := range segments {
+		start := len(o.partial)
+		o.partial = append(o.partial, make([]byte, size)...)
+		if _, err := io.ReadFull(o.r, o.partial[start:]); err != nil {
+			return err
+		}
+
+		// A lacing value below 255 ends the packet; 255 means it continues
+		// in the next segment, possibly on the next page.
+		if size < 255 {
+			if o.skip > 0 {
+				o.skip--
+			} else {
+				o.queue = append(o.queue, o.partial)
+			}
+			o.partial = nil
+		}
+	}
+	return nil
+}
+
+// oggPageWriter wraps Opus packets in Ogg pages, one packet per page, so
+// that they can be fed to a player that expects an Ogg Opus stream.
+type oggPageWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32
+	granule  uint64
+}
+
+func newOggPageWriter(w io.Writer, serial uint32) *oggPageWriter {
+	return &oggPageWriter{w: w, serial: serial}
+}
+
+// WriteOpusHeaders writes the OpusHead and OpusTags header pages.
+func (o *oggPageWriter) WriteOpusHeaders(channels int, inputRate int) error {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], 312) // pre-skip used by libopus
+	binary.LittleEndian.PutUint32(head[12:], uint32(inputRate))
+	if err := o.writePage(head, 0x02); err != nil { // beginning of stream
+		return err
+	}
+
+	vendor := "meshlink"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	return o.writePage(tags, 0)
+}
+
+// WritePacket writes one packet holding the given number of 48 kHz samples.
+func (o *oggPageWriter) WritePacket(packet []byte, samples int) error {
+	o.granule += uint64(samples)
+	return o.writePage(packet, 0)
+}
+
+func (o *oggPageWriter) writePage(packet []byte, headerType byte) error {
+	// Lacing: runs of 255 followed by the remainder, which may be zero
+	lacing := make([]byte, 0, len(packet)/255+1)
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			lacing = append(lacing, byte(n))
+			break
+		}
+		lacing = append(lacing, 255)
+	}
+	if len(lacing) > 255 {
+		return fmt.Errorf("ogg packet too large: %d bytes", len(packet))
+	}
+
+	page := make([]byte, oggPageHeaderSize, oggPageHeaderSize+len(lacing)+len(packet))
+	copy(page, oggCapturePattern)
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], o.granule)
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.sequence)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	page = append(page, packet...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	o.sequence++
+	_, err := o.w.Write(page)
+	return err
+}
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggCRC is the unreflected CRC-32 used by Ogg, computed with the checksum
+// field set to zero.
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
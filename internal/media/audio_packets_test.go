@@ -0,0 +1,192 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// adtsFrame is a 10 byte AAC-LC frame, 48 kHz stereo, with a 3 byte payload.
+var adtsFrame = []byte{0xFF, 0xF1, 0x50, 0x80, 0x01, 0x5F, 0xFC, 0xAA, 0xBB, 0xCC}
+
+func TestADTSReader(t *testing.T) {
+	second := append([]byte(nil), adtsFrame...)
+	second[7] = 0x11
+	r := newADTSReader(bytes.NewReader(append(append([]byte(nil), adtsFrame...), second...)))
+
+	for i, want := range [][]byte{adtsFrame, second} {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d = % x, want % x", i, got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("after the last frame got %v, want EOF", err)
+	}
+}
+
+func TestADTSReaderRejectsBadFrames(t *testing.T) {
+	lostSync := append([]byte(nil), adtsFrame...)
+	lostSync[1] = 0x01
+	tooShort := append([]byte(nil), adtsFrame...)
+	tooShort[4], tooShort[5] = 0x00, 0xDF // length 6, under the header size
+	truncated := adtsFrame[:9]
+
+	for name, stream := range map[string][]byte{
+		"lost sync": lostSync,
+		"too short": tooShort,
+		"truncated": truncated,
+	} {
+		if _, err := newADTSReader(bytes.NewReader(stream)).Next(); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestOggCRC(t *testing.T) {
+	// The check value of the unreflected CRC-32 with polynomial 0x04C11DB7,
+	// zero initial value and no final XOR
+	if got := oggCRC([]byte("123456789")); got != 0x89A1897F {
+		t.Errorf("oggCRC(123456789) = %#08x, want 0x89a1897f", got)
+	}
+	if got := oggCRC(nil); got != 0 {
+		t.Errorf("oggCRC(nil) = %#08x, want 0", got)
+	}
+}
+
+func TestOggPageWriterHeaderPage(t *testing.T) {
+	// OpusHead for stereo 48 kHz input on stream 0x12345678
+	want := []byte{
+		0x4f, 0x67, 0x67, 0x53, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x78, 0x56, 0x34, 0x12, 0x00, 0x00, 0x00, 0x00, 0x23, 0xec,
+		0xb0, 0x3e, 0x01, 0x13, 0x4f, 0x70, 0x75, 0x73, 0x48, 0x65, 0x61, 0x64,
+		0x01, 0x02, 0x38, 0x01, 0x80, 0xbb, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+
+	var buf bytes.Buffer
+	if err := newOggPageWriter(&buf, 0x12345678).WriteOpusHeaders(2, 48000); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes()[:len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("OpusHead page =\n% x\nwant\n% x", got, want)
+	}
+}
+
+func TestOggPageWriterPacketPage(t *testing.T) {
+	var buf bytes.Buffer
+	w := newOggPageWriter(&buf, 7)
+	w.sequence = 2
+	if err := w.WritePacket(make([]byte, 300), 960); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(make([]byte, 255), 960); err != nil {
+		t.Fatal(err)
+	}
+
+	page := buf.Bytes()
+	if granule := binary.LittleEndian.Uint64(page[6:]); granule != 960 {
+		t.Errorf("granule position = %d, want 960", granule)
+	}
+	if seq := binary.LittleEndian.Uint32(page[18:]); seq != 2 {
+		t.Errorf("sequence = %d, want 2", seq)
+	}
+	if lacing := page[26:29]; !bytes.Equal(lacing, []byte{2, 255, 45}) {
+		t.Errorf("lacing of a 300 byte packet = %v, want [2 255 45]", lacing)
+	}
+
+	// A packet of exactly 255 bytes needs a zero lacing value to end it
+	second := page[oggPageHeaderSize+2+300:]
+	if lacing := second[26:29]; !bytes.Equal(lacing, []byte{2, 255, 0}) {
+		t.Errorf("lacing of a 255 byte packet = %v, want [2 255 0]", lacing)
+	}
+	if granule := binary.LittleEndian.Uint64(second[6:]); granule != 1920 {
+		t.Errorf("second granule position = %d, want 1920", granule)
+	}
+
+	// The stored checksum is that of the page with the field zeroed
+	checked := append([]byte(nil), page[:oggPageHeaderSize+2+300]...)
+	stored := binary.LittleEndian.Uint32(checked[22:])
+	binary.LittleEndian.PutUint32(checked[22:], 0)
+	if stored != oggCRC(checked) {
+		t.Errorf("stored checksum %#08x, want %#08x", stored, oggCRC(checked))
+	}
+}
+
+func TestOggRoundTrip(t *testing.T) {
+	packets := [][]byte{
+		{0xFC, 0x01},
+		bytes.Repeat([]byte{0x5A}, 255),
+		bytes.Repeat([]byte{0xA5}, 600),
+		{},
+		{0x7F},
+	}
+
+	var buf bytes.Buffer
+	w := newOggPageWriter(&buf, 1)
+	if err := w.WriteOpusHeaders(1, 44100); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p, 960); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := newOggPacketReader(&buf, 2)
+	for i, want := range packets {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("packet %d is %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("after the last packet got %v, want EOF", err)
+	}
+}
+
+// oggPage builds a page with the given lacing values and body.
+func oggPage(lacing []byte, body []byte) []byte {
+	page := make([]byte, oggPageHeaderSize)
+	copy(page, oggCapturePattern)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	return append(page, body...)
+}
+
+func TestOggPacketReaderJoinsPacketsAcrossPages(t *testing.T) {
+	first := bytes.Repeat([]byte{1}, 255)
+	var stream []byte
+	stream = append(stream, oggPage([]byte{255}, first)...)
+	stream = append(stream, oggPage([]byte{10, 3}, append(bytes.Repeat([]byte{2}, 10), 3, 3, 3))...)
+
+	r := newOggPacketReader(bytes.NewReader(stream), 0)
+	got, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte(nil), first...), bytes.Repeat([]byte{2}, 10)...); !bytes.Equal(got, want) {
+		t.Errorf("joined packet is %d bytes, want %d", len(got), len(want))
+	}
+	got, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{3, 3, 3}) {
+		t.Errorf("second packet = %v, want [3 3 3]", got)
+	}
+}
+
+func TestOggPacketReaderLostSync(t *testing.T) {
+	stream := oggPage([]byte{1}, []byte{0})
+	stream[0] = 'X'
+	if _, err := newOggPacketReader(bytes.NewReader(stream), 0).Next(); err == nil {
+		t.Error("no error for a page without the capture pattern")
+	}
+}
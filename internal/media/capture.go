@@ -1,58 +1,217 @@
 package media
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ringSlots must cover the frames queued in the channel, the one being
+	// read by the consumer and the one being filled by ffmpeg.
+	ringSlots      = 4
+	frameQueueSize = ringSlots - 2
+
+	// TestSourceDevice selects ffmpeg's lavfi test pattern instead of a camera.
+	TestSourceDevice = "testsrc"
 )
 
+// CameraCapture runs one long-lived ffmpeg process per capture session and
+// delivers raw YUV420p frames on a channel.
 type CameraCapture struct {
-	deviceID   string
-	resolution string
-	fps        int
+	deviceID    string
+	resolution  string
+	width       int
+	height      int
+	fps         int
+	frameSize   int
 	isCapturing bool
+	simulated   bool
+	logger      *logrus.Logger
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	frames chan RawFrame
+	stats  captureStats
 }
 
 func NewCameraCapture() *CameraCapture {
-	return &CameraCapture{
-		deviceID:   "0", // Default camera
-		resolution: "1280x720",
-		fps:        30,
+	c := &CameraCapture{
+		deviceID: "0", // Default camera
+		logger:   logrus.New(),
 	}
+	c.configure("1280x720", 30)
+	return c
+}
+
+// NewCameraCaptureWithConfig creates a capture using the configured
+// resolution and frame rate.
+func NewCameraCaptureWithConfig(cfg *config.MediaConfig) *CameraCapture {
+	c := NewCameraCapture()
+	if cfg != nil {
+		c.configure(cfg.Resolution, cfg.FrameRate)
+		if cfg.VideoDevice != "" {
+			c.deviceID = cfg.VideoDevice
+		}
+	}
+	return c
+}
+
+func (c *CameraCapture) configure(resolution string, fps int) {
+	width, height, err := ParseResolution(resolution)
+	if err != nil {
+		c.logger.Warnf("Invalid resolution %q, using 1280x720: %v", resolution, err)
+		width, height = 1280, 720
+	}
+	if fps <= 0 {
+		fps = 30
+	}
+
+	c.width = width
+	c.height = height
+	c.resolution = fmt.Sprintf("%dx%d", width, height)
+	c.fps = fps
+	c.frameSize = width * height * 3 / 2 // YUV420p
+}
+
+// SetDevice selects the capture device: a device index, a device path on
+// Linux, or TestSourceDevice for a synthetic ffmpeg test pattern.
+func (c *CameraCapture) SetDevice(deviceID string) {
+	c.deviceID = deviceID
+}
+
+// SetSimulated makes the capture generate a synthetic test pattern without
+// ffmpeg or a camera, as CAMERA_SIMULATION=true does.
+func (c *CameraCapture) SetSimulated(simulated bool) {
+	c.simulated = simulated
 }
 
 func (c *CameraCapture) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.isCapturing {
 		return fmt.Errorf("already capturing")
 	}
-	
-	// Check for simulation mode
-	if os.Getenv("CAMERA_SIMULATION") == "true" {
-		c.isCapturing = true
-		return nil
-	}
-	
-	// Check if camera is available
-	if !c.isCameraAvailable() {
-		return fmt.Errorf("no camera device found")
+
+	simulate := c.simulated || os.Getenv("CAMERA_SIMULATION") == "true"
+	if !simulate {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return fmt.Errorf("ffmpeg not found: %w", err)
+		}
+		// Check if camera is available
+		if c.deviceID != TestSourceDevice && !c.isCameraAvailable() {
+			return fmt.Errorf("no camera device found")
+		}
 	}
-	
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.frames = make(chan RawFrame, frameQueueSize)
+	c.stats.reset()
 	c.isCapturing = true
+
+	ring := newFrameRing(ringSlots, c.frameSize)
+	if simulate {
+		go c.simulateLoop(ctx, ring, c.frames, c.done)
+	} else {
+		go superviseCapture(ctx, c.logger, "Camera capture", c.ffmpegArgs(), ring, c.frames, c.done, &c.stats)
+	}
 	return nil
 }
 
 func (c *CameraCapture) Stop() {
+	c.mu.Lock()
+	if !c.isCapturing {
+		c.mu.Unlock()
+		return
+	}
 	c.isCapturing = false
+	c.cancel()
+	done := c.done
+	c.mu.Unlock()
+
+	<-done
 }
 
-func (c *CameraCapture) CaptureFrame() ([]byte, error) {
-	if !c.isCapturing {
-		return nil, fmt.Errorf("not capturing")
+// Frames returns the channel that delivers captured frames for the current
+// session. It is closed when capture stops. Each frame is a buffer from the
+// capture ring: it stays valid until the consumer receives the next frame
+// and must be copied if it is kept longer.
+func (c *CameraCapture) Frames() <-chan RawFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.frames
+}
+
+// GetStats returns the frames delivered, frames dropped because the consumer
+// fell behind, and how many times ffmpeg had to be restarted.
+func (c *CameraCapture) GetStats() (captured uint64, dropped uint64, restarts uint64) {
+	return c.stats.get()
+}
+
+func (c *CameraCapture) GetResolution() (width int, height int) {
+	return c.width, c.height
+}
+
+func (c *CameraCapture) GetFrameRate() int {
+	return c.fps
+}
+
+func (c *CameraCapture) ffmpegArgs() []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	args = append(args, c.inputArgs()...)
+	return append(args,
+		"-an",
+		"-f", "rawvideo",
+		"-pix_fmt", "yuv420p",
+		"-s", c.resolution,
+		"-r", strconv.Itoa(c.fps),
+		"-")
+}
+
+func (c *CameraCapture) inputArgs() []string {
+	if c.deviceID == TestSourceDevice {
+		return []string{
+			"-re",
+			"-f", "lavfi",
+			"-i", fmt.Sprintf("testsrc=size=%s:rate=%d", c.resolution, c.fps),
+		}
+	}
+
+	switch runtime.GOOS {
+	case "windows":
+		// Use DirectShow camera
+		device := c.deviceID
+		if device == "0" {
+			device = "USB2.0 PC CAMERA"
+		}
+		return []string{"-f", "dshow", "-framerate", strconv.Itoa(c.fps), "-i", "video=" + device}
+	case "darwin":
+		// Use AVFoundation
+		return []string{"-f", "avfoundation", "-framerate", strconv.Itoa(c.fps), "-i", c.deviceID}
+	default:
+		// Use Video4Linux
+		return []string{"-f", "v4l2", "-framerate", strconv.Itoa(c.fps), "-video_size", c.resolution, "-i", c.linuxDevicePath()}
+	}
+}
+
+func (c *CameraCapture) linuxDevicePath() string {
+	if strings.HasPrefix(c.deviceID, "/") {
+		return c.deviceID
 	}
-	
-	// Use system camera capture
-	return c.captureFromSystem()
+	return "/dev/video" + c.deviceID
 }
 
 func (c *CameraCapture) isCameraAvailable() bool {
@@ -67,120 +226,67 @@ func (c *CameraCapture) isCameraAvailable() bool {
 		return cmd.Run() == nil
 	case "linux":
 		// Check Linux camera
-		cmd := exec.Command("ls", "/dev/video0")
-		return cmd.Run() == nil
+		_, err := os.Stat(c.linuxDevicePath())
+		return err == nil
 	default:
 		return false
 	}
 }
 
-func (c *CameraCapture) captureFromSystem() ([]byte, error) {
-	// Capture actual frame from system camera
-	switch runtime.GOOS {
-	case "windows":
-		return c.captureWindows()
-	case "darwin":
-		return c.captureMacOS()
-	case "linux":
-		return c.captureLinux()
-	default:
-		return nil, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
-	}
-}
+// simulateLoop produces a moving test pattern at the configured frame rate
+// for environments without a camera or ffmpeg (CAMERA_SIMULATION=true).
+func (c *CameraCapture) simulateLoop(ctx context.Context, ring *frameRing, frames chan RawFrame, done chan struct{}) {
+	defer close(done)
+	defer close(frames)
 
-func (c *CameraCapture) captureWindows() ([]byte, error) {
-	// Use ffmpeg to capture from DirectShow camera
-	cmd := exec.Command("ffmpeg", 
-		"-f", "dshow",
-		"-i", fmt.Sprintf("video=USB2.0 PC CAMERA:audio=Microphone (USB2.0 MIC)"),
-		"-vframes", "1",
-		"-f", "rawvideo",
-		"-pix_fmt", "yuv420p",
-		"-s", c.resolution,
-		"-")
-	
-	output, err := cmd.Output()
-	if err != nil {
-		// Fallback to synthetic data if camera unavailable
-		return c.generateFallbackFrame(), nil
+	ticker := time.NewTicker(time.Second / time.Duration(c.fps))
+	defer ticker.Stop()
+
+	var n int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			buf := ring.Next()
+			c.drawTestPattern(buf, n)
+			deliverLatest(ring, frames, RawFrame{Data: buf, Captured: time.Now()}, &c.stats)
+			n++
+		}
 	}
-	
-	return output, nil
 }
 
-func (c *CameraCapture) captureMacOS() ([]byte, error) {
-	// Use ffmpeg to capture from AVFoundation
-	cmd := exec.Command("ffmpeg",
-		"-f", "avfoundation",
-		"-i", "0", // Default camera
-		"-vframes", "1",
-		"-f", "rawvideo",
-		"-pix_fmt", "yuv420p",
-		"-s", c.resolution,
-		"-")
-	
-	output, err := cmd.Output()
-	if err != nil {
-		// Fallback to synthetic data if camera unavailable
-		return c.generateFallbackFrame(), nil
+func (c *CameraCapture) drawTestPattern(buf []byte, n int) {
+	// Luma: diagonal bars scrolling one pixel per frame
+	lumaSize := c.width * c.height
+	for y := 0; y < c.height; y++ {
+		row := buf[y*c.width : (y+1)*c.width]
+		for x := range row {
+			row[x] = byte((x + y + n) % 256)
+		}
 	}
-	
-	return output, nil
-}
 
-func (c *CameraCapture) captureLinux() ([]byte, error) {
-	// Use ffmpeg to capture from Video4Linux
-	cmd := exec.Command("ffmpeg",
-		"-f", "v4l2",
-		"-i", "/dev/video0",
-		"-vframes", "1",
-		"-f", "rawvideo",
-		"-pix_fmt", "yuv420p",
-		"-s", c.resolution,
-		"-")
-	
-	output, err := cmd.Output()
-	if err != nil {
-		// Fallback to synthetic data if camera unavailable
-		return c.generateFallbackFrame(), nil
-	}
-	
-	return output, nil
-}
-
-func (c *CameraCapture) generateFallbackFrame() []byte {
-	// Generate fallback frame when camera is unavailable
-	frameSize := c.calculateFrameSize()
-	frameData := make([]byte, frameSize)
-	c.generateRealisticFrameData(frameData)
-	return frameData
-}
-
-func (c *CameraCapture) calculateFrameSize() int {
-	// Calculate realistic H.264 frame size based on resolution and quality
-	switch c.resolution {
-	case "1920x1080":
-		return 1024 * 80 // 80KB for 1080p
-	case "1280x720":
-		return 1024 * 50 // 50KB for 720p
-	case "854x480":
-		return 1024 * 25 // 25KB for 480p
-	default:
-		return 1024 * 50
+	// Chroma: neutral grey
+	for i := lumaSize; i < len(buf); i++ {
+		buf[i] = 128
 	}
 }
 
-func (c *CameraCapture) generateRealisticFrameData(data []byte) {
-	// Generate data that resembles H.264 NAL units
-	// H.264 frames start with NAL unit headers
-	
-	// SPS (Sequence Parameter Set) - typical H.264 header
-	nalHeader := []byte{0x00, 0x00, 0x00, 0x01, 0x67} // NAL unit start code + SPS
-	copy(data[:len(nalHeader)], nalHeader)
-	
-	// Fill rest with pseudo-random data that resembles compressed video
-	for i := len(nalHeader); i < len(data); i++ {
-		// Create patterns that resemble DCT coefficients
-		data[i] = byte((i*7 + i*i) % 256)
+// ParseResolution parses a "WIDTHxHEIGHT" string. Both dimensions must be
+// positive and even, as required by YUV420p.
+func ParseResolution(resolution string) (width int, height int, err error) {
+	w, h, ok := strings.Cut(resolution, "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected WIDTHxHEIGHT")
+	}
+	if width, err = strconv.Atoi(w); err != nil {
+		return 0, 0, fmt.Errorf("invalid width: %w", err)
+	}
+	if height, err = strconv.Atoi(h); err != nil {
+		return 0, 0, fmt.Errorf("invalid height: %w", err)
 	}
-}
\ No newline at end of file
+	if width <= 0 || height <= 0 || width%2 != 0 || height%2 != 0 {
+		return 0, 0, fmt.Errorf("dimensions must be positive and even")
+	}
+	return width, height, nil
+}
@@ -0,0 +1,29 @@
+package media
+
+import "time"
+
+// MediaClock produces 90 kHz presentation timestamps measured from the start
+// of a broadcast. Audio and video are stamped from the same clock at capture
+// so that receivers can line them up.
+type MediaClock struct {
+	start time.Time
+}
+
+func NewMediaClock() *MediaClock {
+	return &MediaClock{start: time.Now()}
+}
+
+// Now returns the current media time. It uses the monotonic clock, so wall
+// clock adjustments do not cause jumps.
+func (c *MediaClock) Now() uint64 {
+	return c.At(time.Now())
+}
+
+// At returns the media time of an instant, such as when a frame was
+// captured. Instants before the clock started are at zero.
+func (c *MediaClock) At(t time.Time) uint64 {
+	if t.Before(c.start) {
+		return 0
+	}
+	return DurationToPTS(t.Sub(c.start))
+}
@@ -1,7 +1,6 @@
 package media
 
 import (
-	"encoding/json"
 	"fmt"
 )
 
@@ -17,7 +16,7 @@ func (d *H264Decoder) Start() error {
 	if d.isDecoding {
 		return fmt.Errorf("decoder already started")
 	}
-	
+
 	d.isDecoding = true
 	return nil
 }
@@ -30,60 +29,46 @@ func (d *H264Decoder) DecodeFrame(encodedData []byte) (*DecodedFrame, error) {
 	if !d.isDecoding {
 		return nil, fmt.Errorf("decoder not started")
 	}
-	
-	if len(encodedData) < 4 {
-		return nil, fmt.Errorf("invalid frame data: too short")
-	}
-	
-	// Read metadata length
-	metadataLen := int(encodedData[0])<<24 | int(encodedData[1])<<16 | int(encodedData[2])<<8 | int(encodedData[3])
-	
-	if len(encodedData) < 4+metadataLen {
-		return nil, fmt.Errorf("invalid frame data: metadata length mismatch")
-	}
-	
-	// Extract metadata
-	metadataBytes := encodedData[4 : 4+metadataLen]
-	var framePackage struct {
-		Metadata FrameMetadata `json:"metadata"`
-		DataSize int           `json:"data_size"`
-	}
-	
-	if err := json.Unmarshal(metadataBytes, &framePackage); err != nil {
-		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+
+	header, payload, err := UnmarshalFrame(encodedData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid frame data: %w", err)
 	}
-	
-	// Extract frame data
-	frameData := encodedData[4+metadataLen:]
-	
-	if len(frameData) != framePackage.DataSize {
-		return nil, fmt.Errorf("frame data size mismatch: expected %d, got %d", 
-			framePackage.DataSize, len(frameData))
+	if header.Codec != CodecH264 {
+		return nil, fmt.Errorf("unexpected codec %s for H.264 decoder", header.Codec)
 	}
-	
+
 	return &DecodedFrame{
-		Metadata: framePackage.Metadata,
-		Data:     frameData,
+		Header: *header,
+		Data:   payload,
 	}, nil
 }
 
 type DecodedFrame struct {
-	Metadata FrameMetadata
-	Data     []byte
+	Header FrameHeader
+	Data   []byte
 }
 
 func (f *DecodedFrame) GetFrameID() uint64 {
-	return f.Metadata.FrameID
+	return f.Header.FrameID
 }
 
-func (f *DecodedFrame) GetQuality() string {
-	return f.Metadata.Quality
+func (f *DecodedFrame) GetStreamID() uint32 {
+	return f.Header.StreamID
 }
 
-func (f *DecodedFrame) GetSize() int {
-	return f.Metadata.Size
+func (f *DecodedFrame) GetCodec() Codec {
+	return f.Header.Codec
 }
 
-func (f *DecodedFrame) GetBitrate() int {
-	return f.Metadata.Bitrate
-}
\ No newline at end of file
+func (f *DecodedFrame) GetPTS() uint64 {
+	return f.Header.PTS
+}
+
+func (f *DecodedFrame) IsKeyframe() bool {
+	return f.Header.IsKeyframe()
+}
+
+func (f *DecodedFrame) GetSize() int {
+	return len(f.Data)
+}
@@ -1,117 +1,443 @@
 package media
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultGOPLength = 60 // 2 seconds at 30 fps
+	encoderQueueSize = 8
+
+	// A keyframe request this close to the next scheduled IDR waits for it
+	// rather than restarting the encoder
+	keyframeSlack = 500 * time.Millisecond
 )
 
+// EncodedFrame is one compressed access unit together with the header it is
+// sent with.
+type EncodedFrame struct {
+	Header FrameHeader
+	Data   []byte
+}
+
+// Marshal returns the frame in wire format.
+func (f *EncodedFrame) Marshal() []byte {
+	return MarshalFrame(&f.Header, f.Data)
+}
+
+func (f *EncodedFrame) IsKeyframe() bool {
+	return f.Header.IsKeyframe()
+}
+
+// H264Encoder compresses raw YUV420p frames to H.264 Annex-B access units by
+// piping them through a long-lived ffmpeg/libx264 process.
 type H264Encoder struct {
-	bitrate    int
-	quality    string
-	profile    string
-	isEncoding bool
+	bitrate     int
+	quality     string
+	profile     string
+	gopLength   int
+	width       int
+	height      int
+	inputWidth  int
+	inputHeight int
+	fps         int
+	streamID    uint32
+	isEncoding  bool
+	logger      *logrus.Logger
+
+	// mu guards the process lifecycle. The pipe write and the wait for a
+	// replaced process to drain happen outside it, so that Stop can
+	// interrupt a blocked EncodeFrame and Frames never waits for it.
+	mu                sync.Mutex
+	ctx               context.Context
+	cancel            context.CancelFunc
+	proc              *encoderProcess
+	output            chan *EncodedFrame // set by Start, read without mu
+	keyframeRequested bool
+	restartNeeded     bool // the process died and must be replaced
+	submitted         int  // frames written to the current process
+
+	// pendingMu guards the headers of frames submitted to ffmpeg but not yet
+	// read back. libx264 with zerolatency emits exactly one access unit per
+	// input frame, in order.
+	pendingMu sync.Mutex
+	pending   []FrameHeader
+	encoded   uint64
+	keyframes uint64
+}
+
+type encoderProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{} // closed once stdout has been drained
+
+	waitOnce sync.Once
+	waitErr  error
+}
+
+// wait reaps the process once stdout is drained. Both Stop and a restart
+// may wait for the same process.
+func (p *encoderProcess) wait() error {
+	<-p.done
+	p.waitOnce.Do(func() { p.waitErr = p.cmd.Wait() })
+	return p.waitErr
 }
 
 func NewH264Encoder(quality string) *H264Encoder {
 	encoder := &H264Encoder{
-		quality: quality,
-		profile: "baseline",
+		quality:   quality,
+		profile:   "baseline",
+		gopLength: defaultGOPLength,
+		fps:       30,
+		logger:    logrus.New(),
 	}
-	
-	// Set bitrate based on quality
+
+	// Set bitrate and output size based on quality
 	switch quality {
 	case "1080p":
 		encoder.bitrate = 4000000 // 4 Mbps
+		encoder.width, encoder.height = 1920, 1080
 	case "720p":
 		encoder.bitrate = 2000000 // 2 Mbps
+		encoder.width, encoder.height = 1280, 720
 	case "480p":
 		encoder.bitrate = 1000000 // 1 Mbps
+		encoder.width, encoder.height = 854, 480
 	default:
 		encoder.bitrate = 2000000
+		encoder.width, encoder.height = 1280, 720
 	}
-	
+	encoder.inputWidth, encoder.inputHeight = encoder.width, encoder.height
+
 	return encoder
 }
 
+// NewH264EncoderWithConfig creates an encoder for quality and applies the
+// configured bitrate (kbps), frame rate and GOP length when set.
+func NewH264EncoderWithConfig(quality string, cfg *config.MediaConfig) *H264Encoder {
+	encoder := NewH264Encoder(quality)
+	if cfg == nil {
+		return encoder
+	}
+
+	if cfg.Bitrate > 0 {
+		encoder.bitrate = cfg.Bitrate * 1000
+	}
+	if cfg.FrameRate > 0 {
+		encoder.fps = cfg.FrameRate
+	}
+	if cfg.GOPLength > 0 {
+		encoder.gopLength = cfg.GOPLength
+	}
+	return encoder
+}
+
+// SetStreamID sets the stream ID written into every frame header.
+func (e *H264Encoder) SetStreamID(streamID uint32) {
+	e.streamID = streamID
+}
+
+// SetInputFormat declares the size and rate of the raw frames passed to
+// EncodeFrame. Frames are scaled to the quality's output size.
+func (e *H264Encoder) SetInputFormat(width, height, fps int) {
+	e.inputWidth, e.inputHeight = width, height
+	if fps > 0 {
+		e.fps = fps
+	}
+}
+
+// SetProfile selects the H.264 profile, e.g. "baseline" or "main".
+func (e *H264Encoder) SetProfile(profile string) {
+	e.profile = profile
+}
+
+func (e *H264Encoder) GetBitrate() int {
+	return e.bitrate
+}
+
+func (e *H264Encoder) GetGOPLength() int {
+	return e.gopLength
+}
+
 func (e *H264Encoder) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	if e.isEncoding {
 		return fmt.Errorf("encoder already started")
 	}
-	
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("ffmpeg not found: %w", err)
+	}
+
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.output = make(chan *EncodedFrame, encoderQueueSize)
+	e.pending = nil
+	e.encoded = 0
+	e.keyframes = 0
+	e.keyframeRequested = false
+	e.restartNeeded = false
+
+	proc, err := e.startProcess()
+	if err != nil {
+		e.cancel()
+		return err
+	}
+	e.proc = proc
+	e.submitted = 0
 	e.isEncoding = true
 	return nil
 }
 
 func (e *H264Encoder) Stop() {
+	e.mu.Lock()
+	if !e.isEncoding {
+		e.mu.Unlock()
+		return
+	}
 	e.isEncoding = false
+	// Killing ffmpeg also unblocks a write in progress in EncodeFrame
+	e.cancel()
+	proc := e.proc
+	e.mu.Unlock()
+
+	proc.wait()
+	close(e.output)
 }
 
-func (e *H264Encoder) EncodeFrame(rawData []byte, frameID uint64) ([]byte, error) {
+// Frames returns the channel of encoded access units for the session begun
+// by the last Start. Output lags input by one frame, because an access unit
+// is only complete once the next one starts.
+func (e *H264Encoder) Frames() <-chan *EncodedFrame {
+	return e.output
+}
+
+// RequestKeyframe makes the next encoded frame an IDR, or the scheduled one
+// if it is due within keyframeSlack.
+func (e *H264Encoder) RequestKeyframe() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.keyframeRequested = true
+}
+
+// GetStats returns the number of access units produced and how many were IDRs.
+func (e *H264Encoder) GetStats() (encoded uint64, keyframes uint64) {
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+	return e.encoded, e.keyframes
+}
+
+// EncodeFrame submits one raw YUV420p frame. The encoded result is delivered
+// on Frames(). It must not be called concurrently with itself.
+func (e *H264Encoder) EncodeFrame(rawData []byte, frameID uint64, pts uint64) error {
+	e.mu.Lock()
 	if !e.isEncoding {
+		e.mu.Unlock()
+		return fmt.Errorf("encoder not started")
+	}
+	if want := e.inputWidth * e.inputHeight * 3 / 2; len(rawData) != want {
+		e.mu.Unlock()
+		return fmt.Errorf("raw frame is %d bytes, expected %d", len(rawData), want)
+	}
+
+	// ffmpeg cannot be told to emit an IDR mid-stream, but a fresh process
+	// always starts with one. Restarting costs a process launch and a
+	// frame of latency, so a request shortly before a scheduled IDR waits
+	// for it instead.
+	if e.keyframeRequested && e.framesToIDR() <= int(keyframeSlack*time.Duration(e.fps)/time.Second) {
+		e.keyframeRequested = false
+	}
+	restart := e.keyframeRequested || e.restartNeeded
+	e.keyframeRequested, e.restartNeeded = false, false
+	proc := e.proc
+	e.mu.Unlock()
+
+	if restart {
+		var err error
+		if proc, err = e.restartProcess(proc); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	if !e.isEncoding || e.proc != proc {
+		// Stopped, and perhaps started again, meanwhile
+		e.mu.Unlock()
+		return fmt.Errorf("encoder not started")
+	}
+	e.submitted++
+	e.pendingMu.Lock()
+	e.pending = append(e.pending, FrameHeader{
+		StreamID: e.streamID,
+		FrameID:  frameID,
+		PTS:      pts,
+		DTS:      pts,
+		Codec:    CodecH264,
+	})
+	e.pendingMu.Unlock()
+	e.mu.Unlock()
+
+	if _, err := proc.stdin.Write(rawData); err != nil {
+		// Replace the dead process on the next frame
+		e.mu.Lock()
+		e.restartNeeded = true
+		e.mu.Unlock()
+		return fmt.Errorf("failed to write frame to encoder: %w", err)
+	}
+	return nil
+}
+
+// framesToIDR returns how many frames the current process encodes before
+// its next scheduled IDR, zero if the next frame is one.
+func (e *H264Encoder) framesToIDR() int {
+	if e.gopLength <= 0 {
+		return 0
+	}
+	return (e.gopLength - e.submitted%e.gopLength) % e.gopLength
+}
+
+// restartProcess flushes old and replaces it with a new ffmpeg. It waits for
+// old to drain without holding mu, because draining may need the consumer
+// to receive from Frames.
+func (e *H264Encoder) restartProcess(old *encoderProcess) (*encoderProcess, error) {
+	old.stdin.Close()
+	if err := old.wait(); err != nil && e.ctx.Err() == nil {
+		e.logger.Warnf("Encoder process exited with error: %v", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.isEncoding || e.proc != old {
 		return nil, fmt.Errorf("encoder not started")
 	}
-	
-	// Create frame metadata
-	frameInfo := FrameMetadata{
-		FrameID:   frameID,
-		Timestamp: time.Now(),
-		Type:      "video",
-		Codec:     "h264",
-		Quality:   e.quality,
-		Bitrate:   e.bitrate,
-		Profile:   e.profile,
-		Size:      len(rawData),
-	}
-	
-	// Encode frame info + data
-	return e.encodeWithMetadata(frameInfo, rawData)
-}
-
-type FrameMetadata struct {
-	FrameID   uint64    `json:"frame_id"`
-	Timestamp time.Time `json:"timestamp"`
-	Type      string    `json:"type"`
-	Codec     string    `json:"codec"`
-	Quality   string    `json:"quality"`
-	Bitrate   int       `json:"bitrate"`
-	Profile   string    `json:"profile"`
-	Size      int       `json:"size"`
-}
-
-func (e *H264Encoder) encodeWithMetadata(metadata FrameMetadata, data []byte) ([]byte, error) {
-	// Create frame package with metadata + data
-	framePackage := struct {
-		Metadata FrameMetadata `json:"metadata"`
-		DataSize int           `json:"data_size"`
-	}{
-		Metadata: metadata,
-		DataSize: len(data),
-	}
-	
-	// Serialize metadata
-	metadataBytes, err := json.Marshal(framePackage)
+
+	// Frames the old process never emitted are lost
+	e.pendingMu.Lock()
+	e.pending = nil
+	e.pendingMu.Unlock()
+
+	proc, err := e.startProcess()
+	if err != nil {
+		// Try again on the next frame
+		e.restartNeeded = true
+		return nil, err
+	}
+	e.proc = proc
+	e.submitted = 0
+	return proc, nil
+}
+
+func (e *H264Encoder) startProcess() (*encoderProcess, error) {
+	cmd := exec.CommandContext(e.ctx, "ffmpeg", e.ffmpegArgs()...)
+	stderr := e.logger.WriterLevel(logrus.DebugLevel)
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		stderr.Close()
+		return nil, fmt.Errorf("failed to open encoder stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode metadata: %w", err)
-	}
-	
-	// Create final frame: [metadata_length][metadata][data]
-	metadataLen := len(metadataBytes)
-	totalSize := 4 + metadataLen + len(data) // 4 bytes for length + metadata + data
-	
-	result := make([]byte, totalSize)
-	
-	// Write metadata length (4 bytes)
-	result[0] = byte(metadataLen >> 24)
-	result[1] = byte(metadataLen >> 16)
-	result[2] = byte(metadataLen >> 8)
-	result[3] = byte(metadataLen)
-	
-	// Write metadata
-	copy(result[4:4+metadataLen], metadataBytes)
-	
-	// Write frame data
-	copy(result[4+metadataLen:], data)
-	
-	return result, nil
-}
\ No newline at end of file
+		stderr.Close()
+		return nil, fmt.Errorf("failed to open encoder stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		stderr.Close()
+		return nil, fmt.Errorf("failed to start encoder: %w", err)
+	}
+
+	proc := &encoderProcess{
+		cmd:   cmd,
+		stdin: stdin,
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer stderr.Close()
+		e.readLoop(stdout, proc)
+	}()
+	return proc, nil
+}
+
+// readLoop delivers the access units of a process until its output ends.
+// Output that cannot be parsed, such as a NAL unit over maxNALSize, leaves
+// ffmpeg with nobody reading it, so the process is killed and replaced on
+// the next frame.
+func (e *H264Encoder) readLoop(stdout io.Reader, proc *encoderProcess) {
+	defer close(proc.done)
+
+	reader := newAnnexBReader(stdout)
+	for {
+		au, err := reader.Next()
+		if err != nil {
+			if err != io.EOF && e.ctx.Err() == nil {
+				e.logger.Errorf("Failed to read encoder output, restarting encoder: %v", err)
+				proc.cmd.Process.Kill()
+				e.mu.Lock()
+				if e.proc == proc {
+					e.restartNeeded = true
+				}
+				e.mu.Unlock()
+			}
+			return
+		}
+
+		e.pendingMu.Lock()
+		if len(e.pending) == 0 {
+			e.pendingMu.Unlock()
+			e.logger.Warn("Encoder produced an access unit with no pending frame")
+			continue
+		}
+		header := e.pending[0]
+		e.pending = e.pending[1:]
+		e.encoded++
+		if ContainsIDR(au) {
+			header.Flags |= FlagKeyframe
+			e.keyframes++
+		}
+		e.pendingMu.Unlock()
+
+		select {
+		case e.output <- &EncodedFrame{Header: header, Data: au}:
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *H264Encoder) ffmpegArgs() []string {
+	kbps := e.bitrate / 1000
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-f", "rawvideo",
+		"-pix_fmt", "yuv420p",
+		"-s", fmt.Sprintf("%dx%d", e.inputWidth, e.inputHeight),
+		"-r", strconv.Itoa(e.fps),
+		"-i", "-",
+		"-vf", fmt.Sprintf("scale=%d:%d", e.width, e.height),
+		"-c:v", "libx264",
+		"-profile:v", e.profile,
+		"-preset", "ultrafast",
+		"-tune", "zerolatency",
+		"-b:v", fmt.Sprintf("%dk", kbps),
+		"-maxrate", fmt.Sprintf("%dk", kbps),
+		"-bufsize", fmt.Sprintf("%dk", kbps/2),
+		"-g", strconv.Itoa(e.gopLength),
+		"-keyint_min", strconv.Itoa(e.gopLength),
+		"-sc_threshold", "0",
+		"-bf", "0",
+		"-x264-params", "aud=1:repeat-headers=1",
+		"-flush_packets", "1",
+		"-f", "h264",
+		"-",
+	}
+}
@@ -0,0 +1,85 @@
+package media
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFramesToIDR(t *testing.T) {
+	tests := []struct {
+		gopLength int
+		submitted int
+		want      int
+	}{
+		{0, 0, 0},
+		{0, 7, 0},
+		{30, 0, 0},
+		{30, 1, 29},
+		{30, 29, 1},
+		{30, 30, 0},
+		{30, 31, 29},
+		{1, 5, 0},
+	}
+	for _, tt := range tests {
+		e := &H264Encoder{gopLength: tt.gopLength, submitted: tt.submitted}
+		if got := e.framesToIDR(); got != tt.want {
+			t.Errorf("framesToIDR() with GOP %d after %d frames = %d, want %d", tt.gopLength, tt.submitted, got, tt.want)
+		}
+	}
+}
+
+// An encoder whose output cannot be parsed is killed and replaced, rather
+// than left running with nobody reading it.
+func TestEncoderReplacesProcessOnUnreadableOutput(t *testing.T) {
+	// The first process emits a NAL unit over maxNALSize, later ones only
+	// read their input. The helpers must not hold stderr open once the
+	// script is killed.
+	marker := t.TempDir() + "/started"
+	fakeFFmpeg(t, `if [ ! -e `+marker+` ]; then
+	touch `+marker+`
+	printf '\000\000\000\001\011\360'
+	head -c `+strconv.Itoa(maxNALSize+1024)+` /dev/zero 2>/dev/null | tr '\000' '\377' 2>/dev/null
+fi
+exec cat >/dev/null
+`)
+
+	e := NewH264Encoder("480p")
+	e.SetInputFormat(16, 16, 30)
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	frame := make([]byte, 16*16*3/2)
+	if err := e.EncodeFrame(frame, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	e.mu.Lock()
+	first := e.proc
+	e.mu.Unlock()
+	select {
+	case <-first.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the encoder kept reading the oversized NAL unit")
+	}
+	e.mu.Lock()
+	restart := e.restartNeeded
+	e.mu.Unlock()
+	if !restart {
+		t.Fatal("no restart scheduled after unreadable output")
+	}
+	if err := first.wait(); err == nil {
+		t.Error("the first process was not killed")
+	}
+
+	if err := e.EncodeFrame(frame, 2, 3000); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	replaced := e.proc != first
+	e.mu.Unlock()
+	if !replaced {
+		t.Error("the process was not replaced on the next frame")
+	}
+}
@@ -0,0 +1,135 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	minRestartDelay = 500 * time.Millisecond
+	maxRestartDelay = 10 * time.Second
+	stableRunTime   = 5 * time.Second
+)
+
+// captureStats counts the blocks a capture pipeline delivered, dropped and
+// how often its process had to be restarted.
+type captureStats struct {
+	mu       sync.Mutex
+	captured uint64
+	dropped  uint64
+	restarts uint64
+}
+
+func (s *captureStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captured, s.dropped, s.restarts = 0, 0, 0
+}
+
+func (s *captureStats) get() (captured uint64, dropped uint64, restarts uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.captured, s.dropped, s.restarts
+}
+
+// superviseCapture keeps an ffmpeg capture pipeline running until ctx is
+// cancelled, restarting it with exponential backoff whenever it exits. It
+// closes frames and then done when it returns.
+func superviseCapture(ctx context.Context, logger *logrus.Logger, name string, args []string, ring *frameRing, frames chan RawFrame, done chan struct{}, stats *captureStats) {
+	defer close(done)
+	defer close(frames)
+
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		err := runCapturePipeline(ctx, logger, args, ring, frames, stats)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > stableRunTime {
+			delay = minRestartDelay
+		}
+		stats.mu.Lock()
+		stats.restarts++
+		stats.mu.Unlock()
+		logger.Warnf("%s exited: %v, restarting in %s", name, err, delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// runCapturePipeline starts ffmpeg and reads fixed-size blocks from its
+// stdout until the process exits or ctx is cancelled.
+func runCapturePipeline(ctx context.Context, logger *logrus.Logger, args []string, ring *frameRing, frames chan RawFrame, stats *captureStats) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	stderr := logger.WriterLevel(logrus.DebugLevel)
+	defer stderr.Close()
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open ffmpeg stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	var readErr error
+	for {
+		buf := ring.Next()
+		if _, readErr = io.ReadFull(stdout, buf); readErr != nil {
+			break
+		}
+		deliverLatest(ring, frames, RawFrame{Data: buf, Captured: time.Now()}, stats)
+	}
+
+	// Make sure the process is gone before reporting why it stopped
+	cmd.Process.Kill()
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		return fmt.Errorf("ffmpeg exited: %w", waitErr)
+	}
+	return fmt.Errorf("ffmpeg output ended: %w", readErr)
+}
+
+// deliverLatest queues a block, dropping the oldest queued block if the
+// consumer has fallen behind so that latency stays bounded. Dropped blocks
+// go back to the ring.
+func deliverLatest(ring *frameRing, frames chan RawFrame, frame RawFrame, stats *captureStats) {
+	for {
+		select {
+		case frames <- frame:
+			ring.delivered(frame.Data)
+			stats.mu.Lock()
+			stats.captured++
+			stats.mu.Unlock()
+			return
+		default:
+		}
+
+		select {
+		case old := <-frames:
+			ring.dropped(old.Data)
+			stats.mu.Lock()
+			stats.dropped++
+			stats.mu.Unlock()
+		default:
+		}
+	}
+}
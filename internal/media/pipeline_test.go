@@ -0,0 +1,73 @@
+package media
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A capture process that keeps exiting is restarted with a growing delay,
+// and supervision ends, closing its channels, when the context does.
+func TestSuperviseCaptureRestartsWithBackoff(t *testing.T) {
+	// Every run captures one block, then dies
+	fakeFFmpeg(t, "printf 'ABCDEFGH'\nexit 1\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ring := newFrameRing(4, 8)
+	frames := make(chan RawFrame, 2)
+	done := make(chan struct{})
+	var stats captureStats
+	go superviseCapture(ctx, logrus.New(), "Test capture", nil, ring, frames, done, &stats)
+
+	var arrivals []time.Time
+	for len(arrivals) < 3 {
+		select {
+		case frame := <-frames:
+			if string(frame.Data) != "ABCDEFGH" {
+				t.Fatalf("captured %q", frame.Data)
+			}
+			arrivals = append(arrivals, time.Now())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d runs captured", len(arrivals))
+		}
+	}
+	for i, want := range []time.Duration{minRestartDelay, 2 * minRestartDelay} {
+		if gap := arrivals[i+1].Sub(arrivals[i]); gap < want || gap > want+400*time.Millisecond {
+			t.Errorf("restart %d came after %s, want about %s", i+1, gap, want)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervision did not end with its context")
+	}
+	for range frames {
+	}
+	if captured, _, restarts := stats.get(); captured < 3 || restarts < 2 {
+		t.Errorf("stats: %d captured, %d restarts", captured, restarts)
+	}
+}
+
+// A process that cannot be started at all is retried like one that exits.
+func TestSuperviseCaptureRetriesMissingFFmpeg(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	ctx, cancel := context.WithTimeout(context.Background(), minRestartDelay+200*time.Millisecond)
+	defer cancel()
+	frames := make(chan RawFrame, 2)
+	done := make(chan struct{})
+	var stats captureStats
+	superviseCapture(ctx, logrus.New(), "Test capture", nil, newFrameRing(4, 8), frames, done, &stats)
+
+	if _, _, restarts := stats.get(); restarts != 2 {
+		t.Errorf("%d restarts in %s, want 2", restarts, minRestartDelay+200*time.Millisecond)
+	}
+	if _, ok := <-frames; ok {
+		t.Error("frames left open")
+	}
+}
@@ -0,0 +1,162 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// opusFrameSamples matches the 20 ms frame duration used by AudioEncoder.
+const opusFrameSamples = 960
+
+// AudioPlayer plays received audio frames through ffplay on the default
+// output device.
+type AudioPlayer struct {
+	codec      Codec
+	sampleRate int
+	channels   int
+	isPlaying  bool
+	logger     *logrus.Logger
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	ogg    *oggPageWriter
+}
+
+// NewAudioPlayer creates a player for codec. The sample rate and channel
+// count are only needed for PCM and for the Opus stream header.
+func NewAudioPlayer(codec Codec, sampleRate, channels int) *AudioPlayer {
+	if sampleRate <= 0 {
+		sampleRate = defaultSampleRate
+	}
+	if channels <= 0 {
+		channels = defaultChannels
+	}
+
+	return &AudioPlayer{
+		codec:      codec,
+		sampleRate: sampleRate,
+		channels:   channels,
+		logger:     logrus.New(),
+	}
+}
+
+func (p *AudioPlayer) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.isPlaying {
+		return fmt.Errorf("player already started")
+	}
+	if _, err := exec.LookPath("ffplay"); err != nil {
+		return fmt.Errorf("ffplay not found: %w", err)
+	}
+
+	args, err := p.ffplayArgs()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, "ffplay", args...)
+	cmd.Stderr = p.logger.WriterLevel(logrus.DebugLevel)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to open player stdin: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("failed to start player: %w", err)
+	}
+
+	p.cancel = cancel
+	p.cmd = cmd
+	p.stdin = stdin
+	p.ogg = nil
+	if p.codec == CodecOpus {
+		p.ogg = newOggPageWriter(stdin, 1)
+		if err := p.ogg.WriteOpusHeaders(p.channels, p.sampleRate); err != nil {
+			cancel()
+			cmd.Wait()
+			return fmt.Errorf("failed to write Opus headers: %w", err)
+		}
+	}
+
+	p.isPlaying = true
+	return nil
+}
+
+func (p *AudioPlayer) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.isPlaying {
+		return
+	}
+	p.isPlaying = false
+	p.stdin.Close()
+	p.cancel()
+	p.cmd.Wait()
+}
+
+// PlayFrame queues one decoded audio frame for playback.
+func (p *AudioPlayer) PlayFrame(frame *DecodedFrame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.isPlaying {
+		return fmt.Errorf("player not started")
+	}
+	if frame.GetCodec() != p.codec {
+		return fmt.Errorf("unexpected codec %s for %s player", frame.GetCodec(), p.codec)
+	}
+
+	if p.ogg != nil {
+		return p.ogg.WritePacket(frame.Data, opusFrameSamples)
+	}
+	// ADTS and raw PCM are self-delimiting streams
+	_, err := p.stdin.Write(frame.Data)
+	return err
+}
+
+func (p *AudioPlayer) ffplayArgs() ([]string, error) {
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-nodisp",
+		"-fflags", "nobuffer",
+		"-flags", "low_delay",
+		"-probesize", "32",
+	}
+
+	switch p.codec {
+	case CodecAAC:
+		args = append(args, "-f", "adts")
+	case CodecOpus:
+		args = append(args, "-f", "ogg")
+	case CodecPCM:
+		args = append(args, "-f", "s16le", "-sample_rate", strconv.Itoa(p.sampleRate), "-ch_layout", channelLayout(p.channels))
+	default:
+		return nil, fmt.Errorf("unsupported audio codec %s", p.codec)
+	}
+	return append(args, "-i", "-"), nil
+}
+
+func channelLayout(channels int) string {
+	switch channels {
+	case 1:
+		return "mono"
+	case 2:
+		return "stereo"
+	default:
+		return strconv.Itoa(channels) + "c"
+	}
+}
@@ -0,0 +1,124 @@
+package media
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RawEncoder passes frames through uncompressed. Every frame is a keyframe.
+// It is useful for testing and for sources that are already compressed.
+type RawEncoder struct {
+	streamID   uint32
+	codec      Codec
+	isEncoding bool
+
+	mu     sync.Mutex
+	output chan *EncodedFrame
+}
+
+func NewRawEncoder(streamID uint32, codec Codec) *RawEncoder {
+	return &RawEncoder{
+		streamID: streamID,
+		codec:    codec,
+	}
+}
+
+func (e *RawEncoder) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.isEncoding {
+		return fmt.Errorf("encoder already started")
+	}
+
+	e.output = make(chan *EncodedFrame, encoderQueueSize)
+	e.isEncoding = true
+	return nil
+}
+
+func (e *RawEncoder) Stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.isEncoding {
+		return
+	}
+	e.isEncoding = false
+	close(e.output)
+}
+
+func (e *RawEncoder) Frames() <-chan *EncodedFrame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.output
+}
+
+func (e *RawEncoder) RequestKeyframe() {}
+
+// EncodeFrame copies rawData into a frame. If the output queue is full the
+// frame is dropped rather than blocking the source.
+func (e *RawEncoder) EncodeFrame(rawData []byte, frameID uint64, pts uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.isEncoding {
+		return fmt.Errorf("encoder not started")
+	}
+
+	frame := &EncodedFrame{
+		Header: FrameHeader{
+			Flags:    FlagKeyframe,
+			StreamID: e.streamID,
+			FrameID:  frameID,
+			PTS:      pts,
+			DTS:      pts,
+			Codec:    e.codec,
+		},
+		Data: append([]byte(nil), rawData...),
+	}
+
+	select {
+	case e.output <- frame:
+		return nil
+	default:
+		return fmt.Errorf("encoder queue full, dropped frame %d", frameID)
+	}
+}
+
+// RawDecoder accepts frames of any codec and returns their payload as is.
+type RawDecoder struct {
+	isDecoding bool
+}
+
+func NewRawDecoder() *RawDecoder {
+	return &RawDecoder{}
+}
+
+func (d *RawDecoder) Start() error {
+	if d.isDecoding {
+		return fmt.Errorf("decoder already started")
+	}
+
+	d.isDecoding = true
+	return nil
+}
+
+func (d *RawDecoder) Stop() {
+	d.isDecoding = false
+}
+
+func (d *RawDecoder) DecodeFrame(encodedData []byte) (*DecodedFrame, error) {
+	if !d.isDecoding {
+		return nil, fmt.Errorf("decoder not started")
+	}
+
+	header, payload, err := UnmarshalFrame(encodedData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid frame data: %w", err)
+	}
+
+	return &DecodedFrame{
+		Header: *header,
+		Data:   payload,
+	}, nil
+}
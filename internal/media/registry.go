@@ -0,0 +1,234 @@
+package media
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+// RawFrame is a raw frame or sample block from a source, stamped when its
+// capture completed.
+type RawFrame struct {
+	Data     []byte
+	Captured time.Time
+}
+
+// VideoSource produces raw YUV420p frames.
+type VideoSource interface {
+	Start() error
+	Stop()
+	// Frames delivers frames until the source stops. A frame's data may be
+	// reused by the source once the next one has been received.
+	Frames() <-chan RawFrame
+	GetResolution() (width int, height int)
+	GetFrameRate() int
+}
+
+// AudioSource produces blocks of interleaved signed 16-bit little-endian PCM.
+type AudioSource interface {
+	Start() error
+	Stop()
+	// Frames delivers sample blocks until the source stops, with the same
+	// reuse rule as VideoSource.
+	Frames() <-chan RawFrame
+	GetSampleRate() int
+	GetChannels() int
+}
+
+// Encoder compresses raw frames. Output is asynchronous and may lag input.
+type Encoder interface {
+	Start() error
+	Stop()
+	// EncodeFrame submits a raw frame with the media clock PTS at which it
+	// was captured.
+	EncodeFrame(rawData []byte, frameID uint64, pts uint64) error
+	Frames() <-chan *EncodedFrame
+	// RequestKeyframe makes the next output frame independently decodable.
+	RequestKeyframe()
+}
+
+// Decoder turns wire frames back into media frames.
+type Decoder interface {
+	Start() error
+	Stop()
+	DecodeFrame(encodedData []byte) (*DecodedFrame, error)
+}
+
+// EncoderConfig describes the input an encoder will receive and the stream
+// it encodes for.
+type EncoderConfig struct {
+	Quality  string
+	StreamID uint32
+	Media    *config.MediaConfig
+
+	// Video input
+	Width     int
+	Height    int
+	FrameRate int
+
+	// Audio input
+	SampleRate int
+	Channels   int
+}
+
+type (
+	VideoSourceFactory func(cfg *config.MediaConfig) (VideoSource, error)
+	AudioSourceFactory func(cfg *config.MediaConfig) (AudioSource, error)
+	EncoderFactory     func(cfg EncoderConfig) (Encoder, error)
+	DecoderFactory     func() (Decoder, error)
+)
+
+var (
+	registryMu   sync.RWMutex
+	videoSources = map[string]VideoSourceFactory{}
+	audioSources = map[string]AudioSourceFactory{}
+	encoders     = map[string]EncoderFactory{}
+	decoders     = map[string]DecoderFactory{}
+)
+
+func init() {
+	RegisterVideoSource("camera", func(cfg *config.MediaConfig) (VideoSource, error) {
+		return NewCameraCaptureWithConfig(cfg), nil
+	})
+	RegisterVideoSource(TestSourceDevice, func(cfg *config.MediaConfig) (VideoSource, error) {
+		c := NewCameraCaptureWithConfig(cfg)
+		c.SetDevice(TestSourceDevice)
+		return c, nil
+	})
+	RegisterVideoSource("pattern", func(cfg *config.MediaConfig) (VideoSource, error) {
+		c := NewCameraCaptureWithConfig(cfg)
+		c.SetSimulated(true)
+		return c, nil
+	})
+
+	RegisterAudioSource("microphone", func(cfg *config.MediaConfig) (AudioSource, error) {
+		return NewAudioCaptureWithConfig(cfg), nil
+	})
+	RegisterAudioSource("tone", func(cfg *config.MediaConfig) (AudioSource, error) {
+		a := NewAudioCaptureWithConfig(cfg)
+		a.SetSimulated(true)
+		return a, nil
+	})
+
+	RegisterEncoder("h264", func(cfg EncoderConfig) (Encoder, error) {
+		e := NewH264EncoderWithConfig(cfg.Quality, cfg.Media)
+		e.SetStreamID(cfg.StreamID)
+		e.SetInputFormat(cfg.Width, cfg.Height, cfg.FrameRate)
+		return e, nil
+	})
+	RegisterEncoder("raw", func(cfg EncoderConfig) (Encoder, error) {
+		return NewRawEncoder(cfg.StreamID, CodecRawVideo), nil
+	})
+	for _, codec := range []Codec{CodecAAC, CodecOpus} {
+		codec := codec
+		RegisterEncoder(codec.String(), func(cfg EncoderConfig) (Encoder, error) {
+			e, err := NewAudioEncoderWithConfig(codec, cfg.SampleRate, cfg.Channels, cfg.Media)
+			if err != nil {
+				return nil, err
+			}
+			e.SetStreamID(cfg.StreamID)
+			return e, nil
+		})
+	}
+	RegisterEncoder("pcm", func(cfg EncoderConfig) (Encoder, error) {
+		return NewRawEncoder(cfg.StreamID, CodecPCM), nil
+	})
+
+	RegisterDecoder("h264", func() (Decoder, error) {
+		return NewH264Decoder(), nil
+	})
+	RegisterDecoder("raw", func() (Decoder, error) {
+		return NewRawDecoder(), nil
+	})
+	for _, codec := range []Codec{CodecAAC, CodecOpus, CodecPCM} {
+		codec := codec
+		RegisterDecoder(codec.String(), func() (Decoder, error) {
+			return NewAudioDecoder(codec), nil
+		})
+	}
+}
+
+// RegisterVideoSource makes a video source available under name, replacing
+// any previous registration.
+func RegisterVideoSource(name string, factory VideoSourceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	videoSources[name] = factory
+}
+
+// RegisterAudioSource makes an audio source available under name.
+func RegisterAudioSource(name string, factory AudioSourceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	audioSources[name] = factory
+}
+
+// RegisterEncoder makes an encoder available for a codec name as used in
+// MediaConfig.VideoCodec and MediaConfig.AudioCodec.
+func RegisterEncoder(codec string, factory EncoderFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	encoders[codec] = factory
+}
+
+// RegisterDecoder makes a decoder available for a codec name.
+func RegisterDecoder(codec string, factory DecoderFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	decoders[codec] = factory
+}
+
+func NewVideoSource(name string, cfg *config.MediaConfig) (VideoSource, error) {
+	registryMu.RLock()
+	factory, ok := videoSources[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown video source %q (available: %v)", name, sortedKeys(videoSources))
+	}
+	return factory(cfg)
+}
+
+func NewAudioSource(name string, cfg *config.MediaConfig) (AudioSource, error) {
+	registryMu.RLock()
+	factory, ok := audioSources[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown audio source %q (available: %v)", name, sortedKeys(audioSources))
+	}
+	return factory(cfg)
+}
+
+func NewEncoder(codec string, cfg EncoderConfig) (Encoder, error) {
+	registryMu.RLock()
+	factory, ok := encoders[codec]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no encoder for codec %q (available: %v)", codec, sortedKeys(encoders))
+	}
+	return factory(cfg)
+}
+
+func NewDecoder(codec string) (Decoder, error) {
+	registryMu.RLock()
+	factory, ok := decoders[codec]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no decoder for codec %q (available: %v)", codec, sortedKeys(decoders))
+	}
+	return factory()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
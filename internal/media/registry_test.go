@@ -0,0 +1,93 @@
+package media
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+type fakeVideoSource struct {
+	cfg    *config.MediaConfig
+	frames chan RawFrame
+}
+
+func (s *fakeVideoSource) Start() error              { return nil }
+func (s *fakeVideoSource) Stop()                     {}
+func (s *fakeVideoSource) Frames() <-chan RawFrame   { return s.frames }
+func (s *fakeVideoSource) GetResolution() (int, int) { return 16, 16 }
+func (s *fakeVideoSource) GetFrameRate() int         { return 30 }
+
+type fakeEncoder struct {
+	cfg EncoderConfig
+}
+
+func (e *fakeEncoder) Start() error                             { return nil }
+func (e *fakeEncoder) Stop()                                    {}
+func (e *fakeEncoder) EncodeFrame([]byte, uint64, uint64) error { return nil }
+func (e *fakeEncoder) Frames() <-chan *EncodedFrame             { return nil }
+func (e *fakeEncoder) RequestKeyframe()                         {}
+
+type fakeDecoder struct{}
+
+func (d *fakeDecoder) Start() error                              { return nil }
+func (d *fakeDecoder) Stop()                                     {}
+func (d *fakeDecoder) DecodeFrame([]byte) (*DecodedFrame, error) { return nil, nil }
+
+func TestRegistrySelectsFakes(t *testing.T) {
+	cfg := &config.MediaConfig{VideoSource: "fake-source"}
+	RegisterVideoSource("fake-source", func(cfg *config.MediaConfig) (VideoSource, error) {
+		return &fakeVideoSource{cfg: cfg}, nil
+	})
+	RegisterEncoder("fake-codec", func(cfg EncoderConfig) (Encoder, error) {
+		return &fakeEncoder{cfg: cfg}, nil
+	})
+	RegisterDecoder("fake-codec", func() (Decoder, error) {
+		return &fakeDecoder{}, nil
+	})
+
+	source, err := NewVideoSource(cfg.VideoSource, cfg)
+	if err != nil {
+		t.Fatalf("NewVideoSource() error = %v", err)
+	}
+	if fake, ok := source.(*fakeVideoSource); !ok || fake.cfg != cfg {
+		t.Errorf("NewVideoSource() = %#v, want the fake with the given config", source)
+	}
+
+	encoder, err := NewEncoder("fake-codec", EncoderConfig{StreamID: 7})
+	if err != nil {
+		t.Fatalf("NewEncoder() error = %v", err)
+	}
+	if fake, ok := encoder.(*fakeEncoder); !ok || fake.cfg.StreamID != 7 {
+		t.Errorf("NewEncoder() = %#v, want the fake with the given config", encoder)
+	}
+
+	decoder, err := NewDecoder("fake-codec")
+	if err != nil {
+		t.Fatalf("NewDecoder() error = %v", err)
+	}
+	if _, ok := decoder.(*fakeDecoder); !ok {
+		t.Errorf("NewDecoder() = %#v, want the fake", decoder)
+	}
+}
+
+func TestRegistryUnknownNames(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func() error
+		want string
+	}{
+		{"video source", func() error { _, err := NewVideoSource("no-such-source", nil); return err }, `unknown video source "no-such-source"`},
+		{"audio source", func() error { _, err := NewAudioSource("no-such-source", nil); return err }, `unknown audio source "no-such-source"`},
+		{"encoder", func() error { _, err := NewEncoder("no-such-codec", EncoderConfig{}); return err }, `no encoder for codec "no-such-codec"`},
+		{"decoder", func() error { _, err := NewDecoder("no-such-codec"); return err }, `no decoder for codec "no-such-codec"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.new()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to contain %s", err, tt.want)
+			}
+		})
+	}
+}
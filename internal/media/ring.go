@@ -0,0 +1,66 @@
+package media
+
+// frameRing is a fixed set of preallocated frame buffers that are reused in
+// turn, so that a steady capture does not allocate a new slice per frame.
+//
+// A delivered buffer may still be queued on the frames channel or held by
+// the consumer, which keeps the last frame it received. The channel is
+// FIFO, so those are always among the most recent deliveries that were not
+// dropped again: the queued ones and the one received before them. The
+// ring never hands those out, which with a queue of up to len(slots)-2
+// frames always leaves one buffer to fill.
+type frameRing struct {
+	slots [][]byte
+	// Deliveries that may still be in use, oldest first
+	inUse [][]byte
+}
+
+func newFrameRing(slots, frameSize int) *frameRing {
+	r := &frameRing{
+		slots: make([][]byte, slots),
+		inUse: make([][]byte, 0, slots-1),
+	}
+	for i := range r.slots {
+		r.slots[i] = make([]byte, frameSize)
+	}
+	return r
+}
+
+// Next returns a buffer to fill, one that is neither queued nor held by
+// the consumer.
+func (r *frameRing) Next() []byte {
+	for _, buf := range r.slots {
+		if r.indexInUse(buf) < 0 {
+			return buf
+		}
+	}
+	// Unreachable while the queue is no longer than len(slots)-2
+	panic("frame ring exhausted")
+}
+
+// delivered records that buf was queued for the consumer.
+func (r *frameRing) delivered(buf []byte) {
+	if len(r.inUse) == cap(r.inUse) {
+		// The consumer has received the oldest one and moved past it
+		copy(r.inUse, r.inUse[1:])
+		r.inUse = r.inUse[:len(r.inUse)-1]
+	}
+	r.inUse = append(r.inUse, buf)
+}
+
+// dropped records that buf was taken back off the queue unread, so it is
+// free again.
+func (r *frameRing) dropped(buf []byte) {
+	if i := r.indexInUse(buf); i >= 0 {
+		r.inUse = append(r.inUse[:i], r.inUse[i+1:]...)
+	}
+}
+
+func (r *frameRing) indexInUse(buf []byte) int {
+	for i, used := range r.inUse {
+		if &used[0] == &buf[0] {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,47 @@
+package media
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// A consumer that falls behind must never see the frame it holds, or the
+// ones still queued for it, overwritten.
+func TestDeliverLatestKeepsFramesInUse(t *testing.T) {
+	const slots = 4
+	ring := newFrameRing(slots, 8)
+	frames := make(chan RawFrame, slots-2)
+	var stats captureStats
+
+	var seq uint64
+	produce := func(n int) {
+		for i := 0; i < n; i++ {
+			seq++
+			buf := ring.Next()
+			binary.BigEndian.PutUint64(buf, seq)
+			deliverLatest(ring, frames, RawFrame{Data: buf}, &stats)
+		}
+	}
+
+	produce(1)
+	held := (<-frames).Data
+	last := binary.BigEndian.Uint64(held)
+	for round := 0; round < 20; round++ {
+		// The consumer is stalled on held while the producer keeps going
+		produce(round%5 + 1)
+		if got := binary.BigEndian.Uint64(held); got != last {
+			t.Fatalf("round %d: held frame overwritten with %d, want %d", round, got, last)
+		}
+
+		held = (<-frames).Data
+		got := binary.BigEndian.Uint64(held)
+		if got <= last {
+			t.Fatalf("round %d: received frame %d after %d", round, got, last)
+		}
+		last = got
+	}
+
+	if _, dropped, _ := stats.get(); dropped == 0 {
+		t.Error("expected frames to be dropped")
+	}
+}
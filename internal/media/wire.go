@@ -0,0 +1,237 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Frame wire format, version 1. All integers are big-endian.
+//
+//	offset  size  field
+//	0       2     magic "ML"
+//	2       1     version
+//	3       1     flags
+//	4       4     stream ID
+//	8       8     frame ID
+//	16      8     PTS in MediaClockRate ticks
+//	24      8     DTS in MediaClockRate ticks
+//	32      1     codec
+//	33      1     reserved
+//	34      4     payload length
+//	38      4     CRC-32C over bytes 0-37 and the payload
+//	42      n     payload
+const (
+	FrameMagic      uint16 = 0x4D4C // "ML"
+	FrameVersion    uint8  = 1
+	FrameHeaderSize        = 42
+
+	// MediaClockRate is the tick rate of PTS/DTS values, matching the
+	// 90 kHz clock used by RTP and MPEG-TS for video.
+	MediaClockRate = 90000
+)
+
+// Frame flags.
+const (
+	FlagKeyframe uint8 = 1 << 0
+	// FlagParamChange marks the first frame encoded with new parameters,
+	// such as a new resolution or bitrate. It is always set on a keyframe.
+	FlagParamChange uint8 = 1 << 1
+	// FlagEncrypted marks a payload sealed with the stream key. The header
+	// stays in the clear so that the frame can be routed and cached.
+	FlagEncrypted uint8 = 1 << 2
+)
+
+var (
+	ErrShortFrame         = errors.New("frame too short")
+	ErrBadMagic           = errors.New("bad frame magic")
+	ErrUnsupportedVersion = errors.New("unsupported frame version")
+	ErrLengthMismatch     = errors.New("frame payload length mismatch")
+	ErrChecksumMismatch   = errors.New("frame checksum mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Codec identifies the payload encoding of a frame on the wire.
+type Codec uint8
+
+const (
+	CodecUnknown Codec = iota
+	CodecRawVideo
+	CodecH264
+	CodecPCM
+	CodecAAC
+	CodecOpus
+)
+
+var codecNames = map[Codec]string{
+	CodecUnknown:  "unknown",
+	CodecRawVideo: "raw",
+	CodecH264:     "h264",
+	CodecPCM:      "pcm",
+	CodecAAC:      "aac",
+	CodecOpus:     "opus",
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// IsAudio reports whether the codec carries audio samples.
+func (c Codec) IsAudio() bool {
+	return c == CodecPCM || c == CodecAAC || c == CodecOpus
+}
+
+// ParseCodec maps a config codec name such as "h264" to its wire value.
+func ParseCodec(name string) (Codec, error) {
+	for c, n := range codecNames {
+		if c != CodecUnknown && n == name {
+			return c, nil
+		}
+	}
+	return CodecUnknown, fmt.Errorf("unknown codec %q", name)
+}
+
+// FrameHeader is the fixed-size header that precedes every frame payload.
+type FrameHeader struct {
+	Version       uint8
+	Flags         uint8
+	StreamID      uint32
+	FrameID       uint64
+	PTS           uint64
+	DTS           uint64
+	Codec         Codec
+	PayloadLength uint32
+}
+
+func (h *FrameHeader) IsKeyframe() bool {
+	return h.Flags&FlagKeyframe != 0
+}
+
+// IsEncrypted reports whether the payload is sealed with the stream key.
+func (h *FrameHeader) IsEncrypted() bool {
+	return h.Flags&FlagEncrypted != 0
+}
+
+// IsParamChange reports whether the stream's encoding parameters change
+// from this frame on.
+func (h *FrameHeader) IsParamChange() bool {
+	return h.Flags&FlagParamChange != 0
+}
+
+// MarshalFrame serializes the header followed by payload. Version and
+// PayloadLength are filled in from the current format and len(payload).
+func MarshalFrame(h *FrameHeader, payload []byte) []byte {
+	return AppendFrame(make([]byte, 0, FrameHeaderSize+len(payload)), h, payload)
+}
+
+// AppendFrame is like MarshalFrame but appends to dst.
+func AppendFrame(dst []byte, h *FrameHeader, payload []byte) []byte {
+	h.Version = FrameVersion
+	h.PayloadLength = uint32(len(payload))
+
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint16(dst, FrameMagic)
+	dst = append(dst, h.Version, h.Flags)
+	dst = binary.BigEndian.AppendUint32(dst, h.StreamID)
+	dst = binary.BigEndian.AppendUint64(dst, h.FrameID)
+	dst = binary.BigEndian.AppendUint64(dst, h.PTS)
+	dst = binary.BigEndian.AppendUint64(dst, h.DTS)
+	dst = append(dst, byte(h.Codec), 0)
+	dst = binary.BigEndian.AppendUint32(dst, h.PayloadLength)
+
+	crc := crc32.Update(0, crcTable, dst[start:])
+	crc = crc32.Update(crc, crcTable, payload)
+	dst = binary.BigEndian.AppendUint32(dst, crc)
+
+	return append(dst, payload...)
+}
+
+// UnmarshalFrame parses a frame produced by MarshalFrame. The returned
+// payload aliases data.
+func UnmarshalFrame(data []byte) (*FrameHeader, []byte, error) {
+	// Magic and version are checked before the length so that frames from a
+	// newer format with a different header size are reported as such.
+	if len(data) < 3 {
+		return nil, nil, ErrShortFrame
+	}
+	if binary.BigEndian.Uint16(data[0:2]) != FrameMagic {
+		return nil, nil, ErrBadMagic
+	}
+	if data[2] != FrameVersion {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[2])
+	}
+	if len(data) < FrameHeaderSize {
+		return nil, nil, ErrShortFrame
+	}
+
+	h := parseHeader(data)
+	payload := data[FrameHeaderSize:]
+	if uint64(len(payload)) != uint64(h.PayloadLength) {
+		return nil, nil, fmt.Errorf("%w: header says %d, got %d", ErrLengthMismatch, h.PayloadLength, len(payload))
+	}
+
+	crc := crc32.Update(0, crcTable, data[:38])
+	crc = crc32.Update(crc, crcTable, payload)
+	if crc != binary.BigEndian.Uint32(data[38:42]) {
+		return nil, nil, ErrChecksumMismatch
+	}
+
+	return h, payload, nil
+}
+
+// PeekCodec returns the codec of a wire frame without validating the rest
+// of it, so that a frame can be routed to the right decoder.
+func PeekCodec(data []byte) (Codec, error) {
+	h, err := PeekHeader(data)
+	if err != nil {
+		return CodecUnknown, err
+	}
+	return h.Codec, nil
+}
+
+// PeekHeader parses a frame header without checking the payload length or
+// checksum.
+func PeekHeader(data []byte) (*FrameHeader, error) {
+	if len(data) < FrameHeaderSize {
+		return nil, ErrShortFrame
+	}
+	if binary.BigEndian.Uint16(data[0:2]) != FrameMagic {
+		return nil, ErrBadMagic
+	}
+	if data[2] != FrameVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[2])
+	}
+	return parseHeader(data), nil
+}
+
+func parseHeader(data []byte) *FrameHeader {
+	return &FrameHeader{
+		Version:       data[2],
+		Flags:         data[3],
+		StreamID:      binary.BigEndian.Uint32(data[4:8]),
+		FrameID:       binary.BigEndian.Uint64(data[8:16]),
+		PTS:           binary.BigEndian.Uint64(data[16:24]),
+		DTS:           binary.BigEndian.Uint64(data[24:32]),
+		Codec:         Codec(data[32]),
+		PayloadLength: binary.BigEndian.Uint32(data[34:38]),
+	}
+}
+
+// DurationToPTS converts an elapsed duration to media clock ticks.
+func DurationToPTS(d time.Duration) uint64 {
+	if d < 0 {
+		return 0
+	}
+	return uint64(d.Microseconds()) * MediaClockRate / 1000000
+}
+
+// PTSToDuration converts media clock ticks to a duration.
+func PTSToDuration(pts uint64) time.Duration {
+	return time.Duration(pts*1000000/MediaClockRate) * time.Microsecond
+}
@@ -0,0 +1,163 @@
+package media
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Golden frames of wire format version 1. The checksums were checked
+// against an independent CRC-32C implementation; a change to any of them
+// is a change to the format and needs a new version.
+var goldenFrames = []struct {
+	name    string
+	header  FrameHeader
+	payload []byte
+	wire    string
+}{
+	{
+		name: "h264 keyframe",
+		header: FrameHeader{
+			Flags:    FlagKeyframe,
+			StreamID: 0x01020304,
+			FrameID:  0x1122334455667788,
+			PTS:      90000,
+			DTS:      87000,
+			Codec:    CodecH264,
+		},
+		payload: []byte{0, 0, 0, 1, 0x65, 0x88},
+		wire: "4d4c" + "01" + "01" + "01020304" + "1122334455667788" +
+			"0000000000015f90" + "00000000000153d8" + "02" + "00" + "00000006" +
+			"3e56f818" + "000000016588",
+	},
+	{
+		name:   "empty opus frame",
+		header: FrameHeader{Codec: CodecOpus},
+		wire: "4d4c" + "01" + "00" + "00000000" + "0000000000000000" +
+			"0000000000000000" + "0000000000000000" + "05" + "00" + "00000000" +
+			"7a0b9d92",
+	},
+	{
+		name: "encrypted aac with every flag",
+		header: FrameHeader{
+			Flags:    FlagKeyframe | FlagParamChange | FlagEncrypted,
+			StreamID: 0xffffffff,
+			FrameID:  1,
+			PTS:      0xfffffffffffffffe,
+			Codec:    CodecAAC,
+		},
+		payload: []byte("meshlink"),
+		wire: "4d4c" + "01" + "07" + "ffffffff" + "0000000000000001" +
+			"fffffffffffffffe" + "0000000000000000" + "04" + "00" + "00000008" +
+			"5aacbe2b" + hex.EncodeToString([]byte("meshlink")),
+	},
+}
+
+func TestMarshalFrameGolden(t *testing.T) {
+	for _, tt := range goldenFrames {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.header
+			got := hex.EncodeToString(MarshalFrame(&h, tt.payload))
+			if got != tt.wire {
+				t.Errorf("MarshalFrame() =\n%s\nwant\n%s", got, tt.wire)
+			}
+		})
+	}
+}
+
+func TestUnmarshalFrameGolden(t *testing.T) {
+	for _, tt := range goldenFrames {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, payload, err := UnmarshalFrame(data)
+			if err != nil {
+				t.Fatalf("UnmarshalFrame() error = %v", err)
+			}
+			want := tt.header
+			want.Version = FrameVersion
+			want.PayloadLength = uint32(len(tt.payload))
+			if *h != want {
+				t.Errorf("UnmarshalFrame() header = %+v, want %+v", *h, want)
+			}
+			if !bytes.Equal(payload, tt.payload) {
+				t.Errorf("UnmarshalFrame() payload = %x, want %x", payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestUnmarshalFrameErrors(t *testing.T) {
+	valid, err := hex.DecodeString(goldenFrames[0].wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrShortFrame},
+		{"magic only", valid[:2], ErrShortFrame},
+		{"truncated header", valid[:FrameHeaderSize-1], ErrShortFrame},
+		{"bad magic", modified(func(b []byte) []byte { b[0] = 'X'; return b }), ErrBadMagic},
+		{"newer version", modified(func(b []byte) []byte { b[2] = 2; return b }), ErrUnsupportedVersion},
+		// A newer version may have a shorter header, which must still be
+		// reported as a version problem
+		{"newer version truncated", []byte{0x4d, 0x4c, 2, 0}, ErrUnsupportedVersion},
+		{"truncated payload", valid[:len(valid)-1], ErrLengthMismatch},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0), ErrLengthMismatch},
+		{"flipped header bit", modified(func(b []byte) []byte { b[20] ^= 1; return b }), ErrChecksumMismatch},
+		{"flipped payload bit", modified(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }), ErrChecksumMismatch},
+		{"flipped checksum bit", modified(func(b []byte) []byte { b[38] ^= 1; return b }), ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := UnmarshalFrame(tt.data)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("UnmarshalFrame() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshalFrame(f *testing.F) {
+	for _, tt := range goldenFrames {
+		data, err := hex.DecodeString(tt.wire)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x4d, 0x4c, 2})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, payload, err := UnmarshalFrame(data)
+		if err != nil {
+			if h != nil || payload != nil {
+				t.Fatalf("UnmarshalFrame() returned a frame with error %v", err)
+			}
+			return
+		}
+		// Whatever is accepted must survive marshalling again. The reserved
+		// byte is not kept, so the bytes may differ but the frame may not.
+		h2, payload2, err := UnmarshalFrame(MarshalFrame(h, payload))
+		if err != nil {
+			t.Fatalf("UnmarshalFrame() of a marshalled frame error = %v", err)
+		}
+		if *h2 != *h || !bytes.Equal(payload2, payload) {
+			t.Fatalf("round trip mismatch: %+v %x, want %+v %x", *h2, payload2, *h, payload)
+		}
+		if peeked, err := PeekHeader(data); err != nil || *peeked != *h {
+			t.Fatalf("PeekHeader() = %+v, %v, want %+v", peeked, err, *h)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// mDNS only reaches the local network. Beyond it, nodes meet through
+// bootstrap peers: nodes with public addresses that every node stays
+// connected to. Through them a node can look others up in a Kademlia DHT,
+// where it advertises itself under its service tag; a node that cannot be
+// reached directly reserves a slot on a static relay, and relayed
+// connections are upgraded to direct ones by hole punching where the NATs
+// allow it.
+const (
+	// Connection manager tag that keeps bootstrap peers connected
+	bootstrapProtectTag = "meshlink-bootstrap"
+
+	// How often lost bootstrap peers are redialled
+	bootstrapInterval = 30 * time.Second
+
+	// How often the DHT is searched for new peers
+	rendezvousInterval = time.Minute
+
+	// The DHT is separate from the public IPFS one
+	dhtProtocolPrefix = "/meshlink"
+)
+
+// parsePeerAddrs parses multiaddrs ending in /p2p/<peer ID>, merging the
+// addresses of the same peer.
+func parsePeerAddrs(kind string, addrs []string) ([]peer.AddrInfo, error) {
+	maddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", kind, s, err)
+		}
+		maddrs = append(maddrs, addr)
+	}
+	infos, err := peer.AddrInfosFromP2pAddrs(maddrs...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", kind, err)
+	}
+	return infos, nil
+}
+
+// parseDHTMode maps the configured DHT mode to the DHT's, reporting false
+// if the DHT is disabled.
+func parseDHTMode(mode string) (dht.ModeOpt, bool, error) {
+	switch mode {
+	case "":
+		return 0, false, nil
+	case "auto":
+		return dht.ModeAuto, true, nil
+	case "client":
+		return dht.ModeClient, true, nil
+	case "server":
+		return dht.ModeServer, true, nil
+	default:
+		return 0, false, fmt.Errorf("unknown DHT mode %q", mode)
+	}
+}
+
+// keepBootstrapped connects to the bootstrap peers and redials any that
+// are lost until the node closes.
+func (n *Node) keepBootstrapped() {
+	for _, pi := range n.bootstrap {
+		n.Host.ConnManager().Protect(pi.ID, bootstrapProtectTag)
+	}
+
+	ticker := time.NewTicker(bootstrapInterval)
+	defer ticker.Stop()
+	for {
+		for _, pi := range n.bootstrap {
+			n.connect(pi, "bootstrap peer")
+		}
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// connect dials a peer unless it is already connected.
+func (n *Node) connect(pi peer.AddrInfo, kind string) {
+	if pi.ID == n.Host.ID() || n.Host.Network().Connectedness(pi.ID) == network.Connected {
+		return
+	}
+	if err := n.Host.Connect(n.ctx, pi); err != nil {
+		n.logger.Warnf("Failed to connect to %s %s: %v", kind, pi.ID, err)
+		return
+	}
+	n.logger.Infof("Connected to %s %s", kind, pi.ID)
+}
+
+// setupDHT joins the DHT through the bootstrap peers, advertises the node
+// under its service tag and keeps looking for others doing the same.
+func (n *Node) setupDHT(mode dht.ModeOpt) error {
+	kdht, err := dht.New(n.ctx, n.Host,
+		dht.Mode(mode),
+		dht.ProtocolPrefix(dhtProtocolPrefix),
+		dht.BootstrapPeers(n.bootstrap...),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create DHT: %w", err)
+	}
+	if err := kdht.Bootstrap(n.ctx); err != nil {
+		kdht.Close()
+		return fmt.Errorf("failed to bootstrap DHT: %w", err)
+	}
+	n.dht = kdht
+	go n.rendezvousLoop()
+	return nil
+}
+
+func (n *Node) rendezvousLoop() {
+	// Advertising needs DHT peers to store the record with, so wait for
+	// the first one, typically a bootstrap peer
+	wait := time.NewTicker(time.Second)
+	for n.dht.RoutingTable().Size() == 0 {
+		select {
+		case <-n.ctx.Done():
+			wait.Stop()
+			return
+		case <-wait.C:
+		}
+	}
+	wait.Stop()
+
+	disc := drouting.NewRoutingDiscovery(n.dht)
+	dutil.Advertise(n.ctx, disc, n.serviceTag)
+
+	ticker := time.NewTicker(rendezvousInterval)
+	defer ticker.Stop()
+	for {
+		peers, err := disc.FindPeers(n.ctx, n.serviceTag)
+		if err != nil {
+			n.logger.Warnf("Failed to look up peers in the DHT: %v", err)
+		} else {
+			for pi := range peers {
+				if len(pi.Addrs) > 0 {
+					n.connect(pi, "DHT peer")
+				}
+			}
+		}
+
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
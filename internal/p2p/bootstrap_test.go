@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+const testEchoProtocol = "/meshlink/test/echo/1.0.0"
+
+// newNATedHost returns a host that cannot be dialled, as if behind NAT,
+// with the relay client options of newHost.
+func newNATedHost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(
+		libp2p.NoListenAddrs,
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.ForceReachabilityPrivate(),
+		libp2p.EnableRelay(),
+		libp2p.EnableHolePunching(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// loopbackAddrs returns the TCP addresses of h on 127.0.0.1.
+func loopbackAddrs(t *testing.T, h host.Host) []ma.Multiaddr {
+	t.Helper()
+	var addrs []ma.Multiaddr
+	for _, addr := range h.Addrs() {
+		if strings.HasPrefix(addr.String(), "/ip4/127.0.0.1/tcp/") {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		t.Fatalf("host listens on none of 127.0.0.1: %v", h.Addrs())
+	}
+	return addrs
+}
+
+// Two peers that cannot dial each other connect through a relay node, over
+// a circuit that the relay keeps limited.
+func TestRelayedConnectionOverLoopback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts libp2p hosts")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	identity, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayNode, err := NewNode(ctx, &config.NetworkConfig{MaxPeers: 10}, "meshlink-test-relay", identity)
+	if err != nil {
+		t.Fatalf("NewNode() error = %v", err)
+	}
+	defer relayNode.Close()
+	if err := relayNode.EnableRelayService(&config.RelayConfig{}); err != nil {
+		t.Fatalf("EnableRelayService() error = %v", err)
+	}
+	relayInfo := peer.AddrInfo{ID: relayNode.Host.ID(), Addrs: loopbackAddrs(t, relayNode.Host)}
+
+	listener := newNATedHost(t)
+	dialer := newNATedHost(t)
+	listener.SetStreamHandler(testEchoProtocol, func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s)
+	})
+
+	if err := listener.Connect(ctx, relayInfo); err != nil {
+		t.Fatalf("failed to connect to the relay: %v", err)
+	}
+	reservation, err := client.Reserve(ctx, listener, relayInfo)
+	if err != nil {
+		t.Fatalf("failed to reserve a slot on the relay: %v", err)
+	}
+	if want := int64(defaultCircuitData); reservation.LimitData != uint64(want) {
+		t.Errorf("reservation data limit = %d, want %d", reservation.LimitData, want)
+	}
+
+	// The listener has no address of its own, so the dialer can only reach
+	// it through the relay
+	if err := dialer.Connect(ctx, relayInfo); err != nil {
+		t.Fatalf("failed to connect to the relay: %v", err)
+	}
+	circuit, err := ma.NewMultiaddr(relayInfo.Addrs[0].String() + "/p2p/" + relayInfo.ID.String() + "/p2p-circuit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialer.Connect(ctx, peer.AddrInfo{ID: listener.ID(), Addrs: []ma.Multiaddr{circuit}}); err != nil {
+		t.Fatalf("failed to connect through the relay: %v", err)
+	}
+
+	conns := dialer.Network().ConnsToPeer(listener.ID())
+	if len(conns) == 0 {
+		t.Fatal("no connection to the listener")
+	}
+	for _, c := range conns {
+		if _, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			t.Errorf("connection over %s is not relayed", c.RemoteMultiaddr())
+		}
+		if !c.Stat().Transient {
+			t.Errorf("relayed connection over %s is not limited", c.RemoteMultiaddr())
+		}
+	}
+
+	s, err := dialer.NewStream(network.WithUseTransient(ctx, "test"), listener.ID(), testEchoProtocol)
+	if err != nil {
+		t.Fatalf("failed to open a stream through the relay: %v", err)
+	}
+	defer s.Close()
+	msg := []byte("hello through the relay")
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(s)
+	if err != nil || string(got) != string(msg) {
+		t.Fatalf("echo = %q, %v, want %q", got, err, msg)
+	}
+}
@@ -0,0 +1,192 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// In GossipSub every subscriber forwards what it receives to the peers in
+// its mesh. To weight that mesh by bandwidth, nodes tell each other how much
+// upload they can spare when they connect, and the router scores peers by
+// it: meshes keep their best-scored peers when pruned and graft better ones
+// when the mesh is poor, so traffic tends to flow through the peers that can
+// carry it. No node builds a distribution tree or assigns viewers to
+// forwarders, and the advertised upload is neither measured nor enforced;
+// it only biases each node's own mesh. A leaf, such as a phone, keeps a
+// single mesh peer and emits no gossip, so it receives the stream but
+// forwards next to nothing.
+const (
+	capacityTimeout = 5 * time.Second
+
+	// Largest capacity message accepted
+	maxCapacitySize = 256
+
+	// Peers scoring below these are not gossiped to, not published to and
+	// ignored altogether. Capacity alone never scores below zero.
+	gossipThreshold   = -100
+	publishThreshold  = -200
+	graylistThreshold = -300
+
+	// A mesh whose median peer spares less than about 1 Mbit/s grafts
+	// better peers
+	opportunisticGraftThreshold = 1
+)
+
+// Capacity is what a node tells its peers about its forwarding.
+type Capacity struct {
+	UploadKbps int  `json:"upload_kbps,omitempty"` // spare upload, zero if unknown
+	Leaf       bool `json:"leaf,omitempty"`        // does not forward
+}
+
+// score rates a peer's capacity for the GossipSub router: zero for leaves
+// and peers of unknown capacity, and one more for each doubling of the
+// spare upload beyond 1 Mbit/s.
+func (c Capacity) score() float64 {
+	if c.Leaf || c.UploadKbps <= 0 {
+		return 0
+	}
+	return math.Log2(1 + float64(c.UploadKbps)/1000)
+}
+
+// capacityTable holds the capacity of the connected peers.
+type capacityTable struct {
+	mu    sync.RWMutex
+	peers map[peer.ID]Capacity
+}
+
+func (t *capacityTable) get(p peer.ID) (Capacity, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c, ok := t.peers[p]
+	return c, ok
+}
+
+func (t *capacityTable) set(p peer.ID, c Capacity) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers[p] = c
+}
+
+func (t *capacityTable) remove(p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, p)
+}
+
+func (t *capacityTable) score(p peer.ID) float64 {
+	c, _ := t.get(p)
+	return c.score()
+}
+
+// capacityProtocol returns the protocol nodes exchange their capacity on.
+func capacityProtocol(serviceTag string) protocol.ID {
+	return protocol.ID("/meshlink/" + serviceTag + "/capacity/1.0.0")
+}
+
+// scoreOptions scores peers by the capacity they advertise.
+func scoreOptions(table *capacityTable) []pubsub.Option {
+	params := &pubsub.PeerScoreParams{
+		Topics:            make(map[string]*pubsub.TopicScoreParams),
+		AppSpecificScore:  table.score,
+		AppSpecificWeight: 1,
+		DecayInterval:     time.Second,
+		DecayToZero:       0.01,
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             gossipThreshold,
+		PublishThreshold:            publishThreshold,
+		GraylistThreshold:           graylistThreshold,
+		OpportunisticGraftThreshold: opportunisticGraftThreshold,
+	}
+	return []pubsub.Option{pubsub.WithPeerScore(params, thresholds)}
+}
+
+// leafParams shrinks a leaf's meshes to a single peer without gossip.
+func leafParams(gs *pubsub.GossipSubParams) {
+	gs.D, gs.Dlo, gs.Dhi, gs.Dscore, gs.Dout = 1, 1, 1, 1, 0
+	gs.Dlazy, gs.GossipFactor = 0, 0
+	gs.OpportunisticGraftPeers = 1
+}
+
+// setupCapacity serves the node's capacity and asks every new peer for
+// theirs.
+func (n *Node) setupCapacity() {
+	proto := capacityProtocol(n.serviceTag)
+	n.Host.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		s.SetWriteDeadline(time.Now().Add(capacityTimeout))
+		if err := json.NewEncoder(s).Encode(n.capacity); err != nil {
+			s.Reset()
+		}
+	})
+	n.Host.Network().Notify(&capacityNotifee{node: n})
+}
+
+// queryCapacity asks a peer for its capacity.
+func (n *Node) queryCapacity(p peer.ID) {
+	ctx, cancel := context.WithTimeout(n.ctx, capacityTimeout)
+	defer cancel()
+
+	s, err := n.Host.NewStream(ctx, p, capacityProtocol(n.serviceTag))
+	if err != nil {
+		n.logger.Debugf("Failed to ask %s for its capacity: %v", p, err)
+		return
+	}
+	defer s.Close()
+
+	s.SetReadDeadline(time.Now().Add(capacityTimeout))
+	var c Capacity
+	if err := json.NewDecoder(io.LimitReader(s, maxCapacitySize)).Decode(&c); err != nil {
+		n.logger.Debugf("Invalid capacity from %s: %v", p, err)
+		s.Reset()
+		return
+	}
+	if n.Host.Network().Connectedness(p) != network.Connected {
+		return
+	}
+	n.peerCapacity.set(p, c)
+	n.logger.Debugf("Peer %s spares %d kbit/s (leaf: %t)", p, c.UploadKbps, c.Leaf)
+}
+
+// PeerCapacity returns what a connected peer advertised about its
+// forwarding, reporting false if it has not.
+func (n *Node) PeerCapacity(p peer.ID) (Capacity, bool) {
+	return n.peerCapacity.get(p)
+}
+
+// Capacity returns what the node advertises about its forwarding.
+func (n *Node) Capacity() Capacity {
+	return n.capacity
+}
+
+type capacityNotifee struct {
+	node *Node
+}
+
+func (c *capacityNotifee) Connected(_ network.Network, conn network.Conn) {
+	p := conn.RemotePeer()
+	if _, ok := c.node.peerCapacity.get(p); ok {
+		return
+	}
+	go c.node.queryCapacity(p)
+}
+
+func (c *capacityNotifee) Disconnected(net network.Network, conn network.Conn) {
+	p := conn.RemotePeer()
+	if net.Connectedness(p) != network.Connected {
+		c.node.peerCapacity.remove(p)
+	}
+}
+
+func (c *capacityNotifee) Listen(network.Network, ma.Multiaddr)      {}
+func (c *capacityNotifee) ListenClose(network.Network, ma.Multiaddr) {}
@@ -0,0 +1,124 @@
+package p2p
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCapacityScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity Capacity
+		want     float64
+	}{
+		{"unknown", Capacity{}, 0},
+		{"negative", Capacity{UploadKbps: -500}, 0},
+		{"leaf", Capacity{UploadKbps: 10000, Leaf: true}, 0},
+		{"half a megabit", Capacity{UploadKbps: 500}, math.Log2(1.5)},
+		{"one megabit", Capacity{UploadKbps: 1000}, 1},
+		{"three megabits", Capacity{UploadKbps: 3000}, 2},
+		{"seven megabits", Capacity{UploadKbps: 7000}, 3},
+	}
+	for _, tt := range tests {
+		if got := tt.capacity.score(); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: score() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLeafParams(t *testing.T) {
+	params := pubsub.DefaultGossipSubParams()
+	leafParams(&params)
+
+	if params.D != 1 || params.Dlo != 1 || params.Dhi != 1 || params.Dscore != 1 || params.Dout != 0 {
+		t.Errorf("leaf mesh degrees D=%d Dlo=%d Dhi=%d Dscore=%d Dout=%d, want a single peer",
+			params.D, params.Dlo, params.Dhi, params.Dscore, params.Dout)
+	}
+	if params.Dlazy != 0 || params.GossipFactor != 0 {
+		t.Errorf("leaf gossips to Dlazy=%d, GossipFactor=%v", params.Dlazy, params.GossipFactor)
+	}
+	if params.OpportunisticGraftPeers != 1 {
+		t.Errorf("OpportunisticGraftPeers = %d, want 1", params.OpportunisticGraftPeers)
+	}
+	// The router refuses parameters it cannot keep to
+	if params.Dout >= params.Dlo || params.Dout > params.D/2 {
+		t.Errorf("Dout %d is invalid for D=%d Dlo=%d", params.Dout, params.D, params.Dlo)
+	}
+}
+
+func TestCapacityExchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.WithNPeers(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	capacities := []Capacity{{UploadKbps: 3000}, {Leaf: true}}
+	nodes := make([]*Node, len(capacities))
+	for i, h := range mn.Hosts() {
+		nodes[i] = &Node{
+			Host:         h,
+			serviceTag:   "capacity-test",
+			capacity:     capacities[i],
+			ctx:          ctx,
+			logger:       logrus.New(),
+			peerCapacity: &capacityTable{peers: make(map[peer.ID]Capacity)},
+		}
+		nodes[i].setupCapacity()
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each side asks the other on connecting
+	for i, n := range nodes {
+		other := nodes[1-i]
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c, ok := n.PeerCapacity(other.Host.ID())
+			if ok {
+				if c != other.Capacity() {
+					t.Errorf("node %d learned %+v, want %+v", i, c, other.Capacity())
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d never learned its peer's capacity", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if got, want := nodes[1].peerCapacity.score(nodes[0].Host.ID()), 2.0; got != want {
+		t.Errorf("score of the 3 Mbit/s peer = %v, want %v", got, want)
+	}
+
+	// Disconnected peers are forgotten
+	if err := mn.DisconnectPeers(nodes[0].Host.ID(), nodes[1].Host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, ok0 := nodes[0].PeerCapacity(nodes[1].Host.ID())
+		_, ok1 := nodes[1].PeerCapacity(nodes[0].Host.ID())
+		if !ok0 && !ok1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("capacity kept after disconnecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,149 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/meshlink/church-streaming/internal/config"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/sirupsen/logrus"
+)
+
+// privateNetworks are trusted in trusted-network-only mode when no ranges
+// are configured: the local network, whatever its addressing.
+var privateNetworks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"127.0.0.0/8",
+	"fc00::/7",
+	"fe80::/10",
+	"::1/128",
+}
+
+// ConnectionGater enforces the configured access rules on every connection,
+// outbound and inbound. A denied peer is always refused; with an allow-list
+// only the peers on it are accepted; and in trusted-network-only mode only
+// addresses in the trusted ranges are dialled or accepted.
+type ConnectionGater struct {
+	allowed     map[peer.ID]bool
+	denied      map[peer.ID]bool
+	trusted     []*net.IPNet
+	trustedOnly bool
+	logger      *logrus.Logger
+}
+
+// NewConnectionGater builds a gater from the access config that reports
+// rejected connections to logger.
+func NewConnectionGater(cfg *config.AccessConfig, logger *logrus.Logger) (*ConnectionGater, error) {
+	g := &ConnectionGater{
+		allowed:     make(map[peer.ID]bool),
+		denied:      make(map[peer.ID]bool),
+		trustedOnly: cfg.TrustedNetworkOnly,
+		logger:      logger,
+	}
+
+	for _, s := range cfg.AllowedPeers {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed peer %q: %w", s, err)
+		}
+		g.allowed[id] = true
+	}
+	for _, s := range cfg.DeniedPeers {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied peer %q: %w", s, err)
+		}
+		g.denied[id] = true
+	}
+
+	networks := cfg.TrustedNetworks
+	if len(networks) == 0 {
+		networks = privateNetworks
+	}
+	for _, s := range networks {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted network %q: %w", s, err)
+		}
+		g.trusted = append(g.trusted, ipNet)
+	}
+	return g, nil
+}
+
+// checkPeer returns why a peer is refused, or "" if it is not.
+func (g *ConnectionGater) checkPeer(id peer.ID) string {
+	switch {
+	case g.denied[id]:
+		return "peer is denied"
+	case len(g.allowed) > 0 && !g.allowed[id]:
+		return "peer is not on the allow-list"
+	}
+	return ""
+}
+
+// checkAddr returns why an address is refused, or "" if it is not.
+func (g *ConnectionGater) checkAddr(addr ma.Multiaddr) string {
+	if !g.trustedOnly {
+		return ""
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return "address has no IP to check against the trusted networks"
+	}
+	for _, ipNet := range g.trusted {
+		if ipNet.Contains(ip) {
+			return ""
+		}
+	}
+	return "address is outside the trusted networks"
+}
+
+func (g *ConnectionGater) reject(direction string, who string, reason string) bool {
+	g.logger.Warnf("Rejected %s connection %s: %s", direction, who, reason)
+	return false
+}
+
+func (g *ConnectionGater) InterceptPeerDial(id peer.ID) bool {
+	if reason := g.checkPeer(id); reason != "" {
+		return g.reject("outbound", "to "+id.String(), reason)
+	}
+	return true
+}
+
+func (g *ConnectionGater) InterceptAddrDial(id peer.ID, addr ma.Multiaddr) bool {
+	if reason := g.checkAddr(addr); reason != "" {
+		return g.reject("outbound", fmt.Sprintf("to %s at %s", id, addr), reason)
+	}
+	return true
+}
+
+func (g *ConnectionGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	if reason := g.checkAddr(addrs.RemoteMultiaddr()); reason != "" {
+		return g.reject("inbound", "from "+addrs.RemoteMultiaddr().String(), reason)
+	}
+	return true
+}
+
+// InterceptSecured checks the peer once its ID is authenticated, which for
+// an inbound connection is the first time it is known.
+func (g *ConnectionGater) InterceptSecured(dir network.Direction, id peer.ID, addrs network.ConnMultiaddrs) bool {
+	if reason := g.checkPeer(id); reason != "" {
+		direction := "inbound"
+		if dir == network.DirOutbound {
+			direction = "outbound"
+		}
+		return g.reject(direction, fmt.Sprintf("with %s at %s", id, addrs.RemoteMultiaddr()), reason)
+	}
+	return true
+}
+
+func (g *ConnectionGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+// GossipSub's defaults suit small, infrequent messages. A video stream is
+// a steady flow of chunks where one that arrives late is as good as lost.
+const (
+	profileDefault         = "default"
+	profileLowLatencyVideo = "low-latency-video"
+
+	// Room a message needs beyond its chunk for the author's signature
+	// and key, the sequence number, the topic and the framing
+	messageOverhead = 512
+)
+
+// routerProfile is a complete set of GossipSub options.
+type routerProfile struct {
+	params         pubsub.GossipSubParams
+	maxMessageSize int
+	// Off in every profile, as go-libp2p-pubsub leaves it: flooding every
+	// subscribed peer would multiply a broadcaster's upload by its audience
+	floodPublish      bool
+	outboundQueueSize int
+	validateQueueSize int
+}
+
+// profile returns the named router profile.
+func profile(name string) (routerProfile, error) {
+	p := routerProfile{
+		params:         pubsub.DefaultGossipSubParams(),
+		maxMessageSize: pubsub.DefaultMaxMessageSize,
+		// A keyframe is published as a burst of chunks; the default
+		// queues of 32 messages would drop most of it.
+		outboundQueueSize: 1024,
+		validateQueueSize: 1024,
+	}
+
+	switch name {
+	case "", profileDefault:
+	case profileLowLatencyVideo:
+		// A wider mesh reaches every viewer in fewer hops
+		p.params.D, p.params.Dlo, p.params.Dhi = 8, 6, 12
+		// Faster heartbeats repair meshes and recover missed chunks
+		// through gossip within a quarter of a second rather than a second.
+		// The history is kept as long as a chunk can still make its playout.
+		p.params.HeartbeatInterval = 250 * time.Millisecond
+		p.params.HistoryLength, p.params.HistoryGossip = 8, 4
+		p.params.IWantFollowupTime = time.Second
+		// Room for the keyframe bursts of several renditions
+		p.outboundQueueSize = 4096
+		p.validateQueueSize = 4096
+	default:
+		return routerProfile{}, fmt.Errorf("unknown GossipSub profile %q", name)
+	}
+	return p, nil
+}
+
+// routerOptions returns the GossipSub options of the configured profile and
+// overrides.
+func routerOptions(cfg *config.NetworkConfig) ([]pubsub.Option, error) {
+	p, err := configuredProfile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return []pubsub.Option{
+		pubsub.WithGossipSubParams(p.params),
+		pubsub.WithMaxMessageSize(p.maxMessageSize),
+		pubsub.WithFloodPublish(p.floodPublish),
+		pubsub.WithPeerOutboundQueueSize(p.outboundQueueSize),
+		pubsub.WithValidateQueueSize(p.validateQueueSize),
+	}, nil
+}
+
+// configuredProfile applies the configured overrides to the profile. A
+// leaf's meshes shrink to a single peer whatever the profile.
+func configuredProfile(cfg *config.NetworkConfig) (routerProfile, error) {
+	gcfg := &cfg.GossipSub
+	p, err := profile(gcfg.Profile)
+	if err != nil {
+		return routerProfile{}, err
+	}
+
+	if gcfg.D > 0 {
+		p.params.D = gcfg.D
+	}
+	if gcfg.Dlo > 0 {
+		p.params.Dlo = gcfg.Dlo
+	}
+	if gcfg.Dhi > 0 {
+		p.params.Dhi = gcfg.Dhi
+	}
+	if p.params.Dlo > p.params.D || p.params.D > p.params.Dhi {
+		return routerProfile{}, fmt.Errorf("GossipSub degrees must satisfy dlo <= d <= dhi, got %d, %d and %d",
+			p.params.Dlo, p.params.D, p.params.Dhi)
+	}
+	// The router keeps this many of the best-scored and outbound peers
+	// when pruning, which must fit the mesh
+	p.params.Dscore = min(p.params.Dscore, p.params.D)
+	p.params.Dout = min(p.params.Dout, p.params.Dlo-1, p.params.D/2)
+
+	if gcfg.HeartbeatInterval > 0 {
+		p.params.HeartbeatInterval = time.Duration(gcfg.HeartbeatInterval) * time.Millisecond
+	}
+	if gcfg.MaxMessageSize > 0 {
+		p.maxMessageSize = gcfg.MaxMessageSize
+	}
+	if cfg.ChunkSize > 0 && p.maxMessageSize < cfg.ChunkSize+messageOverhead {
+		return routerProfile{}, fmt.Errorf("GossipSub max message size %d is too small for chunks of %d bytes",
+			p.maxMessageSize, cfg.ChunkSize)
+	}
+	if gcfg.FloodPublish != nil {
+		p.floodPublish = *gcfg.FloodPublish
+	}
+	if gcfg.OutboundQueueSize > 0 {
+		p.outboundQueueSize = gcfg.OutboundQueueSize
+	}
+	if gcfg.ValidateQueueSize > 0 {
+		p.validateQueueSize = gcfg.ValidateQueueSize
+	}
+
+	if cfg.Leaf {
+		leafParams(&p.params)
+	}
+	return p, nil
+}
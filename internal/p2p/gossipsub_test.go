@@ -0,0 +1,189 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+func TestConfiguredFloodPublish(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name    string
+		profile string
+		flood   *bool
+		want    bool
+	}{
+		{"library default", profileDefault, nil, false},
+		{"low-latency video", profileLowLatencyVideo, nil, false},
+		{"turned on", profileLowLatencyVideo, &on, true},
+		{"turned off", profileDefault, &off, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.NetworkConfig{GossipSub: config.GossipSubConfig{Profile: tt.profile, FloodPublish: tt.flood}}
+			p, err := configuredProfile(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.floodPublish != tt.want {
+				t.Errorf("flood publish = %v, want %v", p.floodPublish, tt.want)
+			}
+		})
+	}
+}
+
+// A benchmark stream: a frame every 33 ms, of several chunks, with a burst
+// for a keyframe once a second, as a 2-3 Mbit/s rendition sends it.
+const (
+	benchViewers        = 12
+	benchPeersPerViewer = 3
+	benchChunkSize      = 1200
+	benchFrameChunks    = 8
+	benchKeyframeChunks = 60
+	benchKeyframeEvery  = 30
+	benchFrameInterval  = 33 * time.Millisecond
+)
+
+// BenchmarkFrameLatency measures how long each viewer of a loopback mesh
+// waits from a frame's publication until its last chunk arrives, under each
+// router profile. Viewers only know a few peers each, so that most frames
+// take several hops.
+func BenchmarkFrameLatency(b *testing.B) {
+	for _, name := range []string{profileDefault, profileLowLatencyVideo} {
+		b.Run(name, func(b *testing.B) {
+			benchmarkFrameLatency(b, name)
+		})
+	}
+}
+
+func benchmarkFrameLatency(b *testing.B, profileName string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.NetworkConfig{ChunkSize: benchChunkSize, GossipSub: config.GossipSubConfig{Profile: profileName}}
+	opts, err := routerOptions(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts = append(opts, pubsub.WithMessageSignaturePolicy(pubsub.StrictSign))
+
+	hosts := make([]host.Host, benchViewers+1)
+	topics := make([]*pubsub.Topic, len(hosts))
+	for i := range hosts {
+		h, err := libp2p.New(
+			libp2p.NoTransports,
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer h.Close()
+		ps, err := pubsub.NewGossipSub(ctx, h, opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if topics[i], err = ps.Join("bench"); err != nil {
+			b.Fatal(err)
+		}
+		hosts[i] = h
+	}
+	// Each viewer connects to a few of the nodes before it, the first
+	// ones to the broadcaster
+	for i := 1; i < len(hosts); i++ {
+		for j := max(0, i-benchPeersPerViewer); j < i; j++ {
+			if err := hosts[i].Connect(ctx, peer.AddrInfo{ID: hosts[j].ID(), Addrs: hosts[j].Addrs()}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var wg sync.WaitGroup
+	for _, topic := range topics[1:] {
+		sub, err := topic.Subscribe(pubsub.WithBufferSize(4096))
+		if err != nil {
+			b.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			received := make(map[uint64]int) // chunks by frame
+			for {
+				msg, err := sub.Next(ctx)
+				if err != nil {
+					return
+				}
+				frame := binary.BigEndian.Uint64(msg.Data[0:8])
+				chunks := int(binary.BigEndian.Uint16(msg.Data[16:18]))
+				received[frame]++
+				if received[frame] == chunks {
+					published := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Data[8:16])))
+					mu.Lock()
+					latencies = append(latencies, time.Since(published))
+					mu.Unlock()
+					delete(received, frame)
+				}
+			}
+		}()
+	}
+	// Let the meshes form before measuring
+	time.Sleep(2 * time.Second)
+
+	ticker := time.NewTicker(benchFrameInterval)
+	defer ticker.Stop()
+	b.ResetTimer()
+	for frame := 0; frame < b.N; frame++ {
+		chunks := benchFrameChunks
+		if frame%benchKeyframeEvery == 0 {
+			chunks = benchKeyframeChunks
+		}
+		published := time.Now().UnixNano()
+		for i := 0; i < chunks; i++ {
+			// Publish keeps the slice, so every chunk needs its own
+			chunk := make([]byte, benchChunkSize)
+			binary.BigEndian.PutUint64(chunk[0:8], uint64(frame))
+			binary.BigEndian.PutUint64(chunk[8:16], uint64(published))
+			binary.BigEndian.PutUint16(chunk[16:18], uint16(chunks))
+			binary.BigEndian.PutUint16(chunk[18:20], uint16(i))
+			if err := topics[0].Publish(ctx, chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+		<-ticker.C
+	}
+	// Give the last frames time to arrive
+	time.Sleep(500 * time.Millisecond)
+	b.StopTimer()
+	cancel()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := b.N * benchViewers; len(latencies) < want {
+		b.Logf("%d of %d frames arrived whole", len(latencies), want)
+	}
+	if len(latencies) == 0 {
+		b.Fatal("no frame arrived")
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		return float64(latencies[int(p*float64(len(latencies)-1))]) / float64(time.Millisecond)
+	}
+	b.ReportMetric(percentile(0.50), "p50-ms")
+	b.ReportMetric(percentile(0.95), "p95-ms")
+	b.ReportMetric(percentile(0.99), "p99-ms")
+	b.ReportMetric(float64(len(latencies))/float64(b.N*benchViewers), "delivered")
+}
@@ -0,0 +1,200 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+// A node's peer ID is derived from its private key, which is generated once
+// and kept in an identity file so that the ID survives restarts and can be
+// pinned by viewers and allow-lists. The file holds the key in libp2p's
+// protobuf encoding and must only be readable by its owner.
+
+// identityFileMode keeps the key private to its owner.
+const identityFileMode = 0600
+
+// IdentityPath returns the identity file configured in cfg, or a file named
+// after the role, such as "broadcaster", in the working directory. Separate
+// defaults let a broadcaster and a viewer run side by side.
+func IdentityPath(cfg *config.NetworkConfig, role string) string {
+	if cfg.IdentityFile != "" {
+		return cfg.IdentityFile
+	}
+	return role + "-identity.key"
+}
+
+// LoadIdentity reads the node's private key from path, generating and
+// storing a new one on first use.
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	key, err := ReadIdentity(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return GenerateIdentity(path)
+	}
+	return key, err
+}
+
+// ReadIdentity reads the private key stored at path. It refuses a file
+// that others can read or write.
+func ReadIdentity(path string) (crypto.PrivKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIdentityMode(path, info.Mode()); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// checkIdentityMode rejects an identity file with group or other
+// permissions. Windows has no such permission bits to check.
+func checkIdentityMode(path string, mode fs.FileMode) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if mode.Perm()&0077 != 0 {
+		return fmt.Errorf("identity file %s is accessible by others (mode %04o); run chmod 600 %s", path, mode.Perm(), path)
+	}
+	return nil
+}
+
+// GenerateIdentity creates a new Ed25519 key and stores it at path,
+// replacing any key there.
+func GenerateIdentity(path string) (crypto.PrivKey, error) {
+	key, data, err := newIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeIdentityFile(path, data); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RotateIdentity replaces the key at path with a new one. The old file is
+// kept alongside as path + ".old" so that a rotation can be undone; it
+// refuses to run while an earlier backup is still there rather than
+// overwrite it. The key at path is only replaced once the new key and the
+// backup are both on disk, so a failure leaves it as it was.
+func RotateIdentity(path string) (old crypto.PrivKey, next crypto.PrivKey, err error) {
+	old, err = ReadIdentity(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldData, err := crypto.MarshalPrivateKey(old)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode identity: %w", err)
+	}
+	next, data, err := newIdentity()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmp, err := writeIdentityTemp(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmp)
+
+	backup := path + ".old"
+	if err := writeIdentityBackup(backup, oldData); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(backup)
+		return nil, nil, fmt.Errorf("failed to write identity: %w", err)
+	}
+	return old, next, nil
+}
+
+// newIdentity generates an Ed25519 key and returns it with its encoding.
+func newIdentity() (crypto.PrivKey, []byte, error) {
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+	data, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode identity: %w", err)
+	}
+	return key, data, nil
+}
+
+// writeIdentityBackup stores the old key at backup, failing if a file is
+// already there.
+func writeIdentityBackup(backup string, data []byte) error {
+	f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, identityFileMode)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s already exists; move it away before rotating again", backup)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to keep old identity: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(backup)
+		return fmt.Errorf("failed to keep old identity: %w", err)
+	}
+	return nil
+}
+
+// writeIdentityFile writes data through a temporary file, so that a crash
+// never leaves a truncated key behind.
+func writeIdentityFile(path string, data []byte) error {
+	tmp, err := writeIdentityTemp(path, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write identity: %w", err)
+	}
+	return nil
+}
+
+// writeIdentityTemp writes data to a new private file next to path and
+// returns its name.
+func writeIdentityTemp(path string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", fmt.Errorf("failed to write identity: %w", err)
+	}
+	if err := tmp.Chmod(identityFileMode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write identity: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write identity: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write identity: %w", err)
+	}
+	return tmp.Name(), nil
+}
@@ -0,0 +1,49 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node-identity.key")
+	first, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadIdentity() error = %v", err)
+	}
+
+	old, next, err := RotateIdentity(path)
+	if err != nil {
+		t.Fatalf("RotateIdentity() error = %v", err)
+	}
+	if !old.Equals(first) || next.Equals(first) {
+		t.Fatal("RotateIdentity() did not move from the stored key to a new one")
+	}
+	if stored, err := ReadIdentity(path); err != nil || !stored.Equals(next) {
+		t.Fatalf("ReadIdentity() = %v, want the new key", err)
+	}
+	if backup, err := ReadIdentity(path + ".old"); err != nil || !backup.Equals(first) {
+		t.Fatalf("ReadIdentity(backup) = %v, want the old key", err)
+	}
+
+	// A second rotation would lose the first key, so it must refuse and
+	// leave both files alone
+	if _, _, err := RotateIdentity(path); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("RotateIdentity() with a backup present error = %v", err)
+	}
+	if stored, err := ReadIdentity(path); err != nil || !stored.Equals(next) {
+		t.Errorf("key changed after a refused rotation: %v", err)
+	}
+	if backup, err := ReadIdentity(path + ".old"); err != nil || !backup.Equals(first) {
+		t.Errorf("backup changed after a refused rotation: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory holds %d files, want the key and its backup", len(entries))
+	}
+}
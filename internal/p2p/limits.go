@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+)
+
+// Connections are bounded at two levels, both sized from MaxPeers. Past the
+// high watermark the connection manager closes the least useful connections
+// until the low watermark is reached, sparing protected ones such as a
+// viewer's connection to its broadcaster. The resource manager is the hard
+// cap behind it, with headroom for the connections still being set up when
+// the connection manager trims.
+const (
+	defaultMaxPeers = 50
+
+	// New connections are never trimmed within this long of opening, so that
+	// a peer has time to join the mesh
+	connGracePeriod = 30 * time.Second
+
+	// Hard connection limit as a multiple of MaxPeers
+	connHeadroom = 2
+)
+
+// connWatermarks returns the connection manager's low and high watermarks.
+func connWatermarks(maxPeers int) (low int, high int) {
+	if maxPeers <= 0 {
+		maxPeers = defaultMaxPeers
+	}
+	low = maxPeers * 4 / 5
+	if low < 1 {
+		low = 1
+	}
+	return low, maxPeers
+}
+
+// newConnManager trims to the watermarks of maxPeers. opts follow the grace
+// period, so that tests can replace the clock.
+func newConnManager(maxPeers int, opts ...connmgr.Option) (*connmgr.BasicConnMgr, error) {
+	low, high := connWatermarks(maxPeers)
+	opts = append([]connmgr.Option{connmgr.WithGracePeriod(connGracePeriod)}, opts...)
+	cm, err := connmgr.NewConnManager(low, high, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection manager: %w", err)
+	}
+	return cm, nil
+}
+
+// newResourceManager scales libp2p's default limits to the machine and caps
+// connections at connHeadroom times the high watermark. Connections that
+// have not yet been upgraded are held to the high watermark.
+func newResourceManager(maxPeers int) (network.ResourceManager, error) {
+	_, high := connWatermarks(maxPeers)
+	conns := rcmgr.LimitVal(high * connHeadroom)
+	transient := rcmgr.LimitVal(high)
+
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+	partial := rcmgr.PartialLimitConfig{
+		System: rcmgr.ResourceLimits{
+			Conns:         conns,
+			ConnsInbound:  conns,
+			ConnsOutbound: conns,
+		},
+		Transient: rcmgr.ResourceLimits{
+			Conns:         transient,
+			ConnsInbound:  transient,
+			ConnsOutbound: transient,
+		},
+	}
+
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(partial.Build(limits.AutoScale())))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource manager: %w", err)
+	}
+	return rm, nil
+}
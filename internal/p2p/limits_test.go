@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestConnWatermarks(t *testing.T) {
+	tests := []struct {
+		maxPeers  int
+		low, high int
+	}{
+		{0, 40, 50},
+		{-3, 40, 50},
+		{1, 1, 1},
+		{2, 1, 2},
+		{5, 4, 5},
+		{50, 40, 50},
+		{101, 80, 101},
+	}
+	for _, tt := range tests {
+		low, high := connWatermarks(tt.maxPeers)
+		if low != tt.low || high != tt.high {
+			t.Errorf("connWatermarks(%d) = %d, %d, want %d, %d", tt.maxPeers, low, high, tt.low, tt.high)
+		}
+	}
+}
+
+// With MaxPeers 2, at most 2 connections may be setting up at a time and 4
+// be open in all.
+func TestResourceManagerConnLimits(t *testing.T) {
+	rm, err := newResourceManager(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Close()
+
+	addr := ma.StringCast("/ip4/10.0.0.1/tcp/4001")
+	var scopes []network.ConnManagementScope
+	defer func() {
+		for _, s := range scopes {
+			s.Done()
+		}
+	}()
+	open := func() (network.ConnManagementScope, error) {
+		s, err := rm.OpenConnection(network.DirInbound, true, addr)
+		if err == nil {
+			scopes = append(scopes, s)
+		}
+		return s, err
+	}
+
+	// Transient: connections not yet upgraded to a peer
+	var pending []network.ConnManagementScope
+	for i := 0; i < 2; i++ {
+		s, err := open()
+		if err != nil {
+			t.Fatalf("connection %d refused: %v", i+1, err)
+		}
+		pending = append(pending, s)
+	}
+	if _, err := open(); err == nil {
+		t.Fatal("a third connection in setup was accepted")
+	}
+
+	// System: upgraded connections make room for more, up to 4
+	for _, s := range pending {
+		if err := s.SetPeer(testPeerID(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		s, err := open()
+		if err != nil {
+			t.Fatalf("connection %d refused: %v", i+3, err)
+		}
+		if err := s.SetPeer(testPeerID(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := open(); err == nil {
+		t.Fatal("a fifth connection was accepted")
+	}
+}
+
+// Past the grace period, trimming to the low watermark spares a protected
+// peer, such as a viewer's broadcaster, even when it is the least valuable.
+func TestConnManagerSparesProtectedPeer(t *testing.T) {
+	mock := clock.NewMock()
+	cm, err := newConnManager(5, connmgr.WithClock(mock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	mn, err := mocknet.WithNPeers(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	hub, others := mn.Hosts()[0], mn.Hosts()[1:]
+	hub.Network().Notify(cm.Notifee())
+
+	broadcaster := others[0].ID()
+	cm.Protect(broadcaster, "broadcaster")
+	for _, h := range others {
+		if _, err := mn.ConnectPeers(hub.ID(), h.ID()); err != nil {
+			t.Fatal(err)
+		}
+		if h.ID() != broadcaster {
+			cm.TagPeer(h.ID(), "useful", 10)
+		}
+	}
+
+	// Nothing is trimmed within the grace period
+	cm.TrimOpenConns(context.Background())
+	if n := len(hub.Network().Peers()); n != len(others) {
+		t.Fatalf("%d peers left within the grace period, want %d", n, len(others))
+	}
+
+	mock.Add(connGracePeriod + 1)
+	cm.TrimOpenConns(context.Background())
+	// Protected peers do not count towards the low watermark
+	low, _ := connWatermarks(5)
+	if n := len(hub.Network().Peers()); n != low+1 {
+		t.Errorf("%d peers left after trimming, want %d", n, low+1)
+	}
+	if hub.Network().Connectedness(broadcaster) != network.Connected {
+		t.Error("the protected broadcaster was trimmed")
+	}
+}
@@ -5,50 +5,176 @@ import (
 	"fmt"
 
 	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/meshlink/church-streaming/internal/config"
 	"github.com/sirupsen/logrus"
 )
 
 type Node struct {
-	Host   host.Host
-	PubSub *pubsub.PubSub
-	ctx    context.Context
-	logger *logrus.Logger
+	Host       host.Host
+	PubSub     *pubsub.PubSub
+	serviceTag string
+	bootstrap  []peer.AddrInfo
+	dht        *dht.IpfsDHT
+	relay      *relayv2.Relay
+	maxPeers   int
+	capacity   Capacity
+	ctx        context.Context
+	cancel     context.CancelFunc
+	logger     *logrus.Logger
+
+	peerCapacity *capacityTable
 }
 
-func NewNode(ctx context.Context) (*Node, error) {
-	h, err := libp2p.New(
-		libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"),
-		libp2p.EnableRelay(),
-	)
+// NewNode starts a libp2p host with the given identity, listening on the
+// configured port and finding peers on the local network by mDNS under
+// serviceTag, and beyond it through the configured bootstrap peers, relays
+// and DHT. Only nodes using the same tag find each other, the access rules
+// decide which of them may connect, and connections are limited to around
+// MaxPeers. Streams are forwarded preferably through the peers that spare
+// the most upload, and not through leaves.
+func NewNode(ctx context.Context, cfg *config.NetworkConfig, serviceTag string, identity crypto.PrivKey) (*Node, error) {
+	logger := logrus.New()
+	gater, err := NewConnectionGater(&cfg.Access, logger)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
+		return nil, fmt.Errorf("invalid access config: %w", err)
+	}
+	bootstrap, err := parsePeerAddrs("bootstrap peer", cfg.BootstrapPeers)
+	if err != nil {
+		return nil, err
+	}
+	relays, err := parsePeerAddrs("relay", cfg.Relays)
+	if err != nil {
+		return nil, err
+	}
+	dhtMode, useDHT, err := parseDHTMode(cfg.DHTMode)
+	if err != nil {
+		return nil, err
+	}
+	routerOpts, err := routerOptions(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	ps, err := pubsub.NewGossipSub(ctx, h)
+	h, err := newHost(cfg, cfg.Port, identity, gater, relays)
+	if err != nil && cfg.Port != 0 {
+		// Typically the port is taken, as when a broadcaster and a viewer
+		// share a machine and a config
+		logger.Warnf("Failed to listen on port %d, using a free port: %v", cfg.Port, err)
+		h, err = newHost(cfg, 0, identity, gater, relays)
+	}
 	if err != nil {
+		return nil, err
+	}
+
+	capacity := Capacity{UploadKbps: cfg.UploadKbps, Leaf: cfg.Leaf}
+	peerCapacity := &capacityTable{peers: make(map[peer.ID]Capacity)}
+
+	// Every message is signed by its author and checked on receipt, which
+	// stream topic validators rely on to tell the broadcaster's frames apart
+	opts := []pubsub.Option{pubsub.WithMessageSignaturePolicy(pubsub.StrictSign)}
+	opts = append(opts, routerOpts...)
+	opts = append(opts, scoreOptions(peerCapacity)...)
+	ps, err := pubsub.NewGossipSub(ctx, h, opts...)
+	if err != nil {
+		h.Close()
 		return nil, fmt.Errorf("failed to create pubsub: %w", err)
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	node := &Node{
-		Host:   h,
-		PubSub: ps,
-		ctx:    ctx,
-		logger: logrus.New(),
+		Host:       h,
+		PubSub:     ps,
+		serviceTag: serviceTag,
+		bootstrap:  bootstrap,
+		maxPeers:   cfg.MaxPeers,
+		capacity:   capacity,
+		ctx:        ctx,
+		cancel:     cancel,
+		logger:     logger,
+
+		peerCapacity: peerCapacity,
 	}
+	node.setupCapacity()
 
+	// Past this point a failure closes the node, stopping its background
+	// work and releasing the host and, once created, the DHT
 	if err := node.setupDiscovery(); err != nil {
+		node.Close()
 		return nil, fmt.Errorf("failed to setup discovery: %w", err)
 	}
+	if useDHT {
+		if err := node.setupDHT(dhtMode); err != nil {
+			node.Close()
+			return nil, err
+		}
+	}
+	if len(bootstrap) > 0 {
+		go node.keepBootstrapped()
+	}
 
 	return node, nil
 }
 
+// newHost creates the libp2p host, listening on port over TCP and QUIC.
+// Without a public address it reserves slots on the static relays, and it
+// tries to turn relayed connections into direct ones.
+func newHost(cfg *config.NetworkConfig, port int, identity crypto.PrivKey, gater *ConnectionGater, relays []peer.AddrInfo) (host.Host, error) {
+	cm, err := newConnManager(cfg.MaxPeers)
+	if err != nil {
+		return nil, err
+	}
+	rm, err := newResourceManager(cfg.MaxPeers)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []libp2p.Option{
+		libp2p.Identity(identity),
+		libp2p.ConnectionGater(gater),
+		libp2p.ConnectionManager(cm),
+		libp2p.ResourceManager(rm),
+		// Without port reuse a second node on the same machine cannot
+		// share a TCP port, where dials meant for one would reach the other
+		libp2p.Transport(tcp.NewTCPTransport, tcp.DisableReuseport()),
+		libp2p.Transport(quic.NewTransport),
+		libp2p.ListenAddrStrings(listenAddrs(port)...),
+		libp2p.NATPortMap(),
+		libp2p.EnableRelay(),
+		libp2p.EnableHolePunching(),
+	}
+	if len(relays) > 0 {
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(relays))
+	}
+
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
+	}
+	return h, nil
+}
+
+// listenAddrs returns the TCP and QUIC addresses of port on every IPv4 and
+// IPv6 interface.
+func listenAddrs(port int) []string {
+	return []string{
+		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port),
+		fmt.Sprintf("/ip6/::/tcp/%d", port),
+		fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1", port),
+		fmt.Sprintf("/ip6/::/udp/%d/quic-v1", port),
+	}
+}
+
 func (n *Node) setupDiscovery() error {
-	s := mdns.NewMdnsService(n.Host, "meshlink-church", &discoveryNotifee{node: n})
+	s := mdns.NewMdnsService(n.Host, n.serviceTag, &discoveryNotifee{node: n})
 	return s.Start()
 }
 
@@ -64,5 +190,12 @@ func (d *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
 }
 
 func (n *Node) Close() error {
+	n.cancel()
+	if n.relay != nil {
+		n.relay.Close()
+	}
+	if n.dht != nil {
+		n.dht.Close()
+	}
 	return n.Host.Close()
 }
\ No newline at end of file
@@ -0,0 +1,58 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+// libp2p's default relay limits are meant for hole punching and cut a
+// connection after two minutes or 128 KiB. A congregation's own relay
+// allows more, but a relayed connection is always limited, so that a peer
+// cannot tie up the relay's upload indefinitely. Streams reach peers
+// behind NAT through the relay's own GossipSub mesh rather than through
+// circuits, which GossipSub does not use while they are limited.
+const (
+	defaultCircuitDuration = 10 * time.Minute
+	defaultCircuitData     = 64 << 20 // bytes
+)
+
+// EnableRelayService lets peers that cannot reach each other directly, such
+// as viewers behind NAT, connect through this node with circuit relay v2.
+// Each relayed connection is limited as configured in cfg, and the number
+// of reservations is bounded by MaxPeers.
+func (n *Node) EnableRelayService(cfg *config.RelayConfig) error {
+	if n.relay != nil {
+		return fmt.Errorf("relay service already enabled")
+	}
+
+	_, maxReservations := connWatermarks(n.maxPeers)
+	resources := relayv2.DefaultResources()
+	resources.Limit = circuitLimit(cfg)
+	resources.MaxReservations = maxReservations
+
+	r, err := relayv2.New(n.Host, relayv2.WithResources(resources))
+	if err != nil {
+		return fmt.Errorf("failed to start relay service: %w", err)
+	}
+	n.relay = r
+	return nil
+}
+
+// circuitLimit returns the configured limit of a relayed connection,
+// falling back to the defaults for unset values.
+func circuitLimit(cfg *config.RelayConfig) *relayv2.RelayLimit {
+	limit := &relayv2.RelayLimit{
+		Duration: defaultCircuitDuration,
+		Data:     defaultCircuitData,
+	}
+	if cfg.CircuitDuration > 0 {
+		limit.Duration = time.Duration(cfg.CircuitDuration) * time.Second
+	}
+	if cfg.CircuitDataMB > 0 {
+		limit.Data = int64(cfg.CircuitDataMB) << 20
+	}
+	return limit
+}
@@ -0,0 +1,29 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+func TestCircuitLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          config.RelayConfig
+		wantDuration time.Duration
+		wantData     int64
+	}{
+		{"defaults", config.RelayConfig{}, defaultCircuitDuration, defaultCircuitData},
+		{"configured", config.RelayConfig{CircuitDuration: 30, CircuitDataMB: 2}, 30 * time.Second, 2 << 20},
+		{"negative keeps defaults", config.RelayConfig{CircuitDuration: -1, CircuitDataMB: -1}, defaultCircuitDuration, defaultCircuitData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := circuitLimit(&tt.cfg)
+			if limit == nil || limit.Duration != tt.wantDuration || limit.Data != tt.wantData {
+				t.Errorf("circuitLimit() = %+v, want %s and %d bytes", limit, tt.wantDuration, tt.wantData)
+			}
+		})
+	}
+}
@@ -12,21 +12,24 @@ import (
 )
 
 type BroadcasterUI struct {
-	app           fyne.App
-	window        fyne.Window
-	statusText    *widget.Label
-	startBtn      *widget.Button
-	stopBtn       *widget.Button
-	previewArea   *widget.Card
-	statsLabel    *widget.Label
-	qualitySelect *widget.Select
-	onStart       func() error
-	onStop        func()
-	onQualityChange func(string) error
-	getStats      func() (uint64, uint64, bool)
-	getViewerCount func() int
-	isStreaming   bool
-	startTime     time.Time
+	app               fyne.App
+	window            fyne.Window
+	statusText        *widget.Label
+	startBtn          *widget.Button
+	stopBtn           *widget.Button
+	previewArea       *widget.Card
+	statsLabel        *widget.Label
+	qualitySelect     *widget.Select
+	audioOnlyCheck    *widget.Check
+	onStart           func() error
+	onStop            func()
+	onQualityChange   func(string) error
+	onAudioOnlyChange func(bool) error
+	getStats          func() (uint64, uint64, bool)
+	getViewerCount    func() int
+	isStreaming       bool
+	audioOnly         bool
+	startTime         time.Time
 }
 
 func NewBroadcasterUI() *BroadcasterUI {
@@ -83,18 +86,37 @@ func (ui *BroadcasterUI) setupUI() {
 		default:
 			quality = "720p"
 		}
-		
+
 		// Update broadcaster quality if callback is set
 		if ui.onQualityChange != nil {
 			if err := ui.onQualityChange(quality); err != nil {
 				ui.statusText.SetText(fmt.Sprintf("Quality change failed: %v", err))
+			} else if ui.isStreaming {
+				// Applied live at the next keyframe
+				ui.statusText.SetText(fmt.Sprintf("🔴 Broadcasting Live - switching to %s", quality))
 			}
 		}
 	})
 	ui.qualitySelect.SetSelected("720p (2Mbps)")
 
+	// Audio-only mode for overflow rooms and low-bandwidth members
+	ui.audioOnlyCheck = widget.NewCheck("Audio only (no camera)", func(checked bool) {
+		if checked == ui.audioOnly {
+			return
+		}
+		if ui.onAudioOnlyChange != nil {
+			if err := ui.onAudioOnlyChange(checked); err != nil {
+				ui.statusText.SetText(fmt.Sprintf("Audio-only change failed: %v", err))
+				ui.audioOnlyCheck.SetChecked(ui.audioOnly)
+				return
+			}
+		}
+		ui.audioOnly = checked
+		ui.updateUI()
+	})
+
 	// Preview area
-	ui.previewArea = widget.NewCard("Camera Preview", "Camera feed will appear here", 
+	ui.previewArea = widget.NewCard("Camera Preview", "Camera feed will appear here",
 		widget.NewLabel("📹 Camera Preview\n\nSource: Default camera\nResolution: 1280x720\nFPS: 30\n\nIn production:\n- Live camera feed\n- Audio level meters\n- Recording controls"),
 	)
 	ui.previewArea.Resize(fyne.NewSize(320, 240))
@@ -111,6 +133,7 @@ func (ui *BroadcasterUI) setupUI() {
 		container.NewHBox(ui.startBtn, ui.stopBtn),
 		widget.NewLabel("Quality:"),
 		ui.qualitySelect,
+		ui.audioOnlyCheck,
 		ui.statsLabel,
 	)
 
@@ -127,50 +150,68 @@ func (ui *BroadcasterUI) updateUI() {
 		ui.statusText.SetText("🔴 Broadcasting Live")
 		ui.startBtn.Disable()
 		ui.stopBtn.Enable()
-		ui.qualitySelect.Disable()
-		ui.previewArea.SetSubTitle("Live - broadcasting to network")
+		ui.audioOnlyCheck.Disable()
+		if ui.audioOnly {
+			ui.qualitySelect.Disable()
+			ui.previewArea.SetSubTitle("Live - broadcasting audio only")
+		} else {
+			ui.qualitySelect.Enable()
+			ui.previewArea.SetSubTitle("Live - broadcasting to network")
+		}
 	} else {
 		ui.statusText.SetText("⚪ Ready to broadcast")
 		ui.startBtn.Enable()
 		ui.stopBtn.Disable()
-		ui.qualitySelect.Enable()
-		ui.previewArea.SetSubTitle("Camera feed will appear here")
+		ui.audioOnlyCheck.Enable()
+		if ui.audioOnly {
+			ui.qualitySelect.Disable()
+			ui.previewArea.SetSubTitle("Audio only - camera disabled")
+		} else {
+			ui.qualitySelect.Enable()
+			ui.previewArea.SetSubTitle("Camera feed will appear here")
+		}
 		ui.statsLabel.SetText("Statistics: Not broadcasting")
 	}
 }
 
 func (ui *BroadcasterUI) updateStats() {
 	ui.startTime = time.Now()
-	
+
 	for ui.isStreaming {
 		// Get real statistics from broadcaster
 		var frameCount, bytesSent uint64
 		var viewerCount int
-		
+
 		if ui.getStats != nil {
 			frameCount, bytesSent, _ = ui.getStats()
 		}
-		
+
 		if ui.getViewerCount != nil {
 			viewerCount = ui.getViewerCount()
 		}
-		
+
 		// Calculate actual uptime
 		uptime := time.Since(ui.startTime).Truncate(time.Second)
-		
+
 		// Calculate frame rate
 		var fps float64
 		if uptime.Seconds() > 0 {
 			fps = float64(frameCount) / uptime.Seconds()
 		}
-		
-		statsText := fmt.Sprintf("Viewers: %d | Sent: %.2f MB | FPS: %.1f | Uptime: %s", 
-			viewerCount, 
+
+		statsText := fmt.Sprintf("Viewers: %d | Sent: %.2f MB | FPS: %.1f | Uptime: %s",
+			viewerCount,
 			float64(bytesSent)/(1024*1024),
 			fps,
 			uptime.String())
+		if ui.audioOnly {
+			statsText = fmt.Sprintf("Viewers: %d | Sent: %.2f MB | Audio only | Uptime: %s",
+				viewerCount,
+				float64(bytesSent)/(1024*1024),
+				uptime.String())
+		}
 		ui.statsLabel.SetText(statsText)
-		
+
 		time.Sleep(1 * time.Second)
 	}
 }
@@ -189,6 +230,20 @@ func (ui *BroadcasterUI) SetOnQualityChange(callback func(string) error) {
 	ui.onQualityChange = callback
 }
 
+// SetOnAudioOnlyChange sets the callback used when the operator toggles
+// audio-only mode.
+func (ui *BroadcasterUI) SetOnAudioOnlyChange(callback func(bool) error) {
+	ui.onAudioOnlyChange = callback
+}
+
+// SetAudioOnly reflects the broadcaster's current mode without invoking the
+// change callback.
+func (ui *BroadcasterUI) SetAudioOnly(audioOnly bool) {
+	ui.audioOnly = audioOnly
+	ui.audioOnlyCheck.SetChecked(audioOnly)
+	ui.updateUI()
+}
+
 func (ui *BroadcasterUI) Run() {
 	ui.window.ShowAndRun()
-}
\ No newline at end of file
+}
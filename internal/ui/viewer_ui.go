@@ -10,15 +10,28 @@ import (
 	"fyne.io/fyne/v2/widget"
 )
 
+// StreamOption is a live stream offered in the stream picker.
+type StreamOption struct {
+	ID    uint32
+	Label string
+}
+
 type ViewerUI struct {
 	app         fyne.App
 	window      fyne.Window
 	statusText  *widget.Label
+	streamSelect *widget.Select
 	connectBtn  *widget.Button
 	videoArea   *widget.Card
 	statsLabel  *widget.Label
-	onConnect   func() error
+	renditionLabel *widget.Label
+	onConnect   func(streamID uint32) error
 	onDisconnect func()
+	getFECStats func() (uint64, uint64)
+	rendition   string
+	keyError    error
+	streams     []StreamOption
+	streamID    uint32
 	isConnected bool
 	bytesReceived uint64
 	framesReceived uint64
@@ -43,26 +56,13 @@ func (ui *ViewerUI) setupUI() {
 	ui.statusText = widget.NewLabel("Searching for broadcasts...")
 	ui.statusText.Alignment = fyne.TextAlignCenter
 
-	ui.connectBtn = widget.NewButton("Connect to Stream", func() {
-		if !ui.isConnected {
-			if ui.onConnect != nil {
-				ui.statusText.SetText("Connecting...")
-				if err := ui.onConnect(); err != nil {
-					ui.statusText.SetText(fmt.Sprintf("Connection failed: %v", err))
-					return
-				}
-				ui.isConnected = true
-				ui.updateUI()
-			}
-		} else {
-			if ui.onDisconnect != nil {
-				ui.onDisconnect()
-			}
-			ui.isConnected = false
-			ui.bytesReceived = 0
-			ui.framesReceived = 0
-			ui.updateUI()
-		}
+	// Picking a stream connects to it, leaving any other stream first
+	ui.streamSelect = widget.NewSelect(nil, ui.selectStream)
+	ui.streamSelect.PlaceHolder = "Select a stream..."
+
+	ui.connectBtn = widget.NewButton("Disconnect", func() {
+		ui.disconnect()
+		ui.streamSelect.ClearSelected()
 	})
 
 	ui.videoArea = widget.NewCard("Video Stream", "Waiting for connection...", 
@@ -73,11 +73,13 @@ func (ui *ViewerUI) setupUI() {
 	ui.statsLabel = widget.NewLabel("Statistics: Not connected")
 	ui.statsLabel.Alignment = fyne.TextAlignCenter
 
+	ui.renditionLabel = widget.NewLabel("")
+
 	ui.updateUI()
 
 	topControls := container.NewVBox(
 		ui.statusText,
-		container.NewHBox(ui.connectBtn),
+		container.NewHBox(ui.streamSelect, ui.connectBtn, ui.renditionLabel),
 		ui.statsLabel,
 	)
 
@@ -90,22 +92,102 @@ func (ui *ViewerUI) setupUI() {
 	ui.window.SetContent(content)
 }
 
+func (ui *ViewerUI) selectStream(label string) {
+	option, ok := ui.findStream(label)
+	if !ok || (ui.isConnected && option.ID == ui.streamID) {
+		return
+	}
+	ui.disconnect()
+
+	if ui.onConnect != nil {
+		ui.statusText.SetText("Connecting...")
+		if err := ui.onConnect(option.ID); err != nil {
+			ui.streamSelect.ClearSelected()
+			ui.statusText.SetText(fmt.Sprintf("Connection failed: %v", err))
+			return
+		}
+		ui.isConnected = true
+		ui.streamID = option.ID
+		ui.updateUI()
+	}
+}
+
+func (ui *ViewerUI) findStream(label string) (StreamOption, bool) {
+	for _, option := range ui.streams {
+		if option.Label == label {
+			return option, true
+		}
+	}
+	return StreamOption{}, false
+}
+
+func (ui *ViewerUI) disconnect() {
+	if !ui.isConnected {
+		return
+	}
+	if ui.onDisconnect != nil {
+		ui.onDisconnect()
+	}
+	ui.isConnected = false
+	ui.keyError = nil
+	ui.streamID = 0
+	ui.bytesReceived = 0
+	ui.framesReceived = 0
+	ui.updateUI()
+}
+
 func (ui *ViewerUI) updateUI() {
 	if ui.isConnected {
-		ui.statusText.SetText("🔴 Connected - Receiving Stream")
-		ui.connectBtn.SetText("Disconnect")
+		ui.statusText.SetText(ui.connectedStatus())
+		ui.connectBtn.Show()
 		ui.videoArea.SetSubTitle("Stream active - receiving data")
 		ui.statsLabel.SetText("Statistics: Connected - waiting for data...")
 	} else {
-		ui.statusText.SetText("⚪ Searching for broadcasts...")
-		ui.connectBtn.SetText("Connect to Stream")
+		ui.statusText.SetText(ui.searchStatus())
+		ui.connectBtn.Hide()
 		ui.videoArea.SetSubTitle("Waiting for connection...")
 		ui.videoArea.SetContent(widget.NewLabel("📺 Video stream will appear here\n\nResolution: 1280x720\nCodec: H.264\nBitrate: 2000 kbps"))
 		ui.statsLabel.SetText("Statistics: Not connected")
+		ui.rendition = ""
+		ui.renditionLabel.SetText("")
+	}
+}
+
+func (ui *ViewerUI) searchStatus() string {
+	switch len(ui.streams) {
+	case 0:
+		return "⚪ Searching for broadcasts..."
+	case 1:
+		return "⚪ 1 live stream - select it to watch"
+	default:
+		return fmt.Sprintf("⚪ %d live streams - select one to watch", len(ui.streams))
+	}
+}
+
+// SetStreams replaces the streams offered in the picker. Labels are made
+// unique so that each can be picked.
+func (ui *ViewerUI) SetStreams(streams []StreamOption) {
+	seen := make(map[string]int)
+	labels := make([]string, len(streams))
+	for i := range streams {
+		seen[streams[i].Label]++
+		if n := seen[streams[i].Label]; n > 1 {
+			streams[i].Label = fmt.Sprintf("%s (%d)", streams[i].Label, n)
+		}
+		labels[i] = streams[i].Label
+	}
+
+	ui.streams = streams
+	ui.streamSelect.Options = labels
+	ui.streamSelect.Refresh()
+	if !ui.isConnected {
+		ui.statusText.SetText(ui.searchStatus())
 	}
 }
 
-func (ui *ViewerUI) SetOnConnect(callback func() error) {
+// SetOnConnect sets the callback that starts watching the stream picked
+// from the list.
+func (ui *ViewerUI) SetOnConnect(callback func(streamID uint32) error) {
 	ui.onConnect = callback
 }
 
@@ -113,6 +195,55 @@ func (ui *ViewerUI) SetOnDisconnect(callback func()) {
 	ui.onDisconnect = callback
 }
 
+// SetFECStatsCallback supplies the recovered and unrecoverable counts shown
+// in the statistics line.
+func (ui *ViewerUI) SetFECStatsCallback(getFECStats func() (recovered uint64, unrecoverable uint64)) {
+	ui.getFECStats = getFECStats
+}
+
+// ShowNotice briefly replaces the connection status with a message.
+func (ui *ViewerUI) ShowNotice(message string) {
+	ui.statusText.SetText(message)
+	time.AfterFunc(3*time.Second, func() {
+		if ui.isConnected {
+			ui.statusText.SetText(ui.connectedStatus())
+		}
+	})
+}
+
+func (ui *ViewerUI) connectedStatus() string {
+	if ui.keyError != nil {
+		return fmt.Sprintf("🔒 Cannot decrypt stream: %v", ui.keyError)
+	}
+	return "🔴 Connected - Receiving Stream"
+}
+
+// SetKeyError shows that the stream cannot be decrypted with the configured
+// key, or clears that state with nil.
+func (ui *ViewerUI) SetKeyError(err error) {
+	ui.keyError = err
+	if !ui.isConnected {
+		return
+	}
+	ui.statusText.SetText(ui.connectedStatus())
+	if err != nil {
+		ui.videoArea.SetSubTitle("Encrypted stream - check the passphrase or key file")
+	} else {
+		ui.videoArea.SetSubTitle("Stream active - receiving data")
+	}
+}
+
+// SetRendition shows the rendition being received, which the viewer picks
+// automatically from its receive rate and loss.
+func (ui *ViewerUI) SetRendition(rendition string) {
+	ui.rendition = rendition
+	if rendition == "" {
+		ui.renditionLabel.SetText("")
+		return
+	}
+	ui.renditionLabel.SetText(fmt.Sprintf("Quality: %s (auto)", rendition))
+}
+
 func (ui *ViewerUI) UpdateVideoFrame(data []byte) {
 	if !ui.isConnected {
 		return
@@ -132,6 +263,13 @@ func (ui *ViewerUI) UpdateVideoFrame(data []byte) {
 		ui.framesReceived, 
 		float64(ui.bytesReceived)/(1024*1024),
 		float64(ui.framesReceived)/time.Since(time.Now().Add(-time.Duration(ui.framesReceived)*100*time.Millisecond)).Seconds())
+	if ui.rendition != "" {
+		statsText += fmt.Sprintf(" | %s", ui.rendition)
+	}
+	if ui.getFECStats != nil {
+		recovered, unrecoverable := ui.getFECStats()
+		statsText += fmt.Sprintf(" | FEC: %d recovered, %d lost", recovered, unrecoverable)
+	}
 	ui.statsLabel.SetText(statsText)
 
 	// Frame processing: H.264 decode → render → audio sync → buffer management
@@ -0,0 +1,299 @@
+package streaming
+
+import (
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/media"
+)
+
+const (
+	// The viewer measures its receive rate and loss over each window
+	abrWindow = 2 * time.Second
+
+	// Loss above abrDownLoss steps down a rendition at once. A higher
+	// rendition is tried after abrStableWindows windows below abrUpLoss,
+	// waiting longer each time one fails.
+	abrDownLoss      = 0.05
+	abrUpLoss        = 0.01
+	abrStableWindows = 3
+	abrMaxBackoff    = 8
+
+	// Stepping down this soon after stepping up means the higher rendition
+	// did not fit
+	abrFailWindow = 10 * time.Second
+
+	// A rendition that sends no keyframe within this time is given up on
+	renditionProbeTimeout = 5 * time.Second
+)
+
+// RenditionStats describes the viewer's adaptive bitrate measurements.
+type RenditionStats struct {
+	Active   string  // rendition being watched, empty without simulcast
+	Rate     float64 // bits per second received over the last window
+	Loss     float64 // share of frames lost over the last window
+	Switches uint64  // rendition changes since viewing started
+}
+
+// abrSample holds the viewer's running counters at the end of a window.
+type abrSample struct {
+	frames uint64
+	video  uint64
+	bytes  uint64
+	lost   uint64
+}
+
+// abrController decides from one window to the next whether the viewer
+// should move to a lower or higher rendition.
+type abrController struct {
+	last     abrSample
+	stable   int
+	backoff  int
+	lastUp   time.Time
+	sawVideo bool
+	rate     float64
+	loss     float64
+}
+
+func newABRController() abrController {
+	return abrController{backoff: 1}
+}
+
+// update takes the counters at the end of a window and returns -1 to step
+// down, 1 to step up or 0 to stay.
+func (a *abrController) update(now time.Time, sample abrSample, window time.Duration) int {
+	frames := sample.frames - a.last.frames
+	video := sample.video - a.last.video
+	lost := sample.lost - a.last.lost
+	a.rate = float64(sample.bytes-a.last.bytes) * 8 / window.Seconds()
+	a.last = sample
+
+	a.sawVideo = a.sawVideo || video > 0
+	a.loss = 0
+	if frames+lost > 0 {
+		a.loss = float64(lost) / float64(frames+lost)
+	}
+
+	// A higher rendition that held up earns back some patience
+	if !a.lastUp.IsZero() && now.Sub(a.lastUp) > abrFailWindow {
+		a.backoff = max(1, a.backoff/2)
+		a.lastUp = time.Time{}
+	}
+
+	switch {
+	case video == 0 && frames > 0 && a.sawVideo:
+		// Audio still flows but video stopped: the broadcaster lowered its
+		// quality and no longer publishes this rendition
+		a.sawVideo = false
+		a.stable = 0
+		return -1
+	case a.loss > abrDownLoss:
+		a.stable = 0
+		if !a.lastUp.IsZero() {
+			a.failed()
+		}
+		return -1
+	case a.loss < abrUpLoss && video > 0:
+		a.stable++
+		if a.stable >= abrStableWindows*a.backoff {
+			a.stable = 0
+			return 1
+		}
+	default:
+		a.stable = 0
+	}
+	return 0
+}
+
+// switched records a completed switch.
+func (a *abrController) switched(now time.Time, up bool) {
+	a.stable = 0
+	a.sawVideo = false
+	if up {
+		a.lastUp = now
+	}
+}
+
+// failed doubles the wait before the next step up.
+func (a *abrController) failed() {
+	a.backoff = min(abrMaxBackoff, a.backoff*2)
+	a.lastUp = time.Time{}
+}
+
+// renditionProbe is a subscription to another rendition, kept until its
+// first keyframe arrives so that the switch lands on a decodable frame.
+type renditionProbe struct {
+	index       int
+	sub         feed
+	reassembler *Reassembler
+	deadline    time.Time
+}
+
+// adaptRendition measures the last window and starts or abandons a switch.
+// It runs on the receive loop.
+func (v *Viewer) adaptRendition(now time.Time) {
+	if len(v.renditions) < 2 {
+		return
+	}
+
+	jitter := v.jitterBuffer.GetStats()
+	_, incomplete, _ := v.reassembler.GetStats()
+	step := v.abr.update(now, abrSample{
+		frames: v.framesReceived,
+		video:  v.videoReceived,
+		bytes:  v.bytesReceived,
+		lost:   jitter.Lost + incomplete,
+	}, abrWindow)
+
+	active := int(v.rendition.Load())
+	v.renditionMu.Lock()
+	v.renditionStats.Rate = v.abr.rate
+	v.renditionStats.Loss = v.abr.loss
+	v.renditionMu.Unlock()
+
+	if v.probe != nil {
+		switch {
+		case now.After(v.probe.deadline):
+			if v.probe.index > active {
+				v.abr.failed()
+			}
+			v.cancelProbe("no keyframe arrived")
+		case step < 0 && v.probe.index > active:
+			v.cancelProbe("loss on the current rendition")
+		default:
+			return
+		}
+	}
+
+	target := active + step
+	if step == 0 || target < 0 || target >= len(v.renditions) || v.isFastStartPending() {
+		return
+	}
+	v.startProbe(target)
+}
+
+// startProbe subscribes to another rendition and asks for a keyframe on
+// it. The current rendition keeps playing until that keyframe arrives.
+func (v *Viewer) startProbe(index int) {
+	name := v.renditions[index]
+	sub, err := v.subscribe(index)
+	if err != nil {
+		v.logger.Warnf("Failed to subscribe to rendition %s: %v", name, err)
+		return
+	}
+
+	v.probe = &renditionProbe{
+		index:       index,
+		sub:         sub,
+		reassembler: NewReassembler(0),
+		deadline:    time.Now().Add(renditionProbeTimeout),
+	}
+	go v.read(sub, v.stopChan)
+	v.sendKeyframeRequest(name, "switch")
+
+	v.logger.Infof("Switching to rendition %s (%.0f kbps, %.1f%% loss on %s)",
+		name, v.abr.rate/1000, v.abr.loss*100, v.activeRendition())
+}
+
+func (v *Viewer) cancelProbe(reason string) {
+	v.logger.Infof("Staying on rendition %s: %s", v.activeRendition(), reason)
+	v.probe.sub.Cancel()
+	v.probe = nil
+}
+
+// receiveProbe handles a chunk or frame from the rendition being probed,
+// switching over once a video keyframe is complete. Earlier frames are
+// discarded; the current rendition still covers them.
+func (v *Viewer) receiveProbe(in subscriptionMessage) {
+	frame := in.data
+	if !in.frame {
+		var err error
+		if frame, err = v.probe.reassembler.Add(in.data); err != nil || frame == nil {
+			return
+		}
+	}
+	header, err := media.PeekHeader(frame)
+	if err != nil || header.Codec.IsAudio() || !header.IsKeyframe() {
+		return
+	}
+	v.switchRendition(header, frame)
+}
+
+// switchRendition makes the probed rendition the active one, starting with
+// its keyframe.
+func (v *Viewer) switchRendition(header *media.FrameHeader, keyframe []byte) {
+	probe := v.probe
+	v.probe = nil
+	previous := int(v.rendition.Load())
+
+	v.subscription.Cancel()
+	probe.reassembler.Inherit(v.reassembler)
+	v.subscription = probe.sub
+	v.reassembler = probe.reassembler
+	v.rendition.Store(int32(probe.index))
+	v.abr.switched(time.Now(), probe.index > previous)
+
+	// Frame IDs restart with the new rendition's sequence, and frames up to
+	// the keyframe have already been delivered by the old one
+	v.jitterBuffer.Resync(header.PTS)
+	v.audioResumePTS = v.lastAudioPTS
+	v.startMu.Lock()
+	v.fastStartStream = 0
+	v.startMu.Unlock()
+
+	name := v.renditions[probe.index]
+	v.renditionMu.Lock()
+	v.renditionStats.Active = name
+	v.renditionStats.Switches++
+	v.renditionMu.Unlock()
+	v.logger.Infof("Now watching rendition %s", name)
+
+	v.processFrame(keyframe)
+	if v.onRenditionChange != nil {
+		v.onRenditionChange(name)
+	}
+}
+
+func (v *Viewer) isFastStartPending() bool {
+	v.startMu.Lock()
+	defer v.startMu.Unlock()
+	return v.fastStartPending
+}
+
+// renditionName returns the name of the rendition at index, or "" without
+// simulcast.
+func (v *Viewer) renditionName(index int) string {
+	if len(v.renditions) == 0 {
+		return ""
+	}
+	return v.renditions[index]
+}
+
+func (v *Viewer) activeRendition() string {
+	return v.renditionName(int(v.rendition.Load()))
+}
+
+func (v *Viewer) setRenditionStats(stats RenditionStats) {
+	v.renditionMu.Lock()
+	defer v.renditionMu.Unlock()
+	v.renditionStats = stats
+}
+
+// GetActiveRendition returns the rendition being watched, or "" when the
+// broadcast has no simulcast renditions.
+func (v *Viewer) GetActiveRendition() string {
+	return v.activeRendition()
+}
+
+// GetRenditionStats returns the active rendition with the receive rate and
+// loss measured over the last window.
+func (v *Viewer) GetRenditionStats() RenditionStats {
+	v.renditionMu.Lock()
+	defer v.renditionMu.Unlock()
+	return v.renditionStats
+}
+
+// SetOnRenditionChange sets a callback for when the viewer starts watching
+// a rendition, both at start and after each automatic switch.
+func (v *Viewer) SetOnRenditionChange(callback func(rendition string)) {
+	v.onRenditionChange = callback
+}
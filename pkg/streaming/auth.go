@@ -0,0 +1,137 @@
+package streaming
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/meshlink/church-streaming/internal/media"
+)
+
+// Every pubsub message is signed with its author's peer key and checked on
+// receipt, so the author of a chunk cannot be forged. A stream topic only
+// accepts chunks authored by the stream's broadcaster, as named in its
+// signed announcement; a topic validator rejects the rest, so GossipSub
+// drops them without forwarding and penalizes the peer that sent them.
+// Viewers can also pin the broadcasters they trust by peer ID, in which
+// case streams announced by anyone else are not listed at all.
+//
+// Cached GOPs reach a joining viewer outside of pubsub, possibly from a
+// relay, so the broadcaster also signs every frame with its peer key. The
+// signature follows the wire frame, then its length as a uint16; relays
+// cache and pass on frames with it, and a viewer only plays a cached GOP
+// whose every frame verifies against the broadcaster's key.
+
+const (
+	// Prefixed to a frame before signing, so that the signature cannot be
+	// passed off as one over any other message
+	frameSignaturePrefix = "meshlink-frame:"
+)
+
+// ErrUnsignedFrame means a frame that must come from the broadcaster
+// carries no signature.
+var ErrUnsignedFrame = errors.New("frame is not signed")
+
+// ParseTrustedBroadcasters decodes the configured broadcaster peer IDs.
+func ParseTrustedBroadcasters(ids []string) ([]peer.ID, error) {
+	trusted := make([]peer.ID, 0, len(ids))
+	for _, s := range ids {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted broadcaster %q: %w", s, err)
+		}
+		trusted = append(trusted, id)
+	}
+	return trusted, nil
+}
+
+// authorValidator accepts only messages authored by one peer.
+func authorValidator(author peer.ID) pubsub.ValidatorEx {
+	return func(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		if msg.GetFrom() != author {
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationAccept
+	}
+}
+
+// registerAuthorValidator makes a topic accept only messages authored by
+// author.
+func registerAuthorValidator(ps *pubsub.PubSub, topic string, author peer.ID) error {
+	if err := ps.RegisterTopicValidator(topic, authorValidator(author)); err != nil {
+		return fmt.Errorf("failed to register validator for %s: %w", topic, err)
+	}
+	return nil
+}
+
+// announcementValidator accepts announcements that verify and, if any
+// broadcasters are pinned, come from one of them. The descriptor is passed
+// on as the message's ValidatorData. The announcing peer must also be the
+// message's author, so that announcements cannot be replayed by others.
+func announcementValidator(ns Namespace, trusted []peer.ID) pubsub.ValidatorEx {
+	pinned := make(map[peer.ID]bool, len(trusted))
+	for _, id := range trusted {
+		pinned[id] = true
+	}
+	return func(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		desc, err := verifyAnnouncement(msg.Data, ns)
+		if err != nil || desc.Broadcaster != msg.GetFrom() {
+			return pubsub.ValidationReject
+		}
+		if len(pinned) > 0 && !pinned[desc.Broadcaster] {
+			return pubsub.ValidationIgnore
+		}
+		msg.ValidatorData = desc
+		return pubsub.ValidationAccept
+	}
+}
+
+// signFrame returns a wire frame followed by its signature with key.
+func signFrame(frame []byte, key crypto.PrivKey) ([]byte, error) {
+	signature, err := key.Sign(append([]byte(frameSignaturePrefix), frame...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign frame: %w", err)
+	}
+	signed := make([]byte, 0, len(frame)+len(signature)+2)
+	signed = append(append(signed, frame...), signature...)
+	return binary.BigEndian.AppendUint16(signed, uint16(len(signature))), nil
+}
+
+// splitFrameSignature separates a wire frame from the signature following
+// it. The signature is nil if the frame is not signed.
+func splitFrameSignature(data []byte) (frame []byte, signature []byte, err error) {
+	header, err := media.PeekHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	end := uint64(media.FrameHeaderSize) + uint64(header.PayloadLength)
+	if uint64(len(data)) <= end {
+		return data, nil, nil
+	}
+	trailer := data[end:]
+	if len(trailer) < 2 || int(binary.BigEndian.Uint16(trailer[len(trailer)-2:])) != len(trailer)-2 {
+		return nil, nil, fmt.Errorf("malformed frame signature")
+	}
+	return data[:end:end], trailer[:len(trailer)-2], nil
+}
+
+// verifyFrame checks a signed wire frame against the broadcaster's key and
+// returns it without the signature.
+func verifyFrame(data []byte, key crypto.PubKey) ([]byte, error) {
+	frame, signature, err := splitFrameSignature(data)
+	if err != nil {
+		return nil, err
+	}
+	if signature == nil {
+		return nil, ErrUnsignedFrame
+	}
+	ok, err := key.Verify(append([]byte(frameSignaturePrefix), frame...), signature)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("bad frame signature")
+	}
+	return frame, nil
+}
@@ -0,0 +1,67 @@
+package streaming
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/meshlink/church-streaming/internal/media"
+)
+
+func TestFrameSignature(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := media.FrameHeader{StreamID: 1, FrameID: 9, Codec: media.CodecH264, Flags: media.FlagKeyframe}
+	frame := media.MarshalFrame(&header, testFrame(300))
+	signed, err := signFrame(frame, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := verifyFrame(signed, key.GetPublic()); err != nil || !bytes.Equal(got, frame) {
+		t.Fatalf("verifyFrame() = %v, want the frame without its signature", err)
+	}
+	if got, signature, err := splitFrameSignature(frame); err != nil || signature != nil || !bytes.Equal(got, frame) {
+		t.Errorf("splitFrameSignature(unsigned) = %v, %x, want the frame as is", err, signature)
+	}
+
+	tampered := append([]byte(nil), signed...)
+	tampered[media.FrameHeaderSize+5] ^= 1
+	truncated := append(append([]byte(nil), signed[:len(signed)-3]...), signed[len(signed)-2:]...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		key     crypto.PubKey
+		wantErr error
+	}{
+		{"unsigned", frame, key.GetPublic(), ErrUnsignedFrame},
+		{"other key", signed, other.GetPublic(), nil},
+		{"tampered payload", tampered, key.GetPublic(), nil},
+		{"truncated signature", truncated, key.GetPublic(), nil},
+		{"not a frame", []byte("not a frame at all, not even close to one"), key.GetPublic(), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifyFrame(tt.data, tt.key)
+			if err == nil {
+				t.Fatal("verifyFrame() accepted the frame")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("verifyFrame() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A GOP with a single bad frame is discarded whole
+	if _, err := verifyGOP([][]byte{signed, tampered}, key.GetPublic()); err == nil {
+		t.Error("verifyGOP() accepted a GOP with a tampered frame")
+	}
+}
@@ -2,39 +2,114 @@ package streaming
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
-	"github.com/sirupsen/logrus"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/meshlink/church-streaming/internal/config"
 	"github.com/meshlink/church-streaming/internal/media"
+	"github.com/sirupsen/logrus"
 )
 
-const StreamTopic = "meshlink/church/stream"
-
 type Broadcaster struct {
-	topic       *pubsub.Topic
-	logger      *logrus.Logger
-	ctx         context.Context
-	isStreaming bool
-	viewerCount int
-	bytesSent   uint64
-	frameCount  uint64
-	stopChan    chan struct{}
-	camera      *media.CameraCapture
-	encoder     *media.H264Encoder
-	quality     string
+	renditions   []*rendition // lowest first
+	simulcast    bool
+	namespace    Namespace
+	controlTopic *pubsub.Topic
+	controlSub   *pubsub.Subscription
+	ps           *pubsub.PubSub
+	logger       *logrus.Logger
+	ctx          context.Context
+	isStreaming  atomic.Bool // also read by stream handlers
+	startMu      sync.Mutex  // serializes StartStreaming and Stop
+	viewerCount  int
+	bytesSent    uint64
+	frameCount   uint64
+	audioCount   uint64
+	clock        *media.MediaClock
+	chunker      *Chunker
+	fec          *FECEncoder
+	sealer       *frameSealer // nil for a stream in the clear
+	direct       bool         // frames go to viewers over direct streams
+
+	// Keyframe requests from viewers, coalesced per rendition
+	keyframeMu       sync.Mutex
+	keyframeRequests uint64
+	keyframesForced  uint64
+	stopChan         chan struct{}
+	camera           media.VideoSource
+	microphone       media.AudioSource
+	audioEncoder     media.Encoder
+	audioOnly        bool
+	streamID         uint32
+	mediaConfig      *config.MediaConfig
+
+	// Announcements on the directory topic, sent while streaming once the
+	// identity is set
+	topicName      string
+	directoryTopic *pubsub.Topic
+	streamConfig   config.StreamConfig
+	signingKey     crypto.PrivKey
+	peerID         peer.ID
+	startedAt      time.Time
+
+	// Guards the renditions' encoders, the quality and the bitrate, which
+	// can change while streaming
+	videoMu      sync.Mutex
+	quality      string
+	bitrate      int    // kbps, zero for the quality's standard bitrate
+	publishLoops uint64 // publish loops started, which numbers them
 }
 
 func NewBroadcaster(ctx context.Context, ps *pubsub.PubSub) (*Broadcaster, error) {
 	return NewBroadcasterWithConfig(ctx, ps, nil)
 }
 
+// NewBroadcasterWithConfig creates a broadcaster without a host, which only
+// publishes over pubsub; the direct transport needs NewBroadcasterWithHost.
 func NewBroadcasterWithConfig(ctx context.Context, ps *pubsub.PubSub, cfg *config.Config) (*Broadcaster, error) {
-	topic, err := ps.Join(StreamTopic)
+	direct, err := isDirect(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to join topic: %w", err)
+		return nil, err
+	}
+	if direct {
+		return nil, errDirectNeedsHost
+	}
+	return newBroadcaster(ctx, ps, cfg)
+}
+
+// NewBroadcasterWithHost creates a broadcaster whose identity is the host's
+// peer key, and which serves the cached GOP and, with the direct transport,
+// the stream itself to viewers connecting to the host.
+func NewBroadcasterWithHost(ctx context.Context, h host.Host, ps *pubsub.PubSub, cfg *config.Config) (*Broadcaster, error) {
+	b, err := newBroadcaster(ctx, ps, cfg)
+	if err != nil {
+		return nil, err
+	}
+	b.EnableFastStart(h)
+	if err := b.SetIdentity(h); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newBroadcaster(ctx context.Context, ps *pubsub.PubSub, cfg *config.Config) (*Broadcaster, error) {
+	namespace := namespaceOf(cfg)
+	controlTopic, err := ps.Join(namespace.ControlTopic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to join control topic: %w", err)
+	}
+	directoryTopic, err := ps.Join(namespace.DirectoryTopic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to join directory topic: %w", err)
 	}
 
 	// Use config or defaults
@@ -50,19 +125,230 @@ func NewBroadcasterWithConfig(ctx context.Context, ps *pubsub.PubSub, cfg *confi
 		}
 	}
 
+	streamID, err := newStreamID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate stream ID: %w", err)
+	}
+	direct, err := isDirect(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize media components with config
-	camera := media.NewCameraCapture()
-	encoder := media.NewH264Encoder(quality)
+	mediaConfig := &config.DefaultConfig().Media
+	streamConfig := config.DefaultConfig().Stream
+	securityConfig := &config.DefaultConfig().Security
+	chunkSize := DefaultChunkSize
+	if cfg != nil {
+		mediaConfig = &cfg.Media
+		streamConfig = cfg.Stream
+		securityConfig = &cfg.Security
+		chunkSize = cfg.Network.ChunkSize
+	}
+
+	// A configured key makes the stream private
+	var sealer *frameSealer
+	key, err := LoadStreamKey(securityConfig, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		rotation := time.Duration(securityConfig.KeyRotation) * time.Second
+		if sealer, err = newFrameSealer(key, streamID, rotation); err != nil {
+			return nil, err
+		}
+	}
+
+	fec := NewFECEncoder(mediaConfig.FECRatio)
+	chunker := NewChunker(chunkSize)
+	if fec != nil {
+		chunker = fec.DataChunker(chunkSize)
+	}
+
+	b := &Broadcaster{
+		namespace:      namespace,
+		controlTopic:   controlTopic,
+		ps:             ps,
+		directoryTopic: directoryTopic,
+		logger:         logrus.New(),
+		ctx:            ctx,
+		stopChan:       make(chan struct{}),
+		quality:        quality,
+		streamID:       streamID,
+		topicName:      namespace.StreamTopic(streamID),
+		mediaConfig:    mediaConfig,
+		streamConfig:   streamConfig,
+		audioOnly:      mediaConfig.AudioOnly,
+		bitrate:        mediaConfig.Bitrate,
+		chunker:        chunker,
+		fec:            fec,
+		sealer:         sealer,
+		direct:         direct,
+	}
+
+	// Each simulcast rendition gets its own topic; otherwise the one
+	// quality goes out on the stream's topic
+	if names := sortRenditions(mediaConfig.Renditions); len(names) > 0 {
+		b.simulcast = true
+		for _, name := range names {
+			topic, err := ps.Join(RenditionTopic(b.topicName, name))
+			if err != nil {
+				return nil, fmt.Errorf("failed to join %s topic: %w", name, err)
+			}
+			b.renditions = append(b.renditions, newRendition(name, topic))
+		}
+	} else {
+		topic, err := ps.Join(b.topicName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to join topic: %w", err)
+		}
+		b.renditions = []*rendition{newRendition(quality, topic)}
+	}
+
+	// Audio is optional; older configs have no audio source
+	audioSource := mediaConfig.AudioSource
+	if b.audioOnly && audioSource == "" {
+		audioSource = "microphone"
+	}
+	if audioSource != "" && audioSource != "none" {
+		if err := b.setupAudio(audioSource); err != nil {
+			return nil, err
+		}
+	}
+
+	// In audio-only mode the camera is never opened, so a device without
+	// one can still broadcast
+	if b.audioOnly {
+		if b.microphone == nil {
+			return nil, fmt.Errorf("audio-only mode requires an audio source")
+		}
+	} else if err := b.setupVideo(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
 
-	return &Broadcaster{
-		topic:    topic,
-		logger:   logrus.New(),
-		ctx:      ctx,
-		stopChan: make(chan struct{}),
-		camera:   camera,
-		encoder:  encoder,
-		quality:  quality,
-	}, nil
+func (b *Broadcaster) setupVideo() error {
+	camera, err := media.NewVideoSource(orDefault(b.mediaConfig.VideoSource, "camera"), b.mediaConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create video source: %w", err)
+	}
+	b.camera = camera
+
+	if err := b.setupEncoders(b.quality); err != nil {
+		b.camera = nil
+		return fmt.Errorf("failed to create video encoder: %w", err)
+	}
+	return nil
+}
+
+// setupEncoders creates the video encoders for quality before streaming.
+func (b *Broadcaster) setupEncoders(quality string) error {
+	encoders := make([]media.Encoder, len(b.renditions))
+	for i, encoded := range b.encodedRenditions(quality) {
+		if !encoded {
+			continue
+		}
+		name := b.renditions[i].name
+		if !b.simulcast {
+			name = quality
+		}
+		encoder, err := b.newVideoEncoder(name)
+		if err != nil {
+			return err
+		}
+		encoders[i] = encoder
+	}
+
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+	for i, r := range b.renditions {
+		r.encoder = encoders[i]
+	}
+	if !b.simulcast {
+		b.renditions[0].name = quality
+	}
+	b.quality = quality
+	return nil
+}
+
+// encodedRenditions reports which renditions are encoded at quality. With
+// simulcast these are the renditions up to quality that the source can
+// fill; the lowest is always encoded, however small the source.
+func (b *Broadcaster) encodedRenditions(quality string) []bool {
+	encoded := make([]bool, len(b.renditions))
+	encoded[0] = true
+	if b.simulcast {
+		_, sourceHeight := b.camera.GetResolution()
+		limit := min(sourceHeight, renditionHeight(quality))
+		for i, r := range b.renditions {
+			encoded[i] = i == 0 || renditionHeight(r.name) <= limit
+		}
+	}
+	return encoded
+}
+
+func (b *Broadcaster) setupAudio(source string) error {
+	microphone, err := media.NewAudioSource(source, b.mediaConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create audio source: %w", err)
+	}
+
+	encoder, err := media.NewEncoder(orDefault(b.mediaConfig.AudioCodec, "aac"), media.EncoderConfig{
+		StreamID:   b.streamID,
+		Media:      b.mediaConfig,
+		SampleRate: microphone.GetSampleRate(),
+		Channels:   microphone.GetChannels(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audio encoder: %w", err)
+	}
+
+	b.microphone = microphone
+	b.audioEncoder = encoder
+	return nil
+}
+
+// newVideoEncoder creates an encoder for the configured video codec that
+// accepts frames from the broadcaster's video source.
+func (b *Broadcaster) newVideoEncoder(quality string) (media.Encoder, error) {
+	// Simulcast renditions each keep their quality's standard bitrate
+	encoderConfig := *b.mediaConfig
+	encoderConfig.Bitrate = b.bitrate
+	if b.simulcast {
+		encoderConfig.Bitrate = 0
+	}
+
+	width, height := b.camera.GetResolution()
+	return media.NewEncoder(orDefault(b.mediaConfig.VideoCodec, "h264"), media.EncoderConfig{
+		Quality:   quality,
+		StreamID:  b.streamID,
+		Media:     &encoderConfig,
+		Width:     width,
+		Height:    height,
+		FrameRate: b.camera.GetFrameRate(),
+	})
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// newStreamID returns a random non-zero ID that tags every frame of this broadcast.
+func newStreamID() (uint32, error) {
+	var buf [4]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		if id := binary.BigEndian.Uint32(buf[:]); id != 0 {
+			return id, nil
+		}
+	}
 }
 
 type StreamFrame struct {
@@ -75,146 +361,924 @@ type StreamFrame struct {
 }
 
 func (b *Broadcaster) StartStreaming() error {
-	if b.isStreaming {
+	b.startMu.Lock()
+	defer b.startMu.Unlock()
+	if !b.isStreaming.CompareAndSwap(false, true) {
 		return fmt.Errorf("already streaming")
 	}
-	
-	b.logger.Info("Starting broadcast stream...")
-	
+	if err := b.startStreaming(); err != nil {
+		b.isStreaming.Store(false)
+		return err
+	}
+	return nil
+}
+
+// startStreaming starts capture and the streaming loops, with isStreaming
+// already set.
+func (b *Broadcaster) startStreaming() error {
+	if b.audioOnly {
+		b.logger.Info("Starting audio-only broadcast stream...")
+	} else {
+		b.logger.Info("Starting broadcast stream...")
+	}
+
+	// Audio and video are both stamped from this clock at capture, which
+	// starts with the sources
+	b.clock = media.NewMediaClock()
+	if err := b.startVideo(); err != nil {
+		return err
+	}
+
+	if err := b.startAudio(); err != nil {
+		b.stopVideo()
+		return err
+	}
+
+	controlSub, err := b.controlTopic.Subscribe()
+	if err != nil {
+		b.stopAudio()
+		b.stopVideo()
+		return fmt.Errorf("failed to subscribe to control topic: %w", err)
+	}
+	b.controlSub = controlSub
+	for _, r := range b.renditions {
+		r.gopCache.Reset()
+		r.sequence = 0
+		r.fanout.reopen()
+	}
+
+	atomic.StoreUint64(&b.frameCount, 0)
+	atomic.StoreUint64(&b.audioCount, 0)
+	atomic.StoreUint64(&b.bytesSent, 0)
+	b.stopChan = make(chan struct{})
+	b.startedAt = time.Now()
+
+	// Start viewer count monitoring
+	b.UpdateViewerCount()
+
+	// Start streaming loops. Every rendition encodes the same captured
+	// frames, so their timestamps line up for viewers switching between them.
+	if !b.audioOnly {
+		for _, r := range b.videoRenditions() {
+			// A loop left from before Stop is on its way out and no
+			// longer counts
+			b.videoMu.Lock()
+			b.startPublishLoop(r)
+			b.videoMu.Unlock()
+		}
+		go b.captureLoop(b.camera.Frames(), b.videoEncoders, b.clock, b.stopChan)
+	}
+	if b.microphone != nil {
+		audioEncoders := func() []media.Encoder { return []media.Encoder{b.audioEncoder} }
+		go b.captureLoop(b.microphone.Frames(), audioEncoders, b.clock, b.stopChan)
+		go b.publishAudioLoop(b.stopChan)
+	}
+	go b.controlLoop(controlSub)
+	if b.signingKey != nil {
+		go b.announceLoop(b.stopChan)
+	}
+
+	return nil
+}
+
+func (b *Broadcaster) startVideo() error {
+	if b.audioOnly {
+		return nil
+	}
+
 	// Start camera capture
 	if err := b.camera.Start(); err != nil {
 		return fmt.Errorf("failed to start camera: %w", err)
 	}
-	
-	// Start encoder
-	if err := b.encoder.Start(); err != nil {
-		b.camera.Stop()
-		return fmt.Errorf("failed to start encoder: %w", err)
-	}
-	
-	b.isStreaming = true
-	b.frameCount = 0
-	b.bytesSent = 0
-	
-	// Start viewer count monitoring
-	b.UpdateViewerCount()
-	
-	// Start streaming loop
-	go b.streamLoop()
-	
+
+	// Start encoders
+	video := b.videoRenditions()
+	for i, r := range video {
+		if err := r.encoder.Start(); err != nil {
+			for _, started := range video[:i] {
+				started.encoder.Stop()
+			}
+			b.camera.Stop()
+			return fmt.Errorf("failed to start %s encoder: %w", r.name, err)
+		}
+	}
 	return nil
 }
 
-func (b *Broadcaster) streamLoop() {
-	// Production 30 FPS video streaming
-	ticker := time.NewTicker(33 * time.Millisecond) // 30 FPS timing
-	defer ticker.Stop()
+func (b *Broadcaster) stopVideo() {
+	if b.audioOnly {
+		return
+	}
+
+	b.videoMu.Lock()
+	for _, r := range b.renditions {
+		if r.encoder != nil {
+			r.encoder.Stop()
+		}
+		if r.next != nil {
+			r.next.Stop()
+			r.next = nil
+		}
+	}
+	b.videoMu.Unlock()
+	b.camera.Stop()
+}
+
+// videoRenditions returns the renditions being encoded, lowest first.
+func (b *Broadcaster) videoRenditions() []*rendition {
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+
+	var video []*rendition
+	for _, r := range b.renditions {
+		if r.encoder != nil {
+			video = append(video, r)
+		}
+	}
+	return video
+}
+
+// videoEncoders returns the encoders that captured frames go to, including
+// any that are about to replace another.
+func (b *Broadcaster) videoEncoders() []media.Encoder {
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+
+	var encoders []media.Encoder
+	for _, r := range b.renditions {
+		if r.encoder != nil {
+			encoders = append(encoders, r.encoder)
+		}
+		if r.next != nil {
+			encoders = append(encoders, r.next)
+		}
+	}
+	return encoders
+}
+
+func (b *Broadcaster) startAudio() error {
+	if b.microphone == nil {
+		return nil
+	}
+
+	if err := b.microphone.Start(); err != nil {
+		return fmt.Errorf("failed to start audio capture: %w", err)
+	}
+	if err := b.audioEncoder.Start(); err != nil {
+		b.microphone.Stop()
+		return fmt.Errorf("failed to start audio encoder: %w", err)
+	}
+	return nil
+}
+
+func (b *Broadcaster) stopAudio() {
+	if b.microphone == nil {
+		return
+	}
+
+	b.audioEncoder.Stop()
+	b.microphone.Stop()
+}
+
+// captureLoop feeds frames from a source into its encoders, stamping each
+// with the media clock at the time the source captured it, however long it
+// was queued.
+func (b *Broadcaster) captureLoop(frames <-chan media.RawFrame, encoders func() []media.Encoder, clock *media.MediaClock, stopChan chan struct{}) {
+	var frameID uint64
 
 	for {
 		select {
 		case <-b.ctx.Done():
-			b.logger.Info("Stream stopped - context cancelled")
 			return
-		case <-b.stopChan:
-			b.logger.Info("Stream stopped - stop signal received")
+		case <-stopChan:
 			return
-		case <-ticker.C:
-			if !b.isStreaming {
+		case rawFrame, ok := <-frames:
+			if !ok {
+				b.logger.Info("Capture source ended")
 				return
 			}
-			
-			// Capture frame from camera
-			rawFrame, err := b.camera.CaptureFrame()
-			if err != nil {
-				b.logger.Errorf("Failed to capture frame: %v", err)
+
+			frameID++
+			pts := clock.At(rawFrame.Captured)
+			for _, encoder := range encoders() {
+				if err := encoder.EncodeFrame(rawFrame.Data, frameID, pts); err != nil {
+					b.logger.Errorf("Failed to encode frame %d: %v", frameID, err)
+				}
+			}
+		}
+	}
+}
+
+// startPublishLoop starts publishing a rendition's video until streaming
+// stops. Called with videoMu held.
+func (b *Broadcaster) startPublishLoop(r *rendition) {
+	b.publishLoops++
+	r.publishing = b.publishLoops
+	go b.publishLoop(r, r.publishing, b.stopChan)
+}
+
+// publishLoop sends a rendition's encoded video to the P2P network in the
+// order the encoder produces it. While the encoder is being replaced, the
+// old one keeps publishing until the new one's first keyframe. The loop
+// ends once the rendition is no longer encoded, or streaming stops, and
+// however it ends a rendition encoded again gets a new loop.
+func (b *Broadcaster) publishLoop(r *rendition, id uint64, stopChan chan struct{}) {
+	defer func() {
+		b.videoMu.Lock()
+		if r.publishing == id {
+			r.publishing = 0
+		}
+		b.videoMu.Unlock()
+	}()
+
+	for {
+		// Frames of the next session are left to its own loop
+		select {
+		case <-stopChan:
+			b.logger.Info("Stream stopped - stop signal received")
+			return
+		default:
+		}
+
+		b.videoMu.Lock()
+		current, next, name := r.encoder, r.next, r.name
+		if current == nil && next == nil {
+			r.publishing = 0
+			b.videoMu.Unlock()
+			b.logger.Infof("Stopped publishing rendition %s", name)
+			return
+		}
+		b.videoMu.Unlock()
+
+		var frames, nextFrames <-chan *media.EncodedFrame
+		if current != nil {
+			frames = current.Frames()
+		}
+		if next != nil {
+			nextFrames = next.Frames()
+		}
+
+		select {
+		case <-b.ctx.Done():
+			b.logger.Info("Stream stopped - context cancelled")
+			return
+		case <-stopChan:
+			b.logger.Info("Stream stopped - stop signal received")
+			return
+		case <-r.changed:
+		case frame, ok := <-frames:
+			if !ok {
+				if b.isCurrentEncoder(r, current) {
+					b.logger.Infof("Stream stopped - %s encoder closed", name)
+					return
+				}
 				continue
 			}
-			
-			// Encode frame with H.264
-			frameData, err := b.encoder.EncodeFrame(rawFrame, b.frameCount+1)
-			if err != nil {
-				b.logger.Errorf("Failed to encode frame: %v", err)
+			b.publishVideo(r, frame)
+		case frame, ok := <-nextFrames:
+			if !ok {
+				b.dropNextEncoder(r, next)
 				continue
 			}
-			
-			// Publish frame to P2P network
-			if err := b.topic.Publish(b.ctx, frameData); err != nil {
-				b.logger.Errorf("Failed to publish frame %d: %v", b.frameCount+1, err)
+			if !frame.IsKeyframe() {
 				continue
 			}
-			
-			// Update statistics
-			b.frameCount++
-			b.bytesSent += uint64(len(frameData))
-			
-			if b.frameCount%30 == 0 { // Log every second
-				b.logger.Infof("Streamed %d frames, %d bytes total", b.frameCount, b.bytesSent)
+
+			// Viewers learn of the new parameters from the frame itself
+			b.promoteEncoder(r, next)
+			frame.Header.Flags |= media.FlagParamChange
+			b.publishVideo(r, frame)
+		}
+	}
+}
+
+func (b *Broadcaster) publishVideo(r *rendition, frame *media.EncodedFrame) {
+	if !b.publishFrame(r, frame) || r != b.renditions[0] {
+		return
+	}
+	frameCount := atomic.AddUint64(&b.frameCount, 1)
+	if frameCount%30 == 0 { // Log every second
+		b.logger.Infof("Streamed %d frames, %d audio frames, %d bytes total",
+			frameCount, atomic.LoadUint64(&b.audioCount), atomic.LoadUint64(&b.bytesSent))
+	}
+}
+
+func (b *Broadcaster) isCurrentEncoder(r *rendition, encoder media.Encoder) bool {
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+	return r.encoder == encoder
+}
+
+// promoteEncoder makes next the rendition's encoder and retires the old one.
+func (b *Broadcaster) promoteEncoder(r *rendition, next media.Encoder) {
+	b.videoMu.Lock()
+	old := r.encoder
+	r.encoder, r.next = next, nil
+	name := r.name
+	b.videoMu.Unlock()
+
+	if old != nil {
+		go old.Stop()
+	}
+	b.logger.Infof("Switched %s encoder at keyframe", name)
+}
+
+// dropNextEncoder gives up on a replacement encoder that closed before
+// producing a keyframe.
+func (b *Broadcaster) dropNextEncoder(r *rendition, next media.Encoder) {
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+	if r.next == next {
+		r.next = nil
+		b.logger.Warnf("Replacement %s encoder closed before its first keyframe", r.name)
+	}
+}
+
+// publishAudioLoop sends encoded audio to every rendition, so that a viewer
+// hears it whichever rendition it watches, including one that has just
+// stopped carrying video.
+func (b *Broadcaster) publishAudioLoop(stopChan chan struct{}) {
+	frames := b.audioEncoder.Frames()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-stopChan:
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+
+			var published bool
+			for _, r := range b.renditions {
+				if b.publishFrame(r, frame) {
+					published = true
+				}
+			}
+			if published {
+				atomic.AddUint64(&b.audioCount, 1)
 			}
 		}
 	}
 }
 
+// publishFrame stamps the frame with the rendition's next sequence number
+// and publishes it as one or more chunks, followed by FEC parity if enabled,
+// or with the direct transport sends it whole to the rendition's viewers.
+// Audio and video share one sequence per rendition so that receivers can
+// detect loss across both.
+func (b *Broadcaster) publishFrame(r *rendition, frame *media.EncodedFrame) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Audio frames go out on every rendition, each with its own sequence,
+	// so the header is stamped on a copy
+	stamped := *frame
+	frame = &stamped
+	r.sequence++
+	frame.Header.FrameID = r.sequence
+
+	// The header stays readable for the GOP cache; only the payload is sealed
+	frameData, err := b.frameData(frame)
+	if err != nil {
+		b.logger.Errorf("Failed to seal %s frame %d: %v", frame.Header.Codec, frame.Header.FrameID, err)
+		return false
+	}
+
+	if b.direct {
+		atomic.AddUint64(&b.bytesSent, uint64(r.fanout.send(&frame.Header, frameData)))
+	} else if !b.publishChunks(r, frame, frameData) {
+		return false
+	}
+
+	r.gopCache.Add(&frame.Header, frameData)
+	if frame.IsKeyframe() && !frame.Header.Codec.IsAudio() {
+		b.keyframeMu.Lock()
+		r.lastKeyframe = time.Now()
+		b.keyframeMu.Unlock()
+	}
+	return true
+}
+
+// publishChunks publishes a wire frame on the rendition's topic.
+func (b *Broadcaster) publishChunks(r *rendition, frame *media.EncodedFrame, frameData []byte) bool {
+	chunks, err := b.chunker.Split(b.streamID, frame.Header.FrameID, frameData)
+	if err != nil {
+		b.logger.Errorf("Failed to chunk %s frame %d: %v", frame.Header.Codec, frame.Header.FrameID, err)
+		return false
+	}
+	if b.fec != nil {
+		if chunks, err = b.fec.Protect(chunks); err != nil {
+			b.logger.Errorf("Failed to add FEC to %s frame %d: %v", frame.Header.Codec, frame.Header.FrameID, err)
+			return false
+		}
+	}
+
+	// The rest of a frame is useless once a chunk fails, so stop there
+	for _, chunk := range chunks {
+		if err := r.topic.Publish(b.ctx, chunk); err != nil {
+			b.logger.Errorf("Failed to publish %s frame %d on %s: %v", frame.Header.Codec, frame.Header.FrameID, r.topic, err)
+			return false
+		}
+		atomic.AddUint64(&b.bytesSent, uint64(len(chunk)))
+	}
+	return true
+}
+
+// frameData returns a frame in wire format, encrypted if the stream is
+// private, and signed once the broadcaster has an identity.
+func (b *Broadcaster) frameData(frame *media.EncodedFrame) ([]byte, error) {
+	var data []byte
+	if b.sealer == nil {
+		data = frame.Marshal()
+	} else {
+		var err error
+		if data, err = b.sealer.Seal(&frame.Header, frame.Data); err != nil {
+			return nil, err
+		}
+	}
+	if b.signingKey == nil {
+		return data, nil
+	}
+	return signFrame(data, b.signingKey)
+}
+
+// controlLoop handles requests from viewers until the subscription is
+// cancelled.
+func (b *Broadcaster) controlLoop(sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(b.ctx)
+		if err != nil {
+			return
+		}
+
+		control, err := UnmarshalControlMessage(msg.Data)
+		if err != nil {
+			b.logger.Debugf("Ignoring control message from %s: %v", msg.GetFrom(), err)
+			continue
+		}
+		if control.StreamID != 0 && control.StreamID != b.streamID {
+			continue
+		}
+
+		switch control.Type {
+		case ControlKeyframeRequest:
+			b.handleKeyframeRequest(control.Rendition, control.Reason)
+		default:
+			b.logger.Debugf("Ignoring unknown control message %q", control.Type)
+		}
+	}
+}
+
+// handleKeyframeRequest forces a keyframe on the named rendition, or on all
+// of them if none is named, unless one went out, or was already requested,
+// within the coalescing window. Viewers joining together then share one
+// keyframe rather than each restarting the encoder, and viewers probing a
+// rendition, or recovering from loss, force one no more often than
+// forcedKeyframeInterval; the others wait for the regular GOP.
+func (b *Broadcaster) handleKeyframeRequest(name string, reason string) {
+	b.keyframeMu.Lock()
+	defer b.keyframeMu.Unlock()
+
+	b.keyframeRequests++
+	if b.audioOnly {
+		return
+	}
+
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+	for _, r := range b.renditions {
+		// A replacement encoder starts with a keyframe anyway
+		if r.encoder == nil || r.next != nil || (name != "" && name != r.name) || time.Since(r.lastKeyframe) < keyframeCoalesceWindow {
+			continue
+		}
+		if time.Since(r.lastForced) < forcedKeyframeInterval {
+			b.logger.Debugf("Not forcing another %s keyframe so soon (%s)", r.name, reason)
+			continue
+		}
+		r.lastKeyframe = time.Now()
+		r.lastForced = r.lastKeyframe
+		b.keyframesForced++
+		r.encoder.RequestKeyframe()
+		b.logger.Debugf("Forcing %s keyframe for viewer (%s)", r.name, reason)
+	}
+}
+
+// EnableFastStart serves the cached GOP to viewers that join mid-stream, so
+// that they can start decoding at once instead of waiting for the next
+// keyframe.
+func (b *Broadcaster) EnableFastStart(h host.Host) {
+	h.SetStreamHandler(b.namespace.FastStartProtocol(), func(s network.Stream) {
+		streamID, name, err := readRenditionRequest(s)
+		if err != nil {
+			b.logger.Debugf("Bad GOP request from %s: %v", s.Conn().RemotePeer(), err)
+			s.Reset()
+			return
+		}
+
+		// Another stream, or a rendition that is not being published, has
+		// nothing to send
+		var frames [][]byte
+		if r := b.findRendition(name); r != nil && streamID == b.streamID {
+			frames = r.gopCache.Snapshot()
+		}
+		if err := serveGOP(s, frames); err != nil {
+			b.logger.Debugf("Failed to send GOP to %s: %v", s.Conn().RemotePeer(), err)
+		}
+	})
+}
+
+// SetIdentity makes the host's peer key the broadcaster's identity. The
+// stream is announced on the directory topic while streaming, signed with
+// it, so that viewers can find it; and the stream's topics only accept
+// chunks signed with it, so that this node never forwards forged frames.
+// With the direct transport, viewers open their streams to the host.
+func (b *Broadcaster) SetIdentity(h host.Host) error {
+	key := h.Peerstore().PrivKey(h.ID())
+	if key == nil {
+		return fmt.Errorf("no private key for host %s", h.ID())
+	}
+	if b.peerID != "" {
+		return fmt.Errorf("identity already set")
+	}
+	for _, r := range b.renditions {
+		if err := registerAuthorValidator(b.ps, r.topic.String(), h.ID()); err != nil {
+			return err
+		}
+	}
+	b.signingKey = key
+	b.peerID = h.ID()
+	if b.direct {
+		h.SetStreamHandler(b.namespace.DirectProtocol(), b.serveDirect)
+	}
+	return nil
+}
+
+// serveDirect sends a rendition to a viewer over the direct transport
+// while streaming.
+func (b *Broadcaster) serveDirect(s network.Stream) {
+	streamID, name, err := readRenditionRequest(s)
+	if err != nil {
+		b.logger.Debugf("Bad stream request from %s: %v", s.Conn().RemotePeer(), err)
+		s.Reset()
+		return
+	}
+
+	r := b.findRendition(name)
+	if r == nil || streamID != b.streamID || !b.isStreaming.Load() {
+		s.Reset()
+		return
+	}
+	b.logger.Debugf("Sending %s directly to %s", renditionLabel(name), s.Conn().RemotePeer())
+	r.fanout.serve(s)
+}
+
+// announceLoop announces the stream at once and then every
+// announceInterval, and announces its end when streaming stops.
+func (b *Broadcaster) announceLoop(stopChan chan struct{}) {
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+
+	b.announce(false)
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-stopChan:
+			b.announce(true)
+			return
+		case <-ticker.C:
+			b.announce(false)
+		}
+	}
+}
+
+func (b *Broadcaster) announce(ended bool) {
+	desc := b.Descriptor()
+	desc.Ended = ended
+	data, err := signDescriptor(&desc, b.signingKey)
+	if err != nil {
+		b.logger.Errorf("Failed to sign stream announcement: %v", err)
+		return
+	}
+	if err := b.directoryTopic.Publish(b.ctx, data); err != nil {
+		b.logger.Errorf("Failed to announce stream: %v", err)
+	}
+}
+
+// Descriptor returns the stream's current description as announced to
+// viewers.
+func (b *Broadcaster) Descriptor() StreamDescriptor {
+	desc := StreamDescriptor{
+		StreamID:    b.streamID,
+		Title:       b.streamConfig.Title,
+		ChurchName:  b.streamConfig.ChurchName,
+		Topic:       b.topicName,
+		StartedAt:   b.startedAt,
+		Broadcaster: b.peerID,
+		IssuedAt:    time.Now(),
+		Encrypted:   b.sealer != nil,
+	}
+	if !b.audioOnly {
+		desc.VideoCodec = orDefault(b.mediaConfig.VideoCodec, "h264")
+	}
+	if b.microphone != nil {
+		desc.AudioCodec = orDefault(b.mediaConfig.AudioCodec, "aac")
+	}
+	if b.simulcast {
+		desc.Renditions = b.GetRenditions()
+		if len(desc.Renditions) == 0 {
+			// Audio-only: every rendition topic carries the audio
+			desc.Renditions = []string{b.renditions[0].name}
+		}
+	}
+	return desc
+}
+
+// findRendition returns the named rendition, or the lowest one for an empty
+// name.
+func (b *Broadcaster) findRendition(name string) *rendition {
+	if name == "" {
+		return b.renditions[0]
+	}
+
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+	for _, r := range b.renditions {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// GetKeyframeStats returns the keyframe requests received from viewers and
+// how many keyframes were forced to serve them.
+func (b *Broadcaster) GetKeyframeStats() (requests uint64, forced uint64) {
+	b.keyframeMu.Lock()
+	defer b.keyframeMu.Unlock()
+	return b.keyframeRequests, b.keyframesForced
+}
+
+// SetQuality changes the broadcast quality, switching to its standard
+// bitrate. With simulcast the quality is the highest rendition published.
+// While streaming the change takes effect at the next keyframe.
 func (b *Broadcaster) SetQuality(quality string) error {
-	if b.isStreaming {
-		return fmt.Errorf("cannot change quality while streaming")
+	return b.reconfigure(quality, 0)
+}
+
+// SetBitrate changes the video bitrate in kbps, zero meaning the quality's
+// standard bitrate. Simulcast renditions always use their standard bitrate.
+func (b *Broadcaster) SetBitrate(kbps int) error {
+	if b.simulcast {
+		return fmt.Errorf("bitrate is fixed per rendition with simulcast")
+	}
+	return b.reconfigure(b.GetQuality(), kbps)
+}
+
+func (b *Broadcaster) reconfigure(quality string, bitrate int) error {
+	if renditionHeight(quality) == 0 {
+		return fmt.Errorf("invalid quality %q", quality)
+	}
+
+	// Without video yet, the quality is applied once video is set up
+	if b.camera == nil {
+		b.videoMu.Lock()
+		b.quality, b.bitrate = quality, bitrate
+		b.videoMu.Unlock()
+		return nil
+	}
+	if !b.isStreaming.Load() || b.audioOnly {
+		b.bitrate = bitrate
+		return b.setupEncoders(quality)
+	}
+	return b.reconfigureLive(quality, bitrate)
+}
+
+// reconfigureLive changes quality and bitrate mid-stream on the same
+// topics. A replaced encoder keeps publishing until its successor's first
+// keyframe, which goes out flagged as a parameter change, so the cut falls
+// on a GOP boundary. With simulcast, renditions the new quality adds start
+// publishing with a keyframe and those it drops stop. Either every change
+// is made or, if an encoder fails to start, none is.
+func (b *Broadcaster) reconfigureLive(quality string, bitrate int) error {
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
+
+	if !b.simulcast {
+		previous := b.bitrate
+		b.bitrate = bitrate
+		encoder, err := b.startVideoEncoder(quality)
+		if err != nil {
+			b.bitrate = previous
+			return err
+		}
+
+		r := b.renditions[0]
+		if r.next != nil {
+			go r.next.Stop() // superseded before its first keyframe
+		}
+		r.next = encoder
+		r.name = quality
+		r.notify()
+		b.quality = quality
+		b.logger.Infof("Switching to %s at the next keyframe", quality)
+		return nil
+	}
+
+	// Start the encoders of the renditions the quality adds before touching
+	// any rendition
+	encodedRenditions := b.encodedRenditions(quality)
+	added := make([]media.Encoder, len(b.renditions))
+	for i, encoded := range encodedRenditions {
+		r := b.renditions[i]
+		if !encoded || r.encoder != nil {
+			continue
+		}
+		encoder, err := b.startVideoEncoder(r.name)
+		if err != nil {
+			for _, started := range added {
+				if started != nil {
+					go started.Stop()
+				}
+			}
+			return err
+		}
+		added[i] = encoder
+	}
+
+	for i, encoded := range encodedRenditions {
+		r := b.renditions[i]
+		switch {
+		case added[i] != nil:
+			r.encoder = added[i]
+			if r.publishing == 0 {
+				b.startPublishLoop(r)
+			}
+			r.notify()
+		case !encoded && r.encoder != nil:
+			go r.encoder.Stop()
+			r.encoder = nil
+			r.notify()
+		}
 	}
-	
 	b.quality = quality
-	b.encoder = media.NewH264Encoder(quality)
+	b.logger.Infof("Broadcast quality is now %s", quality)
+	return nil
+}
+
+func (b *Broadcaster) startVideoEncoder(quality string) (media.Encoder, error) {
+	encoder, err := b.newVideoEncoder(quality)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s encoder: %w", quality, err)
+	}
+	if err := encoder.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s encoder: %w", quality, err)
+	}
+	return encoder, nil
+}
+
+// SetAudioOnly switches between audio-only and audio/video broadcasting.
+// The camera is only opened once video is enabled.
+func (b *Broadcaster) SetAudioOnly(audioOnly bool) error {
+	if b.isStreaming.Load() {
+		return fmt.Errorf("cannot change audio-only mode while streaming")
+	}
+	if audioOnly == b.audioOnly {
+		return nil
+	}
+
+	if audioOnly {
+		if b.microphone == nil {
+			if err := b.setupAudio(orDefault(b.mediaConfig.AudioSource, "microphone")); err != nil {
+				return err
+			}
+		}
+	} else if b.camera == nil {
+		if err := b.setupVideo(); err != nil {
+			return err
+		}
+	}
+
+	b.audioOnly = audioOnly
+	return nil
+}
+
+func (b *Broadcaster) IsAudioOnly() bool {
+	return b.audioOnly
+}
+
+// IsEncrypted reports whether the stream's payloads are encrypted with the
+// congregation's key.
+func (b *Broadcaster) IsEncrypted() bool {
+	return b.sealer != nil
+}
+
+// RotateKey moves the stream to a new key at once, ahead of the configured
+// rotation interval. Viewers holding the congregation's key follow without
+// any exchange; by the same token, it does not revoke anyone's access,
+// which takes a new shared secret and a restart.
+func (b *Broadcaster) RotateKey() error {
+	if b.sealer == nil {
+		return fmt.Errorf("stream is not encrypted")
+	}
+	if err := b.sealer.Rotate(); err != nil {
+		return err
+	}
+	b.logger.Info("Rotated stream key")
 	return nil
 }
 
 func (b *Broadcaster) GetQuality() string {
+	b.videoMu.Lock()
+	defer b.videoMu.Unlock()
 	return b.quality
 }
 
+func (b *Broadcaster) GetStreamID() uint32 {
+	return b.streamID
+}
+
+// GetRenditions returns the renditions being published, lowest first.
+func (b *Broadcaster) GetRenditions() []string {
+	var names []string
+	for _, r := range b.videoRenditions() {
+		names = append(names, r.name)
+	}
+	return names
+}
+
 func (b *Broadcaster) Stop() {
-	if !b.isStreaming {
+	b.startMu.Lock()
+	defer b.startMu.Unlock()
+	if !b.isStreaming.CompareAndSwap(true, false) {
 		return
 	}
-	
+
 	b.logger.Info("Stopping broadcast stream...")
-	b.isStreaming = false
-	
+
 	// Stop media components
-	b.encoder.Stop()
-	b.camera.Stop()
-	
-	// Signal stop to streaming loop
-	select {
-	case b.stopChan <- struct{}{}:
-	default:
+	b.stopVideo()
+	b.stopAudio()
+
+	// Signal stop to streaming loops
+	close(b.stopChan)
+	b.controlSub.Cancel()
+
+	// The topics stay joined: the stream keeps its ID, and so its topics,
+	// when it starts again
+	for _, r := range b.renditions {
+		r.fanout.closeAll()
 	}
-	
-	b.topic.Close()
 }
 
+// GetStats returns the video frames published on the top rendition and the
+// bytes sent across all renditions.
 func (b *Broadcaster) GetStats() (frameCount uint64, bytesSent uint64, isStreaming bool) {
-	return b.frameCount, b.bytesSent, b.isStreaming
+	return atomic.LoadUint64(&b.frameCount), atomic.LoadUint64(&b.bytesSent), b.isStreaming.Load()
+}
+
+// GetAudioFrameCount returns the number of audio frames published.
+func (b *Broadcaster) GetAudioFrameCount() uint64 {
+	return atomic.LoadUint64(&b.audioCount)
 }
 
 func (b *Broadcaster) GetViewerCount() int {
 	// Query actual P2P network for subscriber count
-	peers := b.topic.ListPeers()
-	b.viewerCount = len(peers)
+	b.viewerCount = b.countViewers()
 	return b.viewerCount
 }
 
+// countViewers returns the peers subscribed to any rendition, or with the
+// direct transport the peers it is sent to.
+func (b *Broadcaster) countViewers() int {
+	peers := make(map[peer.ID]struct{})
+	for _, r := range b.renditions {
+		for _, p := range r.topic.ListPeers() {
+			peers[p] = struct{}{}
+		}
+		for _, p := range r.fanout.peers() {
+			peers[p] = struct{}{}
+		}
+	}
+	return len(peers)
+}
+
 func (b *Broadcaster) UpdateViewerCount() {
 	// Continuously update viewer count from P2P network
 	go func() {
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
-		
-		for b.isStreaming {
+
+		for b.isStreaming.Load() {
 			select {
 			case <-b.ctx.Done():
 				return
 			case <-ticker.C:
-				peers := b.topic.ListPeers()
-				b.viewerCount = len(peers)
+				b.viewerCount = b.countViewers()
 				b.logger.Debugf("Updated viewer count: %d peers", b.viewerCount)
 			}
 		}
 	}()
-}
\ No newline at end of file
+}
@@ -0,0 +1,266 @@
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
+	"github.com/sirupsen/logrus"
+)
+
+// A broadcaster built purely from registered media fakes delivers their
+// frames to a viewer over gossipsub.
+func TestBroadcasterWithRegisteredFakes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := newTestHosts(t, 2)
+	bps, err := pubsub.NewGossipSub(ctx, hosts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	vps, err := pubsub.NewGossipSub(ctx, hosts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	useFakeMedia(cfg)
+	cfg.Media.AudioCodec = "none"
+	cfg.Media.Resolution = "854x480"
+	cfg.Media.Renditions = nil
+
+	var mu sync.Mutex
+	var payloads [][]byte
+	v, err := NewViewerWithConfig(ctx, vps, cfg, func(data []byte) {
+		header, payload, err := media.UnmarshalFrame(data)
+		if err != nil || header.Codec != media.CodecRawVideo {
+			return
+		}
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Stop()
+	b, err := NewBroadcasterWithConfig(ctx, bps, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetIdentity(hosts[0]); err != nil {
+		t.Fatal(err)
+	}
+	directory := NewNamespace("").DirectoryTopic()
+	waitFor(t, "the viewer on the directory topic", func() bool { return len(bps.ListPeers(directory)) > 0 })
+
+	if err := b.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	waitFor(t, "the announcement", func() bool { return len(v.ListStreams()) > 0 })
+	if err := v.StartViewing(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "frames", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(payloads) >= 10
+	})
+
+	// Each frame went through the fake source, encoder and decoder
+	mu.Lock()
+	defer mu.Unlock()
+	for _, payload := range payloads {
+		if !bytes.HasPrefix(payload, []byte("480p frame ")) {
+			t.Fatalf("payload %q did not come from the fakes", payload)
+		}
+	}
+}
+
+func TestReconfigureAfterRestartPublishesAddedRendition(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.DefaultConfig()
+	useFakeMedia(cfg)
+	cfg.Media.Resolution = "854x480"
+	cfg.Media.Renditions = []string{"240p", "480p"}
+	b, err := NewBroadcasterWithConfig(ctx, newTestPubSub(t, ctx), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	low, high := b.renditions[0], b.renditions[1]
+	published := func(r *rendition) func() bool {
+		return func() bool { return len(r.gopCache.Snapshot()) > 0 }
+	}
+
+	if err := b.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "both renditions", func() bool { return published(low)() && published(high)() })
+
+	// Dropping 480p while stopped, then adding it back live, must start a
+	// publish loop for it again
+	b.Stop()
+	if err := b.SetQuality("240p"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	waitFor(t, "240p after restart", published(low))
+	if published(high)() {
+		t.Fatal("480p published at 240p")
+	}
+	if err := b.SetQuality("480p"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "480p after reconfigure", published(high))
+
+	// Capture keeps going rather than waiting on an unread encoder
+	before := atomic.LoadUint64(&b.frameCount)
+	time.Sleep(100 * time.Millisecond)
+	if after := atomic.LoadUint64(&b.frameCount); after <= before {
+		t.Fatalf("frame count stuck at %d after reconfigure", after)
+	}
+}
+
+func TestReconfigureLiveRenamesSingleRendition(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.DefaultConfig()
+	useFakeMedia(cfg)
+	cfg.Media.Resolution = "854x480"
+	cfg.Media.Renditions = nil
+	b, err := NewBroadcasterWithConfig(ctx, newTestPubSub(t, ctx), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	r := b.renditions[0]
+	encodedAt := func(quality string) func() bool {
+		return func() bool {
+			gop := r.gopCache.Snapshot()
+			if len(gop) == 0 {
+				return false
+			}
+			_, payload, err := media.UnmarshalFrame(gop[len(gop)-1])
+			return err == nil && bytes.HasPrefix(payload, []byte(quality+" "))
+		}
+	}
+	waitFor(t, "480p frames", encodedAt("480p"))
+
+	if err := b.SetQuality("240p"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "240p frames", encodedAt("240p"))
+	b.videoMu.Lock()
+	name := r.name
+	b.videoMu.Unlock()
+	if name != "240p" {
+		t.Fatalf("rendition name = %q after switching to 240p", name)
+	}
+	if got := b.findRendition("240p"); got != r {
+		t.Fatal("findRendition() did not find the rendition by its new quality")
+	}
+}
+
+func TestStartStreamingOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.DefaultConfig()
+	useFakeMedia(cfg)
+	b, err := NewBroadcasterWithConfig(ctx, newTestPubSub(t, ctx), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Of concurrent starts, exactly one succeeds
+	var started atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.StartStreaming() == nil {
+				started.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := started.Load(); n != 1 {
+		t.Fatalf("%d concurrent starts succeeded, want 1", n)
+	}
+	b.Stop()
+	b.Stop()
+	if err := b.StartStreaming(); err != nil {
+		t.Fatalf("StartStreaming() after Stop = %v", err)
+	}
+	b.Stop()
+}
+
+func TestStartStreamingFailureRollsBack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.DefaultConfig()
+	useFakeMedia(cfg)
+	cfg.Media.VideoSource = brokenSource
+	b, err := NewBroadcasterWithConfig(ctx, newTestPubSub(t, ctx), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := b.StartStreaming(); err == nil {
+			t.Fatal("StartStreaming() succeeded without a camera")
+		}
+		if _, _, streaming := b.GetStats(); streaming {
+			t.Fatal("still streaming after a failed start")
+		}
+	}
+	b.Stop()
+}
+
+func TestCaptureLoopStampsCaptureTime(t *testing.T) {
+	clock := media.NewMediaClock()
+	encoder := &fakeEncoder{}
+	if err := encoder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Stop()
+
+	// Frames waited in the queue; their PTS is still when they were taken
+	captured := []time.Duration{40 * time.Millisecond, 80 * time.Millisecond}
+	frames := make(chan media.RawFrame, len(captured))
+	start := time.Now()
+	for _, d := range captured {
+		frames <- media.RawFrame{Data: []byte("frame"), Captured: start.Add(d)}
+	}
+	close(frames)
+	time.Sleep(150 * time.Millisecond)
+
+	b := &Broadcaster{ctx: context.Background(), logger: logrus.New()}
+	b.captureLoop(frames, func() []media.Encoder { return []media.Encoder{encoder} }, clock, make(chan struct{}))
+	for _, d := range captured {
+		frame := <-encoder.Frames()
+		got := media.PTSToDuration(frame.Header.PTS)
+		if got < d || got > d+10*time.Millisecond {
+			t.Errorf("frame captured at %v stamped %v", d, got)
+		}
+	}
+}
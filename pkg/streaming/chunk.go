@@ -0,0 +1,414 @@
+package streaming
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Frames are split into chunks so that no pubsub message comes near
+// GossipSub's 1 MiB limit and a lost message costs only a small piece of a
+// frame. Each chunk carries a fixed big-endian header:
+//
+//	0  magic         uint16  0x4D43 ("MC")
+//	2  version       uint8
+//	3  flags         uint8   ChunkFlagParity marks FEC parity
+//	4  stream ID     uint32
+//	8  frame ID      uint64
+//	16 chunk index   uint16  group index for parity chunks
+//	18 chunk count   uint16  data chunks in the frame
+//	20 frame length  uint32  total length of the reassembled frame
+//	24 payload
+const (
+	ChunkMagic      = 0x4D43
+	ChunkVersion    = 1
+	ChunkHeaderSize = 24
+
+	ChunkFlagParity = 1 << 0
+
+	// DefaultChunkSize keeps each message, with pubsub overhead, within a
+	// typical path MTU.
+	DefaultChunkSize = 1200
+	minChunkSize     = ChunkHeaderSize + 64
+
+	maxChunkCount = 0xFFFF
+	maxFrameSize  = 32 << 20
+
+	defaultReassemblyTimeout = time.Second
+	maxPendingFrames         = 256
+	completedHistory         = 512
+)
+
+var (
+	ErrNotChunk       = errors.New("not a chunk")
+	ErrChunkVersion   = errors.New("unsupported chunk version")
+	ErrChunkMalformed = errors.New("malformed chunk")
+	ErrFrameTooLarge  = errors.New("frame too large to chunk")
+)
+
+// ChunkHeader describes one chunk of a frame.
+type ChunkHeader struct {
+	Flags       uint8
+	StreamID    uint32
+	FrameID     uint64
+	Index       uint16
+	Count       uint16
+	FrameLength uint32
+}
+
+// Chunker splits frames into chunks of at most a fixed size.
+type Chunker struct {
+	chunkSize int
+}
+
+// NewChunker creates a chunker whose chunks, header included, are at most
+// chunkSize bytes. Zero selects DefaultChunkSize.
+func NewChunker(chunkSize int) *Chunker {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < minChunkSize {
+		chunkSize = minChunkSize
+	}
+	return &Chunker{chunkSize: chunkSize}
+}
+
+// Split returns the chunks for one frame in index order.
+func (c *Chunker) Split(streamID uint32, frameID uint64, frame []byte) ([][]byte, error) {
+	if len(frame) > maxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(frame))
+	}
+
+	payloadSize := c.chunkSize - ChunkHeaderSize
+	count := (len(frame) + payloadSize - 1) / payloadSize
+	if count == 0 {
+		count = 1
+	}
+	if count > maxChunkCount {
+		return nil, fmt.Errorf("%w: needs %d chunks", ErrFrameTooLarge, count)
+	}
+
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * payloadSize
+		end := min(start+payloadSize, len(frame))
+
+		chunk := make([]byte, ChunkHeaderSize, ChunkHeaderSize+end-start)
+		putChunkHeader(chunk, ChunkHeader{
+			StreamID:    streamID,
+			FrameID:     frameID,
+			Index:       uint16(i),
+			Count:       uint16(count),
+			FrameLength: uint32(len(frame)),
+		})
+		chunks = append(chunks, append(chunk, frame[start:end]...))
+	}
+	return chunks, nil
+}
+
+func putChunkHeader(buf []byte, h ChunkHeader) {
+	binary.BigEndian.PutUint16(buf[0:], ChunkMagic)
+	buf[2] = ChunkVersion
+	buf[3] = h.Flags
+	binary.BigEndian.PutUint32(buf[4:], h.StreamID)
+	binary.BigEndian.PutUint64(buf[8:], h.FrameID)
+	binary.BigEndian.PutUint16(buf[16:], h.Index)
+	binary.BigEndian.PutUint16(buf[18:], h.Count)
+	binary.BigEndian.PutUint32(buf[20:], h.FrameLength)
+}
+
+// ParseChunk validates a chunk and returns its header and payload. The
+// payload aliases data.
+func ParseChunk(data []byte) (*ChunkHeader, []byte, error) {
+	if len(data) < ChunkHeaderSize {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrChunkMalformed, len(data))
+	}
+	if binary.BigEndian.Uint16(data[0:]) != ChunkMagic {
+		return nil, nil, ErrNotChunk
+	}
+	if data[2] != ChunkVersion {
+		return nil, nil, fmt.Errorf("%w: %d", ErrChunkVersion, data[2])
+	}
+
+	h := &ChunkHeader{
+		Flags:       data[3],
+		StreamID:    binary.BigEndian.Uint32(data[4:]),
+		FrameID:     binary.BigEndian.Uint64(data[8:]),
+		Index:       binary.BigEndian.Uint16(data[16:]),
+		Count:       binary.BigEndian.Uint16(data[18:]),
+		FrameLength: binary.BigEndian.Uint32(data[20:]),
+	}
+	if h.Count == 0 || h.Index >= h.Count || h.FrameLength > maxFrameSize {
+		return nil, nil, fmt.Errorf("%w: chunk %d/%d of a %d byte frame", ErrChunkMalformed, h.Index, h.Count, h.FrameLength)
+	}
+	return h, data[ChunkHeaderSize:], nil
+}
+
+// IsParity reports whether the chunk carries FEC parity rather than data.
+func (h *ChunkHeader) IsParity() bool {
+	return h.Flags&ChunkFlagParity != 0
+}
+
+type frameKey struct {
+	streamID uint32
+	frameID  uint64
+}
+
+type partialFrame struct {
+	chunks      [][]byte
+	received    int
+	size        int
+	frameLength uint32
+	firstSeen   time.Time
+
+	// FEC parity by group, once the group size is known from a parity chunk
+	groupSize int
+	parity    map[int][]byte
+}
+
+// Reassembler collects chunks back into frames, rebuilding a lost chunk from
+// FEC parity where it can. Frames that are still incomplete after the
+// timeout are discarded. It is not safe for concurrent use.
+type Reassembler struct {
+	timeout   time.Duration
+	pending   map[frameKey]*partialFrame
+	completed map[frameKey]struct{}
+	history   []frameKey
+	lastSweep time.Time
+
+	framesCompleted  uint64
+	framesIncomplete uint64
+	duplicates       uint64
+	chunksRecovered  uint64
+}
+
+// NewReassembler creates a reassembler that gives up on a frame once timeout
+// has passed since its first chunk arrived. Zero selects the default of one
+// second.
+func NewReassembler(timeout time.Duration) *Reassembler {
+	if timeout <= 0 {
+		timeout = defaultReassemblyTimeout
+	}
+	return &Reassembler{
+		timeout:   timeout,
+		pending:   make(map[frameKey]*partialFrame),
+		completed: make(map[frameKey]struct{}),
+	}
+}
+
+// Add stores a chunk and returns the reassembled frame once its last chunk
+// has arrived or been recovered, or nil while it is still incomplete. Chunks
+// may arrive in any order; duplicates and chunks of frames already delivered
+// are ignored.
+func (r *Reassembler) Add(data []byte) ([]byte, error) {
+	return r.AddAt(data, time.Now())
+}
+
+// AddAt is Add with an explicit arrival time.
+func (r *Reassembler) AddAt(data []byte, now time.Time) ([]byte, error) {
+	r.sweep(now)
+
+	h, payload, err := ParseChunk(data)
+	if err != nil {
+		return nil, err
+	}
+
+	key := frameKey{streamID: h.StreamID, frameID: h.FrameID}
+	if _, done := r.completed[key]; done {
+		// Parity for a frame that arrived intact is expected, not a duplicate
+		if !h.IsParity() {
+			r.duplicates++
+		}
+		return nil, nil
+	}
+
+	p, ok := r.pending[key]
+	if !ok {
+		if len(r.pending) >= maxPendingFrames {
+			r.evictOldest()
+		}
+		p = &partialFrame{
+			chunks:      make([][]byte, h.Count),
+			frameLength: h.FrameLength,
+			firstSeen:   now,
+		}
+		r.pending[key] = p
+	}
+	if int(h.Count) != len(p.chunks) || h.FrameLength != p.frameLength {
+		return nil, fmt.Errorf("%w: chunk %d of frame %d disagrees with earlier chunks", ErrChunkMalformed, h.Index, h.FrameID)
+	}
+
+	var group int
+	if h.IsParity() {
+		if group, err = p.addParity(h, payload); err != nil {
+			return nil, err
+		}
+	} else {
+		if p.chunks[h.Index] != nil {
+			r.duplicates++
+			return nil, nil
+		}
+		p.store(int(h.Index), append([]byte(nil), payload...))
+		if p.groupSize > 0 {
+			group = int(h.Index) / p.groupSize
+		}
+	}
+	if p.groupSize > 0 && p.recover(group) {
+		r.chunksRecovered++
+	}
+	if p.received < len(p.chunks) {
+		return nil, nil
+	}
+
+	delete(r.pending, key)
+	r.markCompleted(key)
+	if p.size != int(p.frameLength) {
+		r.framesIncomplete++
+		return nil, fmt.Errorf("%w: frame %d reassembled to %d bytes, expected %d", ErrChunkMalformed, h.FrameID, p.size, p.frameLength)
+	}
+
+	frame := make([]byte, 0, p.size)
+	for _, chunk := range p.chunks {
+		frame = append(frame, chunk...)
+	}
+	r.framesCompleted++
+	return frame, nil
+}
+
+func (p *partialFrame) store(index int, payload []byte) {
+	p.chunks[index] = payload
+	p.received++
+	p.size += len(payload)
+}
+
+// addParity records a parity chunk and returns its group.
+func (p *partialFrame) addParity(h *ChunkHeader, payload []byte) (int, error) {
+	groupSize, parity, err := parseParity(payload)
+	if err != nil {
+		return 0, err
+	}
+	if p.groupSize != 0 && p.groupSize != groupSize {
+		return 0, fmt.Errorf("%w: FEC group size changed within frame %d", ErrChunkMalformed, h.FrameID)
+	}
+	p.groupSize = groupSize
+	if p.parity == nil {
+		p.parity = make(map[int][]byte)
+	}
+
+	group := int(h.Index)
+	if group*groupSize >= len(p.chunks) {
+		return 0, fmt.Errorf("%w: parity group %d beyond frame %d", ErrChunkMalformed, group, h.FrameID)
+	}
+	p.parity[group] = append([]byte(nil), parity...)
+	return group, nil
+}
+
+// recover rebuilds the one missing chunk of a group from its parity, if
+// that is all the group lacks. It reports whether a chunk was rebuilt.
+func (p *partialFrame) recover(group int) bool {
+	parity, ok := p.parity[group]
+	if !ok {
+		return false
+	}
+
+	start := group * p.groupSize
+	end := min(start+p.groupSize, len(p.chunks))
+	missing := -1
+	payloads := [][]byte{parity}
+	for i := start; i < end; i++ {
+		if p.chunks[i] == nil {
+			if missing >= 0 {
+				return false
+			}
+			missing = i
+			continue
+		}
+		payloads = append(payloads, p.chunks[i])
+	}
+	if missing < 0 {
+		return false
+	}
+
+	// Every chunk but the frame's last is full size, so the parity is as long
+	// as a full chunk unless the group holds only the last one
+	length := len(parity)
+	last := len(p.chunks) - 1
+	if missing == last && end-start > 1 {
+		length = int(p.frameLength) - last*len(parity)
+	}
+	if length < 0 || length > len(parity) {
+		return false
+	}
+
+	p.store(missing, xorPayloads(payloads)[:length])
+	delete(p.parity, group)
+	return true
+}
+
+// GetStats returns the frames reassembled, the frames discarded because they
+// were still incomplete at the timeout, and the duplicate chunks ignored.
+func (r *Reassembler) GetStats() (completed uint64, incomplete uint64, duplicates uint64) {
+	return r.framesCompleted, r.framesIncomplete, r.duplicates
+}
+
+// GetFECStats returns the chunks rebuilt from parity and the frames lost
+// even so, because too many of their chunks were missing.
+func (r *Reassembler) GetFECStats() (recovered uint64, unrecoverable uint64) {
+	return r.chunksRecovered, r.framesIncomplete
+}
+
+// Inherit adds the counters of a reassembler that this one replaces, so
+// that stats carry on when a viewer moves to another rendition.
+func (r *Reassembler) Inherit(prev *Reassembler) {
+	r.framesCompleted += prev.framesCompleted
+	r.framesIncomplete += prev.framesIncomplete
+	r.duplicates += prev.duplicates
+	r.chunksRecovered += prev.chunksRecovered
+}
+
+// Pending returns the number of frames still waiting for chunks.
+func (r *Reassembler) Pending() int {
+	return len(r.pending)
+}
+
+// sweep discards frames that have timed out. It runs at most a few times per
+// timeout so that Add stays cheap.
+func (r *Reassembler) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.timeout/4 {
+		return
+	}
+	r.lastSweep = now
+
+	for key, p := range r.pending {
+		if now.Sub(p.firstSeen) >= r.timeout {
+			delete(r.pending, key)
+			r.markCompleted(key) // late chunks must not start it again
+			r.framesIncomplete++
+		}
+	}
+}
+
+func (r *Reassembler) evictOldest() {
+	var oldest frameKey
+	var oldestSeen time.Time
+	for key, p := range r.pending {
+		if oldestSeen.IsZero() || p.firstSeen.Before(oldestSeen) {
+			oldest, oldestSeen = key, p.firstSeen
+		}
+	}
+	delete(r.pending, oldest)
+	r.markCompleted(oldest)
+	r.framesIncomplete++
+}
+
+// markCompleted remembers a finished frame for a while so that late or
+// duplicate chunks are not mistaken for a new frame.
+func (r *Reassembler) markCompleted(key frameKey) {
+	r.completed[key] = struct{}{}
+	r.history = append(r.history, key)
+	if len(r.history) > completedHistory {
+		delete(r.completed, r.history[0])
+		r.history = r.history[1:]
+	}
+}
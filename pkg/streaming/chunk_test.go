@@ -0,0 +1,217 @@
+package streaming
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testFrame returns a frame of n bytes that differs at every offset, so that
+// chunks put back in the wrong place are noticed.
+func testFrame(n int) []byte {
+	frame := make([]byte, n)
+	for i := range frame {
+		frame[i] = byte(i*7 + i/251)
+	}
+	return frame
+}
+
+func shuffled(chunks [][]byte, seed int64) [][]byte {
+	out := append([][]byte(nil), chunks...)
+	rand.New(rand.NewSource(seed)).Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out
+}
+
+// reassemble feeds chunks to r and returns the frames it delivers.
+func reassemble(t *testing.T, r *Reassembler, chunks [][]byte, now time.Time) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for _, chunk := range chunks {
+		frame, err := r.AddAt(chunk, now)
+		if err != nil {
+			t.Fatalf("AddAt() error = %v", err)
+		}
+		if frame != nil {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+func TestChunkReassembly(t *testing.T) {
+	const chunkSize = minChunkSize
+	payloadSize := chunkSize - ChunkHeaderSize
+
+	tests := []struct {
+		name      string
+		frameSize int
+		chunks    int
+	}{
+		{"empty frame", 0, 1},
+		{"one byte", 1, 1},
+		{"exactly one chunk", payloadSize, 1},
+		{"exact multiple", 4 * payloadSize, 4},
+		{"short last chunk", 4*payloadSize + 3, 5},
+		{"many chunks", 50*payloadSize + payloadSize/2, 51},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := testFrame(tt.frameSize)
+			chunks, err := NewChunker(chunkSize).Split(1, 42, frame)
+			if err != nil {
+				t.Fatalf("Split() error = %v", err)
+			}
+			if len(chunks) != tt.chunks {
+				t.Fatalf("Split() returned %d chunks, want %d", len(chunks), tt.chunks)
+			}
+			for _, chunk := range chunks {
+				if len(chunk) > chunkSize {
+					t.Fatalf("chunk of %d bytes exceeds %d", len(chunk), chunkSize)
+				}
+			}
+
+			for seed := int64(0); seed < 5; seed++ {
+				r := NewReassembler(time.Second)
+				frames := reassemble(t, r, shuffled(chunks, seed), time.Unix(0, 0))
+				if len(frames) != 1 || !bytes.Equal(frames[0], frame) {
+					t.Fatalf("seed %d: reassembled %d frames, want the original", seed, len(frames))
+				}
+			}
+		})
+	}
+}
+
+func TestChunkLossAndDuplicates(t *testing.T) {
+	const chunkSize = minChunkSize
+	frame := testFrame(10*(chunkSize-ChunkHeaderSize) + 5)
+	chunks, err := NewChunker(chunkSize).Split(1, 7, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(0, 0)
+
+	tests := []struct {
+		name       string
+		send       [][]byte
+		wantFrames int
+		wantDups   uint64
+		wantLost   uint64
+	}{
+		{
+			name:       "duplicated chunks",
+			send:       append(append([][]byte(nil), chunks...), chunks[0], chunks[len(chunks)-1]),
+			wantFrames: 1,
+			wantDups:   2,
+		},
+		{
+			name:       "duplicate before the frame completes",
+			send:       append([][]byte{chunks[3]}, shuffled(chunks, 1)...),
+			wantFrames: 1,
+			wantDups:   1,
+		},
+		{
+			name:     "lost middle chunk",
+			send:     append(append([][]byte(nil), chunks[:4]...), chunks[5:]...),
+			wantLost: 1,
+		},
+		{
+			name:     "lost short last chunk",
+			send:     shuffled(chunks[:len(chunks)-1], 2),
+			wantLost: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler(time.Second)
+			frames := reassemble(t, r, tt.send, start)
+			if len(frames) != tt.wantFrames {
+				t.Fatalf("reassembled %d frames, want %d", len(frames), tt.wantFrames)
+			}
+			for _, f := range frames {
+				if !bytes.Equal(f, frame) {
+					t.Fatal("reassembled frame differs from the original")
+				}
+			}
+
+			// An incomplete frame is given up once the timeout has passed,
+			// and its late chunks do not bring it back
+			if _, err := r.AddAt(chunks[4], start.Add(2*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if r.Pending() != 0 {
+				t.Errorf("Pending() = %d after the timeout, want 0", r.Pending())
+			}
+			completed, lost, dups := r.GetStats()
+			if completed != uint64(tt.wantFrames) || lost != tt.wantLost {
+				t.Errorf("GetStats() = %d completed, %d incomplete, want %d and %d", completed, lost, tt.wantFrames, tt.wantLost)
+			}
+			// The late chunk counts as a duplicate of a finished frame
+			if dups != tt.wantDups+1 {
+				t.Errorf("GetStats() = %d duplicates, want %d", dups, tt.wantDups+1)
+			}
+		})
+	}
+}
+
+func TestChunkInterleavedFrames(t *testing.T) {
+	chunker := NewChunker(minChunkSize)
+	var all [][]byte
+	var frames [][]byte
+	for id := uint64(0); id < 8; id++ {
+		frame := testFrame(int(id)*500 + 17)
+		chunks, err := chunker.Split(3, id, frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+		all = append(all, chunks...)
+	}
+
+	r := NewReassembler(time.Second)
+	got := reassemble(t, r, shuffled(all, 9), time.Unix(0, 0))
+	if len(got) != len(frames) {
+		t.Fatalf("reassembled %d frames, want %d", len(got), len(frames))
+	}
+	for _, f := range got {
+		found := false
+		for _, want := range frames {
+			found = found || bytes.Equal(f, want)
+		}
+		if !found {
+			t.Fatalf("reassembled a frame of %d bytes that was never sent", len(f))
+		}
+	}
+}
+
+func TestParseChunkRejectsMalformed(t *testing.T) {
+	chunks, err := NewChunker(0).Split(1, 1, testFrame(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := chunks[0]
+	modified := func(f func(b []byte)) []byte {
+		b := append([]byte(nil), valid...)
+		f(b)
+		return b
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short", valid[:ChunkHeaderSize-1]},
+		{"bad magic", modified(func(b []byte) { b[0] = 0 })},
+		{"newer version", modified(func(b []byte) { b[2] = ChunkVersion + 1 })},
+		{"zero count", modified(func(b []byte) { b[18], b[19] = 0, 0 })},
+		{"index beyond count", modified(func(b []byte) { b[17] = 1 })},
+		{"frame too large", modified(func(b []byte) { b[20] = 0xff })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseChunk(tt.data); err == nil {
+				t.Error("ParseChunk() accepted a malformed chunk")
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package streaming
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	ControlKeyframeRequest = "keyframe_request"
+
+	// Keyframe requests from many viewers within this window are served
+	// by a single keyframe.
+	keyframeCoalesceWindow = time.Second
+	// Forcing a keyframe restarts the encoder, so a rendition forces one no
+	// more often than this. Requests in between wait for the regular GOP.
+	forcedKeyframeInterval = 5 * time.Second
+	// A viewer asks again no more often than this.
+	keyframeRequestInterval = 2 * time.Second
+
+	fastStartTimeout = 3 * time.Second
+
+	// Longest rendition name a viewer may send when asking for a GOP
+	maxRenditionNameLength = 32
+)
+
+// ControlMessage is a request sent on the control topic.
+type ControlMessage struct {
+	Type      string `json:"type"`
+	StreamID  uint32 `json:"stream_id,omitempty"` // zero for any stream
+	Rendition string `json:"rendition,omitempty"` // empty for every rendition
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (m *ControlMessage) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func UnmarshalControlMessage(data []byte) (*ControlMessage, error) {
+	var msg ControlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("invalid control message: %w", err)
+	}
+	return &msg, nil
+}
+
+// writeFrame writes a wire frame with its uint32 length prefix.
+func writeFrame(w io.Writer, frame []byte) error {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(frame)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a length-prefixed wire frame, returning io.EOF if the
+// sender closed the stream before it.
+func readFrame(r io.Reader) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// writeGOP sends frames as a sequence of length-prefixed wire frames.
+func writeGOP(w io.Writer, frames [][]byte) error {
+	bw := bufio.NewWriter(w)
+	for _, frame := range frames {
+		if err := writeFrame(bw, frame); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// readGOP reads length-prefixed wire frames until the sender closes the
+// stream.
+func readGOP(r io.Reader) ([][]byte, error) {
+	br := bufio.NewReader(r)
+	var frames [][]byte
+	var total int
+	for {
+		frame, err := readFrame(br)
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		total += len(frame)
+		if total > maxGOPBytes {
+			return nil, fmt.Errorf("GOP too large: %d bytes", total)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// openRenditionStream opens a stream to a peer on proto and sends the
+// request every such protocol starts with: the stream ID followed by the
+// rendition name, empty without simulcast.
+func openRenditionStream(ctx context.Context, h host.Host, proto protocol.ID, to peer.ID, streamID uint32, rendition string) (network.Stream, error) {
+	s, err := h.NewStream(ctx, to, proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	s.SetWriteDeadline(time.Now().Add(fastStartTimeout))
+	request := binary.BigEndian.AppendUint32(nil, streamID)
+	if _, err := s.Write(append(request, rendition...)); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	s.CloseWrite()
+	s.SetWriteDeadline(time.Time{})
+	return s, nil
+}
+
+// readRenditionRequest reads the stream ID and rendition name a viewer
+// sends on opening a stream.
+func readRenditionRequest(s network.Stream) (uint32, string, error) {
+	s.SetReadDeadline(time.Now().Add(fastStartTimeout))
+	defer s.SetReadDeadline(time.Time{})
+
+	request, err := io.ReadAll(io.LimitReader(s, 4+maxRenditionNameLength+1))
+	if err != nil {
+		return 0, "", err
+	}
+	if len(request) < 4 {
+		return 0, "", fmt.Errorf("request too short")
+	}
+	if len(request) > 4+maxRenditionNameLength {
+		return 0, "", fmt.Errorf("rendition name too long")
+	}
+	return binary.BigEndian.Uint32(request), string(request[4:]), nil
+}
+
+// fetchGOP asks a peer for a rendition's cached GOP over the fast start
+// protocol. The peer is the stream's broadcaster or a relay caching it.
+func fetchGOP(ctx context.Context, h host.Host, proto protocol.ID, from peer.ID, streamID uint32, rendition string) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, fastStartTimeout)
+	defer cancel()
+
+	s, err := openRenditionStream(ctx, h, proto, from, streamID, rendition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request GOP: %w", err)
+	}
+	defer s.Close()
+
+	s.SetReadDeadline(time.Now().Add(fastStartTimeout))
+	frames, err := readGOP(s)
+	if err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("failed to read GOP: %w", err)
+	}
+	return frames, nil
+}
+
+// serveGOP writes cached GOP frames to a stream opened by a viewer.
+func serveGOP(s network.Stream, frames [][]byte) error {
+	defer s.Close()
+
+	s.SetWriteDeadline(time.Now().Add(fastStartTimeout))
+	if err := writeGOP(s, frames); err != nil {
+		s.Reset()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package streaming
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
+	"github.com/sirupsen/logrus"
+)
+
+// With the direct transport a viewer opens a stream to the broadcaster and
+// asks for a rendition, and the broadcaster writes it every frame whole, with
+// a length prefix, instead of publishing chunks to GossipSub. Nothing is
+// duplicated and no hop validates anything, but the broadcaster uploads the
+// stream once per viewer, so relays take viewers it cannot serve. Frames on
+// a direct stream carry the broadcaster's signature, as cached GOPs do, and
+// a viewer drops those that do not verify; it only asks the broadcaster and
+// the relays it is configured with for them.
+const (
+	transportPubSub = "pubsub"
+	transportDirect = "direct"
+
+	// Frames queued for a viewer, a second or two of video and audio. A
+	// viewer falling further behind misses frames up to the next keyframe.
+	directQueueSize = 128
+
+	// A viewer that takes no frame for this long is dropped
+	directWriteTimeout = 5 * time.Second
+
+	// How soon a viewer tries again once no source serves the stream
+	directRetryInterval = time.Second
+)
+
+// errDirectNeedsHost is returned for the direct transport by constructors
+// given no host to open streams from.
+var errDirectNeedsHost = errors.New("the direct transport needs a host")
+
+// isDirect reports whether cfg, which may be nil, selects the direct
+// transport.
+func isDirect(cfg *config.Config) (bool, error) {
+	if cfg == nil {
+		return false, nil
+	}
+	switch cfg.Network.Transport {
+	case "", transportPubSub:
+		return false, nil
+	case transportDirect:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown transport %q", cfg.Network.Transport)
+	}
+}
+
+// configuredRelays returns the peer IDs of the configured relays.
+func configuredRelays(cfg *config.Config) ([]peer.ID, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	var relays []peer.ID
+	for _, addr := range cfg.Network.Relays {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay %q: %w", addr, err)
+		}
+		relays = append(relays, info.ID)
+	}
+	return relays, nil
+}
+
+// fanout sends a rendition's frames to the viewers that opened a direct
+// stream for it. Each viewer has a queue of its own, so a slow one holds
+// up no other: once its queue is full its video is dropped up to the next
+// keyframe, from which it can decode again.
+type fanout struct {
+	mu          sync.Mutex
+	subscribers map[*directSubscriber]struct{}
+	closed      bool // set by closeAll, until reopen
+}
+
+type directSubscriber struct {
+	stream   network.Stream
+	queue    chan []byte
+	skipping bool // dropping video until a keyframe, guarded by fanout.mu
+}
+
+func newFanout() *fanout {
+	return &fanout{subscribers: make(map[*directSubscriber]struct{})}
+}
+
+// serve writes the frames sent from now on to a viewer's stream until the
+// viewer goes away or closeAll is called. A closed fanout resets the stream
+// at once.
+func (f *fanout) serve(s network.Stream) {
+	sub := &directSubscriber{stream: s, queue: make(chan []byte, directQueueSize)}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		s.Reset()
+		return
+	}
+	f.subscribers[sub] = struct{}{}
+	f.mu.Unlock()
+	defer f.remove(sub)
+
+	for frame := range sub.queue {
+		s.SetWriteDeadline(time.Now().Add(directWriteTimeout))
+		if err := writeFrame(s, frame); err != nil {
+			s.Reset()
+			return
+		}
+	}
+	s.Close()
+}
+
+func (f *fanout) remove(sub *directSubscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers, sub)
+}
+
+// send queues a wire frame for every viewer and returns the bytes queued.
+func (f *fanout) send(header *media.FrameHeader, frame []byte) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	video := !header.Codec.IsAudio()
+	var queued int
+	for sub := range f.subscribers {
+		if sub.skipping && video {
+			if !header.IsKeyframe() {
+				continue
+			}
+			sub.skipping = false
+		}
+		select {
+		case sub.queue <- frame:
+			queued += len(frame)
+		default:
+			sub.skipping = sub.skipping || video
+		}
+	}
+	return queued
+}
+
+// closeAll ends every viewer's stream once its queued frames are written,
+// and refuses new viewers until reopen is called.
+func (f *fanout) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for sub := range f.subscribers {
+		close(sub.queue)
+		delete(f.subscribers, sub)
+	}
+}
+
+// reopen lets viewers be served again after closeAll.
+func (f *fanout) reopen() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = false
+}
+
+// peers returns the viewers being served.
+func (f *fanout) peers() []peer.ID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peers := make([]peer.ID, 0, len(f.subscribers))
+	for sub := range f.subscribers {
+		peers = append(peers, sub.stream.Conn().RemotePeer())
+	}
+	return peers
+}
+
+// pullFrames receives a rendition over the direct transport from the first
+// of sources that serves it, passing each frame to deliver. When the stream
+// breaks it starts over with the first source, and when none serves the
+// rendition it tries again after directRetryInterval, until ctx is done or
+// deliver returns false.
+func pullFrames(ctx context.Context, h host.Host, proto protocol.ID, sources []peer.ID, streamID uint32, rendition string,
+	deliver func([]byte) bool, logger *logrus.Logger) {
+	for {
+		var received bool
+		for _, p := range sources {
+			n, ok := pullFrom(ctx, h, proto, p, streamID, rendition, deliver, logger)
+			if !ok {
+				return
+			}
+			if n > 0 {
+				received = true
+				break
+			}
+		}
+
+		if received {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(directRetryInterval):
+		}
+	}
+}
+
+// pullFrom receives a rendition from one peer until the stream breaks,
+// returning the frames delivered and false if pulling should stop.
+func pullFrom(ctx context.Context, h host.Host, proto protocol.ID, from peer.ID, streamID uint32, rendition string,
+	deliver func([]byte) bool, logger *logrus.Logger) (int, bool) {
+	openCtx, cancel := context.WithTimeout(ctx, fastStartTimeout)
+	s, err := openRenditionStream(openCtx, h, proto, from, streamID, rendition)
+	cancel()
+	if err != nil {
+		logger.Debugf("No direct stream from %s: %v", from, err)
+		return 0, ctx.Err() == nil
+	}
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+
+	br := bufio.NewReader(s)
+	var n int
+	for {
+		frame, err := readFrame(br)
+		if err != nil {
+			s.Reset()
+			if ctx.Err() != nil {
+				return n, false
+			}
+			if n > 0 {
+				logger.Infof("Direct stream from %s ended after %d frames: %v", from, n, err)
+			}
+			return n, true
+		}
+		if n == 0 {
+			logger.Infof("Receiving %s directly from %s", renditionLabel(rendition), from)
+		}
+		n++
+		if !deliver(frame) {
+			s.Reset()
+			return n, false
+		}
+	}
+}
+
+// renditionLabel names a rendition in log messages.
+func renditionLabel(rendition string) string {
+	if rendition == "" {
+		return "the stream"
+	}
+	return "rendition " + rendition
+}
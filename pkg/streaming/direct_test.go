@@ -0,0 +1,220 @@
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
+	"github.com/sirupsen/logrus"
+)
+
+const testDirectProtocol = "/meshlink/test/direct/1.0.0"
+
+func TestFanoutRefusesViewersAfterCloseAll(t *testing.T) {
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	server, viewer := mn.Hosts()[0], mn.Hosts()[1]
+
+	f := newFanout()
+	served := make(chan struct{}, 1)
+	server.SetStreamHandler(testDirectProtocol, func(s network.Stream) {
+		f.serve(s)
+		served <- struct{}{}
+	})
+	open := func() *bufio.Reader {
+		t.Helper()
+		s, err := viewer.NewStream(context.Background(), server.ID(), testDirectProtocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Reset() })
+		// The stream reaches the server with the first write
+		if _, err := s.Write([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return bufio.NewReader(s)
+	}
+
+	// A closed fanout resets a new viewer's stream at once
+	f.closeAll()
+	r := open()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve() kept a viewer after closeAll")
+	}
+	if _, err := readFrame(r); err == nil {
+		t.Fatal("read a frame from a closed fanout")
+	}
+	if n := len(f.peers()); n != 0 {
+		t.Fatalf("closed fanout has %d viewers", n)
+	}
+
+	// Once reopened, viewers are served again
+	f.reopen()
+	r = open()
+	header := media.FrameHeader{StreamID: 1, FrameID: 1, Codec: media.CodecH264, Flags: media.FlagKeyframe}
+	frame := media.MarshalFrame(&header, []byte("keyframe"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.peers()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := f.send(&header, frame); n != len(frame) {
+		t.Fatalf("send() queued %d bytes, want %d", n, len(frame))
+	}
+	if got, err := readFrame(r); err != nil || string(got) != string(frame) {
+		t.Fatalf("readFrame() = %v, want the frame sent", err)
+	}
+	f.closeAll()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve() did not return after closeAll")
+	}
+}
+
+func TestReadDirectDropsFramesNotSignedByBroadcaster(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broadcaster, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The broadcaster cannot be reached; a configured relay serves a
+	// forged, an unsigned and a genuine frame
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	relay, viewer := mn.Hosts()[0], mn.Hosts()[1]
+
+	header := media.FrameHeader{StreamID: 7, FrameID: 1, Codec: media.CodecH264, Flags: media.FlagKeyframe}
+	frame := media.MarshalFrame(&header, []byte("keyframe"))
+	forged, err := signFrame(frame, forger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genuine, err := signFrame(frame, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := NewNamespace("")
+	relay.SetStreamHandler(ns.DirectProtocol(), func(s network.Stream) {
+		if _, _, err := readRenditionRequest(s); err != nil {
+			s.Reset()
+			return
+		}
+		for _, data := range [][]byte{forged, frame, genuine} {
+			if err := writeFrame(s, data); err != nil {
+				return
+			}
+		}
+		time.Sleep(5 * time.Second)
+		s.Reset()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	v := &Viewer{
+		ctx:       ctx,
+		host:      viewer,
+		namespace: ns,
+		stream:    StreamDescriptor{StreamID: 7, Broadcaster: broadcaster},
+		relays:    []peer.ID{relay.ID()},
+		incoming:  make(chan subscriptionMessage, 4),
+		logger:    logrus.New(),
+	}
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go v.readDirect(&directFeed{ctx: ctx, cancel: cancel}, stopChan)
+
+	select {
+	case in := <-v.incoming:
+		if !bytes.Equal(in.data, frame) {
+			t.Fatalf("received %x, want the genuine frame without its signature", in.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the genuine frame was not received")
+	}
+	select {
+	case in := <-v.incoming:
+		t.Fatalf("received another frame %x", in.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBroadcastToViewerOverDirectTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := newTestHosts(t, 2)
+	bh, vh := hosts[0], hosts[1]
+	bps, err := pubsub.NewGossipSub(ctx, bh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vps, err := pubsub.NewGossipSub(ctx, vh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	useFakeMedia(cfg)
+	cfg.Media.AudioCodec = "none"
+	cfg.Network.Transport = transportDirect
+	if _, err := NewViewerWithConfig(ctx, vps, cfg, nil); err == nil {
+		t.Fatal("NewViewerWithConfig() accepted the direct transport without a host")
+	}
+
+	var received atomic.Int32
+	v, err := NewViewerWithHost(ctx, vh, vps, cfg, func(data []byte) {
+		if header, err := media.PeekHeader(data); err == nil && header.Codec == media.CodecRawVideo {
+			received.Add(1)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Stop()
+	b, err := NewBroadcasterWithHost(ctx, bh, bps, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := NewNamespace("").DirectoryTopic()
+	waitFor(t, "the viewer on the directory topic", func() bool { return len(bps.ListPeers(directory)) > 0 })
+
+	if err := b.StartStreaming(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	waitFor(t, "the announcement", func() bool { return len(v.ListStreams()) > 0 })
+	if err := v.StartViewing(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "direct frames", func() bool { return received.Load() >= 10 })
+	if got := b.GetViewerCount(); got != 1 {
+		t.Errorf("GetViewerCount() = %d, want 1", got)
+	}
+}
@@ -0,0 +1,316 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Every broadcaster announces its stream on the directory topic, so that
+// viewers can list the live broadcasts and pick one. An announcement is
+// signed with the broadcaster's peer key and names the topic the stream is
+// published on, so a peer cannot pass off a stream as another broadcaster's.
+
+const (
+	// A broadcaster announces its stream this often while live
+	announceInterval = 5 * time.Second
+
+	// A stream not announced for this long is taken to be gone
+	announceExpiry = 3 * announceInterval
+
+	// Prefixed to a descriptor before signing, so that the signature cannot
+	// be passed off as one over any other message
+	descriptorSignaturePrefix = "meshlink-stream-descriptor:"
+)
+
+// StreamDescriptor describes a live broadcast.
+type StreamDescriptor struct {
+	StreamID    uint32    `json:"stream_id"`
+	Title       string    `json:"title"`
+	ChurchName  string    `json:"church_name"`
+	VideoCodec  string    `json:"video_codec,omitempty"` // empty for audio-only
+	AudioCodec  string    `json:"audio_codec,omitempty"` // empty without audio
+	Renditions  []string  `json:"renditions,omitempty"`  // empty without simulcast
+	Topic       string    `json:"topic"`
+	StartedAt   time.Time `json:"started_at"`
+	Broadcaster peer.ID   `json:"broadcaster"`
+	IssuedAt    time.Time `json:"issued_at"`
+	Ended       bool      `json:"ended,omitempty"`
+	Encrypted   bool      `json:"encrypted,omitempty"` // needs the congregation's key
+}
+
+// streamAnnouncement is a descriptor with the broadcaster's signature over it.
+type streamAnnouncement struct {
+	Descriptor []byte `json:"descriptor"`
+	PublicKey  []byte `json:"public_key"`
+	Signature  []byte `json:"signature"`
+}
+
+// signDescriptor encodes desc as an announcement signed with key.
+func signDescriptor(desc *StreamDescriptor, key crypto.PrivKey) ([]byte, error) {
+	data, err := json.Marshal(desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode descriptor: %w", err)
+	}
+	signature, err := key.Sign(append([]byte(descriptorSignaturePrefix), data...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign descriptor: %w", err)
+	}
+	publicKey, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	return json.Marshal(&streamAnnouncement{
+		Descriptor: data,
+		PublicKey:  publicKey,
+		Signature:  signature,
+	})
+}
+
+// verifyAnnouncement checks an announcement's signature and returns its
+// descriptor. The signing key must belong to the broadcaster the descriptor
+// names, and the stream must be published on its own topic in ns.
+func verifyAnnouncement(data []byte, ns Namespace) (*StreamDescriptor, error) {
+	var announcement streamAnnouncement
+	if err := json.Unmarshal(data, &announcement); err != nil {
+		return nil, fmt.Errorf("invalid announcement: %w", err)
+	}
+	publicKey, err := crypto.UnmarshalPublicKey(announcement.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	ok, err := publicKey.Verify(append([]byte(descriptorSignaturePrefix), announcement.Descriptor...), announcement.Signature)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("bad signature")
+	}
+
+	var desc StreamDescriptor
+	if err := json.Unmarshal(announcement.Descriptor, &desc); err != nil {
+		return nil, fmt.Errorf("invalid descriptor: %w", err)
+	}
+	signer, err := peer.IDFromPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if signer != desc.Broadcaster {
+		return nil, fmt.Errorf("signed by %s, not by broadcaster %s", signer, desc.Broadcaster)
+	}
+	if desc.StreamID == 0 || desc.Topic != ns.StreamTopic(desc.StreamID) {
+		return nil, fmt.Errorf("stream %08x is not on its own topic", desc.StreamID)
+	}
+	return &desc, nil
+}
+
+// directoryEntry is the latest announcement of a stream and when it arrived.
+type directoryEntry struct {
+	desc StreamDescriptor
+	seen time.Time
+}
+
+// Directory keeps the live streams announced on a namespace's directory
+// topic.
+type Directory struct {
+	namespace Namespace
+	ps        *pubsub.PubSub
+	topic     *pubsub.Topic
+	sub       *pubsub.Subscription
+	logger    *logrus.Logger
+	ctx       context.Context
+	mu        sync.Mutex
+	streams   map[uint32]*directoryEntry
+	onChange  func() // guarded by mu
+}
+
+// NewDirectory joins the directory topic of ns and starts collecting
+// announcements. With trusted broadcasters given, only their streams are
+// listed. Announcements that do not verify are dropped by the topic
+// validator and never forwarded.
+func NewDirectory(ctx context.Context, ps *pubsub.PubSub, ns Namespace, trusted []peer.ID) (*Directory, error) {
+	name := ns.DirectoryTopic()
+	if err := ps.RegisterTopicValidator(name, announcementValidator(ns, trusted)); err != nil {
+		return nil, fmt.Errorf("failed to register directory validator: %w", err)
+	}
+	topic, err := ps.Join(name)
+	if err != nil {
+		ps.UnregisterTopicValidator(name)
+		return nil, fmt.Errorf("failed to join directory topic: %w", err)
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		ps.UnregisterTopicValidator(name)
+		return nil, fmt.Errorf("failed to subscribe to directory topic: %w", err)
+	}
+
+	d := &Directory{
+		namespace: ns,
+		ps:        ps,
+		topic:     topic,
+		sub:       sub,
+		logger:    logrus.New(),
+		ctx:       ctx,
+		streams:   make(map[uint32]*directoryEntry),
+	}
+	go d.receiveLoop()
+	go d.expireLoop()
+	return d, nil
+}
+
+func (d *Directory) receiveLoop() {
+	for {
+		msg, err := d.sub.Next(d.ctx)
+		if err != nil {
+			return
+		}
+		// Verified by the topic validator
+		desc, ok := msg.ValidatorData.(*StreamDescriptor)
+		if !ok {
+			continue
+		}
+		if d.update(desc) {
+			d.changed()
+		}
+	}
+}
+
+// update records an announcement and reports whether the list of live
+// streams changed. An ended stream is kept until it expires, so that a
+// replayed announcement cannot bring it back.
+func (d *Directory) update(desc *StreamDescriptor) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.streams[desc.StreamID]
+	if ok {
+		if entry.desc.Broadcaster != desc.Broadcaster {
+			d.logger.Warnf("Ignoring stream %08x from %s: already announced by %s",
+				desc.StreamID, desc.Broadcaster, entry.desc.Broadcaster)
+			return false
+		}
+		if !desc.IssuedAt.After(entry.desc.IssuedAt) || entry.desc.Ended {
+			return false
+		}
+	}
+
+	changed := !ok || desc.Ended || !sameListing(&entry.desc, desc)
+	d.streams[desc.StreamID] = &directoryEntry{desc: *desc, seen: time.Now()}
+	if !ok {
+		d.logger.Infof("Found stream %08x: %q from %s", desc.StreamID, desc.Title, desc.ChurchName)
+	} else if desc.Ended {
+		d.logger.Infof("Stream %08x ended", desc.StreamID)
+	}
+	return changed
+}
+
+// sameListing reports whether two announcements of a stream would be listed
+// the same way.
+func sameListing(a, b *StreamDescriptor) bool {
+	if a.Title != b.Title || a.ChurchName != b.ChurchName || len(a.Renditions) != len(b.Renditions) {
+		return false
+	}
+	for i := range a.Renditions {
+		if a.Renditions[i] != b.Renditions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// expireLoop drops the streams that are no longer announced.
+func (d *Directory) expireLoop() {
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			if d.expire(time.Now()) {
+				d.changed()
+			}
+		}
+	}
+}
+
+func (d *Directory) expire(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changed := false
+	for id, entry := range d.streams {
+		if now.Sub(entry.seen) < announceExpiry {
+			continue
+		}
+		delete(d.streams, id)
+		if !entry.desc.Ended {
+			d.logger.Infof("Stream %08x is no longer announced", id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// List returns the live streams, most recently started first.
+func (d *Directory) List() []StreamDescriptor {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	streams := make([]StreamDescriptor, 0, len(d.streams))
+	for _, entry := range d.streams {
+		if !entry.desc.Ended {
+			streams = append(streams, entry.desc)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].StartedAt.After(streams[j].StartedAt)
+	})
+	return streams
+}
+
+// Get returns a live stream by ID.
+func (d *Directory) Get(streamID uint32) (StreamDescriptor, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.streams[streamID]
+	if !ok || entry.desc.Ended {
+		return StreamDescriptor{}, false
+	}
+	return entry.desc, true
+}
+
+// SetOnChange sets a callback for when a stream starts, ends or changes its
+// listing. It is called from the directory's goroutines.
+func (d *Directory) SetOnChange(callback func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onChange = callback
+}
+
+// changed calls the change callback, without mu held so that it can list
+// the streams.
+func (d *Directory) changed() {
+	d.mu.Lock()
+	onChange := d.onChange
+	d.mu.Unlock()
+
+	if onChange != nil {
+		onChange()
+	}
+}
+
+// Close stops collecting announcements.
+func (d *Directory) Close() {
+	d.sub.Cancel()
+	d.topic.Close()
+	d.ps.UnregisterTopicValidator(d.namespace.DirectoryTopic())
+}
@@ -0,0 +1,266 @@
+package streaming
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A private stream's payloads are sealed with XChaCha20-Poly1305 before
+// chunking. The frame header stays in the clear, so that relays, the GOP
+// cache and the jitter buffer work unchanged, but it is authenticated along
+// with the payload. Each stream has its own keys, derived from the
+// congregation's shared secret, the stream ID and a key epoch; the
+// broadcaster moves to the next epoch every rotation interval, and viewers
+// derive the key of whichever epoch a frame names.
+//
+// Rotation limits how much is sealed under one key, but it gives no
+// forward secrecy: every epoch's key follows from the shared secret, so
+// whoever learns the secret can decrypt recorded streams of any epoch.
+// Revoking access means changing the secret and restarting the broadcaster
+// and viewers with it. A sealed payload is:
+//
+//	0  key epoch   uint32
+//	4  nonce       24 bytes
+//	28 ciphertext  payload followed by a 16-byte tag
+const (
+	sealedEpochSize = 4
+	sealedOverhead  = sealedEpochSize + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+	// Shortest secret accepted from a key file
+	minKeyFileSecret = 32
+
+	// Passphrases are stretched with Argon2id so that a captured stream
+	// cannot cheaply be tried against a dictionary
+	argonTime    = 1
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+
+	defaultKeyRotation = 10 * time.Minute
+
+	// Stream keys a viewer keeps, covering a few epochs of a few streams
+	maxOpenKeys = 16
+)
+
+var (
+	// ErrNoKey means a stream is encrypted but no key is configured.
+	ErrNoKey = errors.New("stream is encrypted and no key is configured")
+	// ErrWrongKey means a stream's frames do not decrypt with the
+	// configured key.
+	ErrWrongKey = errors.New("wrong stream key")
+	// ErrUnencrypted means a frame of an encrypted stream arrived in the
+	// clear.
+	ErrUnencrypted = errors.New("unencrypted frame on an encrypted stream")
+)
+
+// StreamKey is the congregation's shared secret, from which the keys of
+// every stream are derived.
+type StreamKey struct {
+	secret []byte
+}
+
+// LoadStreamKey reads the key from the key file or stretches the
+// passphrase, salted with the namespace so that the same passphrase gives
+// different keys under different discovery keys. It returns nil if neither
+// is configured.
+func LoadStreamKey(cfg *config.SecurityConfig, ns Namespace) (*StreamKey, error) {
+	switch {
+	case cfg.KeyFile != "":
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		secret := []byte(strings.TrimSpace(string(data)))
+		if decoded, err := hex.DecodeString(string(secret)); err == nil {
+			secret = decoded
+		}
+		if len(secret) < minKeyFileSecret {
+			return nil, fmt.Errorf("key file %s holds %d bytes, need at least %d", cfg.KeyFile, len(secret), minKeyFileSecret)
+		}
+		return &StreamKey{secret: secret}, nil
+	case cfg.Passphrase != "":
+		salt := []byte("meshlink-stream-key:" + ns.id)
+		secret := argon2.IDKey([]byte(cfg.Passphrase), salt, argonTime, argonMemory, argonThreads, chacha20poly1305.KeySize)
+		return &StreamKey{secret: secret}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// streamCipher derives the AEAD of a stream's key epoch.
+func (k *StreamKey) streamCipher(streamID uint32, epoch uint32) (cipher.AEAD, error) {
+	var info [8]byte
+	binary.BigEndian.PutUint32(info[0:4], streamID)
+	binary.BigEndian.PutUint32(info[4:8], epoch)
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, k.secret, []byte("meshlink-stream-key"), info[:])
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// frameAAD returns the header fields authenticated with a sealed payload.
+// The payload length and checksum are left out, as they cover the
+// ciphertext.
+func frameAAD(h *media.FrameHeader) []byte {
+	aad := make([]byte, 0, 30)
+	aad = append(aad, h.Flags)
+	aad = binary.BigEndian.AppendUint32(aad, h.StreamID)
+	aad = binary.BigEndian.AppendUint64(aad, h.FrameID)
+	aad = binary.BigEndian.AppendUint64(aad, h.PTS)
+	aad = binary.BigEndian.AppendUint64(aad, h.DTS)
+	return append(aad, byte(h.Codec))
+}
+
+// frameSealer encrypts a broadcaster's frames, moving to a new key epoch
+// every rotation interval.
+type frameSealer struct {
+	key      *StreamKey
+	streamID uint32
+	rotation time.Duration
+
+	mu        sync.Mutex
+	epoch     uint32
+	aead      cipher.AEAD
+	rotatedAt time.Time
+}
+
+func newFrameSealer(key *StreamKey, streamID uint32, rotation time.Duration) (*frameSealer, error) {
+	if rotation <= 0 {
+		rotation = defaultKeyRotation
+	}
+	aead, err := key.streamCipher(streamID, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive stream key: %w", err)
+	}
+	return &frameSealer{
+		key:       key,
+		streamID:  streamID,
+		rotation:  rotation,
+		aead:      aead,
+		rotatedAt: time.Now(),
+	}, nil
+}
+
+// Seal encrypts the payload and returns the frame in wire format, marked
+// as encrypted.
+func (s *frameSealer) Seal(h *media.FrameHeader, payload []byte) ([]byte, error) {
+	s.mu.Lock()
+	if time.Since(s.rotatedAt) >= s.rotation {
+		if err := s.rotateLocked(); err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+	}
+	epoch, aead := s.epoch, s.aead
+	s.mu.Unlock()
+
+	h.Flags |= media.FlagEncrypted
+	sealed := make([]byte, sealedEpochSize+chacha20poly1305.NonceSizeX, sealedOverhead+len(payload))
+	binary.BigEndian.PutUint32(sealed, epoch)
+	nonce := sealed[sealedEpochSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed = aead.Seal(sealed, nonce, payload, frameAAD(h))
+	return media.MarshalFrame(h, sealed), nil
+}
+
+// Rotate moves to the next key epoch at once. The new key is derived from
+// the same secret, so it does not lock out anyone who holds it.
+func (s *frameSealer) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotateLocked()
+}
+
+func (s *frameSealer) rotateLocked() error {
+	aead, err := s.key.streamCipher(s.streamID, s.epoch+1)
+	if err != nil {
+		return fmt.Errorf("failed to derive stream key: %w", err)
+	}
+	s.epoch++
+	s.aead = aead
+	s.rotatedAt = time.Now()
+	return nil
+}
+
+// openerKey identifies a derived stream key.
+type openerKey struct {
+	streamID uint32
+	epoch    uint32
+}
+
+// frameOpener decrypts a viewer's frames, deriving the key of each epoch
+// as it first appears.
+type frameOpener struct {
+	key *StreamKey
+
+	mu    sync.Mutex
+	aeads map[openerKey]cipher.AEAD
+}
+
+func newFrameOpener(key *StreamKey) *frameOpener {
+	return &frameOpener{key: key, aeads: make(map[openerKey]cipher.AEAD)}
+}
+
+// Open decrypts an encrypted wire frame and returns it in the clear, as the
+// broadcaster's encoder produced it. It fails with ErrWrongKey if the frame
+// does not authenticate.
+func (o *frameOpener) Open(data []byte) ([]byte, error) {
+	h, sealed, err := media.UnmarshalFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < sealedOverhead {
+		return nil, fmt.Errorf("sealed payload too short: %d bytes", len(sealed))
+	}
+
+	aead, err := o.cipher(openerKey{streamID: h.StreamID, epoch: binary.BigEndian.Uint32(sealed)})
+	if err != nil {
+		return nil, err
+	}
+	nonce := sealed[sealedEpochSize : sealedEpochSize+chacha20poly1305.NonceSizeX]
+	payload, err := aead.Open(nil, nonce, sealed[sealedEpochSize+chacha20poly1305.NonceSizeX:], frameAAD(h))
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+
+	h.Flags &^= media.FlagEncrypted
+	return media.MarshalFrame(h, payload), nil
+}
+
+func (o *frameOpener) cipher(k openerKey) (cipher.AEAD, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if aead, ok := o.aeads[k]; ok {
+		return aead, nil
+	}
+	aead, err := o.key.streamCipher(k.streamID, k.epoch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive stream key: %w", err)
+	}
+	if len(o.aeads) >= maxOpenKeys {
+		o.aeads = make(map[openerKey]cipher.AEAD)
+	}
+	o.aeads[k] = aead
+	return aead, nil
+}
@@ -0,0 +1,39 @@
+package streaming
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/meshlink/church-streaming/internal/media"
+)
+
+func TestDecryptFrameRejectsPlaintextOnEncryptedStream(t *testing.T) {
+	key := &StreamKey{secret: bytes.Repeat([]byte{7}, minKeyFileSecret)}
+	sealer, err := newFrameSealer(key, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := media.FrameHeader{StreamID: 1, FrameID: 3, Codec: media.CodecH264}
+	payload := []byte("payload")
+	plain := media.MarshalFrame(&header, payload)
+	sealed, err := sealer.Seal(&header, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Viewer{opener: newFrameOpener(key)}
+	v.stream.Encrypted = true
+	if _, err := v.decryptFrame(plain); !errors.Is(err, ErrUnencrypted) {
+		t.Errorf("decryptFrame(plaintext) error = %v, want ErrUnencrypted", err)
+	}
+	if got, err := v.decryptFrame(sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("decryptFrame(sealed) = %x, %v, want the plaintext frame", got, err)
+	}
+
+	// Frames of a public stream pass through
+	v.stream.Encrypted = false
+	if got, err := v.decryptFrame(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("decryptFrame(plaintext) on a public stream = %x, %v", got, err)
+	}
+}
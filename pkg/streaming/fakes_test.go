@@ -0,0 +1,238 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// fakeMedia is the name the fakes below are registered under, as a video
+// source, an encoder and a decoder. brokenSource names a video source that
+// fails to start.
+const (
+	fakeMedia    = "fake"
+	brokenSource = "fake-broken"
+)
+
+var registerFakes sync.Once
+
+// useFakeMedia registers the fakes and sets cfg to use them, without audio.
+func useFakeMedia(cfg *config.Config) {
+	registerFakes.Do(func() {
+		media.RegisterVideoSource(fakeMedia, func(*config.MediaConfig) (media.VideoSource, error) {
+			return &fakeVideoSource{}, nil
+		})
+		media.RegisterVideoSource(brokenSource, func(*config.MediaConfig) (media.VideoSource, error) {
+			return &fakeVideoSource{broken: true}, nil
+		})
+		media.RegisterEncoder(fakeMedia, func(cfg media.EncoderConfig) (media.Encoder, error) {
+			return &fakeEncoder{streamID: cfg.StreamID, quality: cfg.Quality}, nil
+		})
+		media.RegisterDecoder(fakeMedia, func() (media.Decoder, error) {
+			return media.NewRawDecoder(), nil
+		})
+	})
+	cfg.Media.VideoSource = fakeMedia
+	cfg.Media.VideoCodec = fakeMedia
+	cfg.Media.AudioSource = "none"
+}
+
+// fakeVideoSource produces a small 640x480 frame every few milliseconds
+// until stopped. Like a camera, it starts again after Stop.
+type fakeVideoSource struct {
+	broken bool // Start fails
+
+	mu     sync.Mutex
+	frames chan media.RawFrame
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func (s *fakeVideoSource) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken {
+		return fmt.Errorf("no camera")
+	}
+	if s.stop != nil {
+		return fmt.Errorf("source already started")
+	}
+	frames, stop, done := make(chan media.RawFrame), make(chan struct{}), make(chan struct{})
+	s.frames, s.stop, s.done = frames, stop, done
+
+	go func() {
+		defer close(done)
+		defer close(frames)
+		ticker := time.NewTicker(2 * time.Millisecond)
+		defer ticker.Stop()
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			select {
+			case frames <- media.RawFrame{Data: []byte(fmt.Sprintf("frame %d", n)), Captured: time.Now()}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *fakeVideoSource) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+func (s *fakeVideoSource) Frames() <-chan media.RawFrame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frames
+}
+
+func (s *fakeVideoSource) GetResolution() (int, int) { return 640, 480 }
+func (s *fakeVideoSource) GetFrameRate() int         { return 500 }
+
+// fakeEncoder turns every frame into a keyframe. Unlike RawEncoder it
+// blocks while its output is full, as an encoder process does when nobody
+// reads its pipe, so a rendition left unpublished stalls capture.
+type fakeEncoder struct {
+	streamID uint32
+	quality  string
+
+	mu      sync.Mutex
+	output  chan *media.EncodedFrame
+	stopped chan struct{}
+	sending sync.WaitGroup
+}
+
+func (e *fakeEncoder) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.output != nil {
+		return fmt.Errorf("encoder already started")
+	}
+	e.output = make(chan *media.EncodedFrame, 4)
+	e.stopped = make(chan struct{})
+	return nil
+}
+
+func (e *fakeEncoder) Stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.output == nil {
+		return
+	}
+	close(e.stopped)
+	e.sending.Wait()
+	close(e.output)
+	e.output = nil
+}
+
+func (e *fakeEncoder) Frames() <-chan *media.EncodedFrame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.output
+}
+
+func (e *fakeEncoder) RequestKeyframe() {}
+
+func (e *fakeEncoder) EncodeFrame(rawData []byte, frameID uint64, pts uint64) error {
+	e.mu.Lock()
+	output, stopped := e.output, e.stopped
+	if output == nil {
+		e.mu.Unlock()
+		return fmt.Errorf("encoder not started")
+	}
+	e.sending.Add(1)
+	e.mu.Unlock()
+	defer e.sending.Done()
+
+	frame := &media.EncodedFrame{
+		Header: media.FrameHeader{
+			Flags:    media.FlagKeyframe,
+			StreamID: e.streamID,
+			FrameID:  frameID,
+			PTS:      pts,
+			DTS:      pts,
+			Codec:    media.CodecRawVideo,
+		},
+		Data: append([]byte(e.quality+" "), rawData...),
+	}
+	select {
+	case output <- frame:
+		return nil
+	case <-stopped:
+		return fmt.Errorf("encoder stopped")
+	}
+}
+
+// newTestPubSub returns gossipsub on a host of a mock network.
+func newTestPubSub(t *testing.T, ctx context.Context) *pubsub.PubSub {
+	t.Helper()
+	mn, err := mocknet.FullMeshConnected(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	ps, err := pubsub.NewGossipSub(ctx, mn.Hosts()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+// newTestHosts returns n connected hosts of a mock network. Their peer IDs
+// embed their keys, so that signed announcements and frames verify.
+func newTestHosts(t *testing.T, n int) []host.Host {
+	t.Helper()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	for i := 0; i < n; i++ {
+		key, _, err := crypto.GenerateEd25519Key(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ma.StringCast(fmt.Sprintf("/ip4/10.0.0.%d/tcp/4001", i+1))
+		if _, err := mn.AddPeer(key, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+	return mn.Hosts()
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,124 @@
+package streaming
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Forward error correction uses XOR parity over groups of consecutive data
+// chunks within a frame. Each group gets one parity chunk, so any single
+// lost chunk per group can be rebuilt without waiting for a retransmission
+// that pubsub cannot provide anyway. Groups never span frames, which keeps
+// recovery free of extra latency.
+//
+// A parity chunk has ChunkFlagParity set, its index is the group number,
+// and its payload is the group size (uint16) followed by the XOR of the
+// group's payloads, each zero-padded to the longest. That makes it
+// parityPrefixSize bytes longer than the longest data chunk of its group, so
+// frames that are protected are split with DataChunker, whose chunks leave
+// room for it.
+const (
+	parityPrefixSize = 2
+	maxFECGroupSize  = 255
+)
+
+// FECEncoder adds parity chunks to a frame's data chunks.
+type FECEncoder struct {
+	groupSize int
+}
+
+// NewFECEncoder creates an encoder that adds roughly ratio parity chunks
+// per data chunk. XOR parity cannot exceed one parity chunk per data chunk,
+// so ratios above 1 are treated as 1. It returns nil when ratio is zero or
+// negative, meaning FEC is off.
+func NewFECEncoder(ratio float64) *FECEncoder {
+	if ratio <= 0 || math.IsNaN(ratio) {
+		return nil
+	}
+	groupSize := int(math.Round(1 / ratio))
+	if groupSize < 1 {
+		groupSize = 1
+	}
+	if groupSize > maxFECGroupSize {
+		groupSize = maxFECGroupSize
+	}
+	return &FECEncoder{groupSize: groupSize}
+}
+
+// DataChunker returns a chunker for frames protected by f, such that both
+// data and parity chunks are at most chunkSize bytes.
+func (f *FECEncoder) DataChunker(chunkSize int) *Chunker {
+	c := NewChunker(chunkSize)
+	c.chunkSize -= parityPrefixSize
+	return c
+}
+
+// GroupSize returns the number of data chunks covered by each parity chunk.
+func (f *FECEncoder) GroupSize() int {
+	return f.groupSize
+}
+
+// Protect returns the data chunks with a parity chunk after each group, in
+// the order they should be sent. The data chunks must come from one call to
+// Split on a chunker from DataChunker.
+func (f *FECEncoder) Protect(chunks [][]byte) ([][]byte, error) {
+	if len(chunks) == 0 {
+		return chunks, nil
+	}
+
+	out := make([][]byte, 0, len(chunks)+(len(chunks)+f.groupSize-1)/f.groupSize)
+	for start := 0; start < len(chunks); start += f.groupSize {
+		group := chunks[start:min(start+f.groupSize, len(chunks))]
+
+		h, _, err := ParseChunk(group[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse chunk for parity: %w", err)
+		}
+		h.Flags |= ChunkFlagParity
+		h.Index = uint16(start / f.groupSize)
+
+		payloads := make([][]byte, len(group))
+		for i, chunk := range group {
+			payloads[i] = chunk[ChunkHeaderSize:]
+		}
+		parity := xorPayloads(payloads)
+
+		chunk := make([]byte, ChunkHeaderSize+parityPrefixSize, ChunkHeaderSize+parityPrefixSize+len(parity))
+		putChunkHeader(chunk, *h)
+		binary.BigEndian.PutUint16(chunk[ChunkHeaderSize:], uint16(f.groupSize))
+
+		out = append(out, group...)
+		out = append(out, append(chunk, parity...))
+	}
+	return out, nil
+}
+
+// parseParity splits a parity payload into the group size and the XOR data.
+func parseParity(payload []byte) (groupSize int, parity []byte, err error) {
+	if len(payload) < parityPrefixSize {
+		return 0, nil, fmt.Errorf("%w: parity payload of %d bytes", ErrChunkMalformed, len(payload))
+	}
+	groupSize = int(binary.BigEndian.Uint16(payload))
+	if groupSize == 0 || groupSize > maxFECGroupSize {
+		return 0, nil, fmt.Errorf("%w: FEC group size %d", ErrChunkMalformed, groupSize)
+	}
+	return groupSize, payload[parityPrefixSize:], nil
+}
+
+// xorPayloads XORs payloads of possibly different lengths, treating shorter
+// ones as zero-padded.
+func xorPayloads(payloads [][]byte) []byte {
+	var size int
+	for _, p := range payloads {
+		size = max(size, len(p))
+	}
+
+	out := make([]byte, size)
+	for _, p := range payloads {
+		for i, b := range p {
+			out[i] ^= b
+		}
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package streaming
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFECRecovery(t *testing.T) {
+	const chunkSize = minChunkSize
+	payloadSize := chunkSize - ChunkHeaderSize - parityPrefixSize
+
+	tests := []struct {
+		name          string
+		frameSize     int
+		ratio         float64
+		drop          []int // data chunk indexes lost
+		wantFrame     bool
+		wantRecovered uint64 // at least
+	}{
+		{"no loss", 8 * payloadSize, 0.25, nil, true, 0},
+		{"one per group", 8 * payloadSize, 0.25, []int{1, 6}, true, 2},
+		{"first and last of a group", 8 * payloadSize, 0.25, []int{0, 7}, true, 2},
+		{"short last chunk", 7*payloadSize + 9, 0.25, []int{7}, true, 1},
+		{"short last chunk in a group of one", 8*payloadSize + 9, 0.25, []int{8}, true, 1},
+		{"short last chunk and another group", 7*payloadSize + 9, 0.25, []int{2, 7}, true, 2},
+		{"single short chunk", 9, 1, []int{0}, true, 1},
+		{"parity every chunk", 4 * payloadSize, 1, []int{0, 1, 2, 3}, true, 4},
+		{"two in one group", 8 * payloadSize, 0.25, []int{4, 5}, false, 0},
+		{"short last chunk and its neighbour", 7*payloadSize + 9, 0.25, []int{6, 7}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := testFrame(tt.frameSize)
+			fec := NewFECEncoder(tt.ratio)
+			chunks, err := fec.DataChunker(chunkSize).Split(5, 99, frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			protected, err := fec.Protect(chunks)
+			if err != nil {
+				t.Fatalf("Protect() error = %v", err)
+			}
+
+			dropped := make(map[int]bool)
+			for _, i := range tt.drop {
+				dropped[i] = true
+			}
+			var sent [][]byte
+			for _, chunk := range protected {
+				h, _, err := ParseChunk(chunk)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !h.IsParity() && dropped[int(h.Index)] {
+					continue
+				}
+				sent = append(sent, chunk)
+			}
+
+			// Parity may arrive before or after the rest of its group
+			for seed := int64(0); seed < 5; seed++ {
+				r := NewReassembler(time.Second)
+				frames := reassemble(t, r, shuffled(sent, seed), time.Unix(0, 0))
+				if !tt.wantFrame {
+					if len(frames) != 0 {
+						t.Fatalf("seed %d: reassembled a frame that could not be recovered", seed)
+					}
+					continue
+				}
+				if len(frames) != 1 || !bytes.Equal(frames[0], frame) {
+					t.Fatalf("seed %d: reassembled %d frames, want the original", seed, len(frames))
+				}
+				// Parity arriving early also rebuilds chunks still on their way
+				if recovered, _ := r.GetFECStats(); recovered < tt.wantRecovered {
+					t.Errorf("seed %d: recovered %d chunks, want at least %d", seed, recovered, tt.wantRecovered)
+				}
+			}
+		})
+	}
+}
+
+// Parity chunks stay within the chunk size, like the data chunks they
+// cover, for full, short and single-chunk groups.
+func TestFECParityWithinChunkSize(t *testing.T) {
+	for _, chunkSize := range []int{0, minChunkSize, 200, DefaultChunkSize} {
+		limit := chunkSize
+		if limit == 0 {
+			limit = DefaultChunkSize
+		}
+		for _, frameSize := range []int{1, limit, 10 * limit, 10*limit + 7} {
+			for _, ratio := range []float64{1, 0.25} {
+				fec := NewFECEncoder(ratio)
+				chunks, err := fec.DataChunker(chunkSize).Split(5, 99, testFrame(frameSize))
+				if err != nil {
+					t.Fatal(err)
+				}
+				protected, err := fec.Protect(chunks)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, chunk := range protected {
+					if len(chunk) > limit {
+						h, _, _ := ParseChunk(chunk)
+						t.Fatalf("chunk size %d, frame of %d bytes: chunk %+v is %d bytes", chunkSize, frameSize, h, len(chunk))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFECGroupSize(t *testing.T) {
+	tests := []struct {
+		ratio float64
+		want  int // zero for FEC off
+	}{
+		{0, 0},
+		{-1, 0},
+		{0.25, 4},
+		{0.2, 5},
+		{1, 1},
+		{3, 1},
+		{0.0001, maxFECGroupSize},
+	}
+	for _, tt := range tests {
+		f := NewFECEncoder(tt.ratio)
+		var got int
+		if f != nil {
+			got = f.GroupSize()
+		}
+		if got != tt.want {
+			t.Errorf("NewFECEncoder(%v) group size = %d, want %d", tt.ratio, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package streaming
+
+import (
+	"sync"
+
+	"github.com/meshlink/church-streaming/internal/media"
+)
+
+const (
+	// A GOP longer than this is not worth caching; a viewer is better off
+	// asking for a fresh keyframe.
+	maxGOPFrames = 600
+	maxGOPBytes  = 32 << 20
+)
+
+// GOPCache keeps the video frames since the most recent keyframe, so that a
+// viewer joining mid-stream can be sent a decodable starting point at once.
+type GOPCache struct {
+	mu     sync.RWMutex
+	frames [][]byte
+	size   int
+}
+
+func NewGOPCache() *GOPCache {
+	return &GOPCache{}
+}
+
+// Add records a marshaled wire frame. A keyframe starts a new GOP; frames
+// before the first keyframe are ignored since nothing could decode them.
+func (c *GOPCache) Add(header *media.FrameHeader, frame []byte) {
+	if header.Codec.IsAudio() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if header.IsKeyframe() {
+		c.frames = c.frames[:0:0]
+		c.size = 0
+	} else if len(c.frames) == 0 {
+		return
+	}
+
+	if len(c.frames) >= maxGOPFrames || c.size+len(frame) > maxGOPBytes {
+		c.frames = nil
+		c.size = 0
+		return
+	}
+	c.frames = append(c.frames, frame)
+	c.size += len(frame)
+}
+
+// Snapshot returns the cached GOP, keyframe first. The frames must not be
+// modified.
+func (c *GOPCache) Snapshot() [][]byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([][]byte(nil), c.frames...)
+}
+
+// Reset empties the cache, for example when the stream restarts.
+func (c *GOPCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames = nil
+	c.size = 0
+}
@@ -0,0 +1,575 @@
+package streaming
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPlayoutDelay    = 200 * time.Millisecond
+	defaultMaxPlayoutDelay = 2 * time.Second
+
+	// A frame that misses its presentation time by more than this is
+	// dropped rather than shown out of sync. Audio gets less slack since a
+	// late packet would overlap the next one.
+	maxVideoLateness = 100 * time.Millisecond
+	maxAudioLateness = 40 * time.Millisecond
+
+	// The buffer measures jitter over each window. It grows at once when
+	// frames arrive late and shrinks by at most shrinkStep per window once
+	// the network settles.
+	jitterWindow = 2 * time.Second
+	shrinkStep   = 20 * time.Millisecond
+	depthMargin  = 20 * time.Millisecond
+
+	// For this many windows after anchoring, the timeline follows the
+	// fastest transit outright rather than by driftStep
+	anchorWindows = 2
+
+	// Drift between the broadcaster's clock and ours is corrected by at most
+	// driftStep per window, which is far below what anyone can see or hear.
+	driftStep = 5 * time.Millisecond
+
+	// A timestamp jump larger than this means the broadcast restarted
+	maxTimestampJump = 5 * time.Second
+
+	// Frame IDs missing for longer than the buffer depth are counted lost.
+	// Larger gaps are counted at once rather than tracked one by one.
+	maxTrackedMissing = 1024
+)
+
+// JitterStats describes what the jitter buffer has done since it started.
+type JitterStats struct {
+	Presented uint64 // frames handed to the callbacks
+	Late      uint64 // frames dropped for missing their presentation time
+	Reordered uint64 // frames that arrived after a later frame
+	Lost      uint64 // frame IDs that never arrived
+
+	Depth      time.Duration // current target latency
+	Jitter     time.Duration // interarrival jitter estimate (RFC 3550)
+	Correction time.Duration // total adjustment made to follow clock drift
+}
+
+// JitterBuffer holds decoded frames for a target latency and releases them
+// in presentation order at the local time that matches their media clock
+// PTS, so that audio and video stamped by the same broadcaster clock come
+// out together.
+//
+// The timeline is anchored on the first frame. Each frame's transit time
+// (arrival minus PTS) is compared with the fastest transit seen; the spread
+// between them is the jitter the buffer has to absorb, and its depth adapts
+// to cover it between the configured playout delay and maximum. Over the
+// first few windows the timeline moves to the fastest transit at once, so
+// that a first frame that arrived late, typically a large keyframe, does
+// not hold every later frame back by as much. After that the fastest
+// transit only moves slowly, as the two clocks drift apart.
+type JitterBuffer struct {
+	minDelay time.Duration
+	maxDelay time.Duration
+	lipSync  time.Duration
+	onVideo  func(*media.DecodedFrame)
+	onAudio  func(*media.DecodedFrame)
+	onGap    func(lost int)
+	logger   *logrus.Logger
+	now      func() time.Time // time.Now, but for tests
+
+	mu       sync.Mutex
+	queue    jitterQueue
+	running  bool
+	wake     chan struct{}
+	stopChan chan struct{}
+	done     chan struct{}
+
+	// A frame is due at epoch + refTransit + depth + PTS, plus the lip-sync
+	// offset for its medium
+	epoch      time.Time
+	refTransit time.Duration
+	depth      time.Duration
+	anchored   bool
+	settling   int // windows left in which refTransit follows the fastest transit
+	streamID   uint32
+	lastPTS    uint64
+
+	windowStart time.Time
+	windowMin   time.Duration
+	windowMax   time.Duration
+	lastTransit [2]time.Duration
+	hasTransit  [2]bool
+	jitter      float64
+
+	// Presentation order and gap tracking
+	presentedPTS [2]uint64
+	presented    [2]bool
+	highestID    uint64
+	hasHighest   bool
+	missing      map[uint64]time.Time
+
+	stats JitterStats
+}
+
+// NewJitterBuffer creates a buffer that hands video and audio frames to the
+// given callbacks at presentation time.
+func NewJitterBuffer(onVideo, onAudio func(*media.DecodedFrame)) *JitterBuffer {
+	return &JitterBuffer{
+		minDelay: defaultPlayoutDelay,
+		maxDelay: defaultMaxPlayoutDelay,
+		onVideo:  onVideo,
+		onAudio:  onAudio,
+		logger:   logrus.New(),
+		now:      time.Now,
+	}
+}
+
+// NewJitterBufferWithConfig applies the configured target latency, its
+// upper bound and the lip-sync offset.
+func NewJitterBufferWithConfig(cfg *config.MediaConfig, onVideo, onAudio func(*media.DecodedFrame)) *JitterBuffer {
+	j := NewJitterBuffer(onVideo, onAudio)
+	if cfg != nil {
+		if cfg.PlayoutDelay > 0 {
+			j.minDelay = time.Duration(cfg.PlayoutDelay) * time.Millisecond
+		}
+		if cfg.MaxPlayoutDelay > 0 {
+			j.maxDelay = time.Duration(cfg.MaxPlayoutDelay) * time.Millisecond
+		}
+		if j.maxDelay < j.minDelay {
+			j.maxDelay = j.minDelay
+		}
+		j.lipSync = time.Duration(cfg.LipSyncOffset) * time.Millisecond
+	}
+	return j
+}
+
+// SetOnGap sets a callback for frames that never arrived. It is called
+// without the buffer's lock held, once the missing frames can no longer be
+// presented.
+func (j *JitterBuffer) SetOnGap(callback func(lost int)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.onGap = callback
+}
+
+// SetLipSyncOffset changes the lip-sync offset. A positive offset delays
+// video relative to audio, a negative one delays audio.
+func (j *JitterBuffer) SetLipSyncOffset(offset time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.lipSync = offset
+}
+
+func (j *JitterBuffer) GetLipSyncOffset() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lipSync
+}
+
+func (j *JitterBuffer) Start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.running {
+		return
+	}
+	j.queue = nil
+	j.anchored = false
+	j.stats = JitterStats{}
+	j.wake = make(chan struct{}, 1)
+	j.stopChan = make(chan struct{})
+	j.done = make(chan struct{})
+	j.running = true
+
+	go j.run(j.wake, j.stopChan, j.done)
+}
+
+// Stop discards buffered frames and waits for the buffer to exit.
+func (j *JitterBuffer) Stop() {
+	j.mu.Lock()
+	if !j.running {
+		j.mu.Unlock()
+		return
+	}
+	j.running = false
+	close(j.stopChan)
+	done := j.done
+	j.queue = nil
+	j.mu.Unlock()
+
+	<-done
+}
+
+// Push adds a frame to the buffer. Frames may arrive in any order.
+func (j *JitterBuffer) Push(frame *media.DecodedFrame) {
+	now := j.now()
+
+	j.mu.Lock()
+	if !j.running {
+		j.mu.Unlock()
+		return
+	}
+
+	pts := frame.GetPTS()
+	if !j.anchored || frame.GetStreamID() != j.streamID || ptsDistance(pts, j.lastPTS) > maxTimestampJump {
+		j.anchor(now, frame)
+	}
+	j.lastPTS = pts
+
+	j.trackSequence(now, frame.GetFrameID())
+	lost := j.sweepMissing(now)
+	onGap := j.onGap
+
+	late := j.measure(now, frame)
+	if late {
+		j.stats.Late++
+	} else {
+		heap.Push(&j.queue, &jitterItem{frame: frame, due: j.dueTime(frame)})
+	}
+	wake := j.wake
+	j.mu.Unlock()
+
+	if lost > 0 && onGap != nil {
+		onGap(lost)
+	}
+	if !late {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Skip tells the buffer that a frame arrived but will not be pushed, for
+// example audio on a viewer without an audio decoder, so that it is not
+// counted as lost.
+func (j *JitterBuffer) Skip(frameID uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.running && j.anchored {
+		j.trackSequence(j.now(), frameID)
+	}
+}
+
+// Resync prepares the buffer for frames from another rendition of the same
+// stream. Queued video from pts on is dropped, since the new rendition
+// delivers it again, and gap tracking restarts on the new frame sequence.
+// The timeline is kept, so playout carries on without a jump.
+func (j *JitterBuffer) Resync(pts uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	kept := j.queue[:0]
+	for _, item := range j.queue {
+		if mediumOf(item.frame) == videoMedium && item.frame.GetPTS() >= pts {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	for i := len(kept); i < len(j.queue); i++ {
+		j.queue[i] = nil
+	}
+	j.queue = kept
+	heap.Init(&j.queue)
+
+	j.hasHighest = false
+	j.missing = make(map[uint64]time.Time)
+}
+
+// GetStats returns a snapshot of the buffer's counters and current depth.
+func (j *JitterBuffer) GetStats() JitterStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stats := j.stats
+	stats.Depth = j.depth
+	stats.Jitter = time.Duration(j.jitter)
+	return stats
+}
+
+// anchor starts a new timeline with frame arriving at the fastest transit
+// seen so far. Called with mu held.
+func (j *JitterBuffer) anchor(now time.Time, frame *media.DecodedFrame) {
+	if j.anchored {
+		j.logger.Infof("Stream timeline restarted (stream %08x, PTS %d), re-anchoring playout", frame.GetStreamID(), frame.GetPTS())
+	}
+	j.epoch = now.Add(-media.PTSToDuration(frame.GetPTS()))
+	j.refTransit = 0
+	j.depth = j.minDelay
+	j.anchored = true
+	j.settling = anchorWindows
+	j.streamID = frame.GetStreamID()
+
+	j.windowStart = now
+	j.windowMin = math.MaxInt64
+	j.windowMax = math.MinInt64
+	j.hasTransit = [2]bool{}
+	j.jitter = 0
+
+	j.presented = [2]bool{}
+	j.hasHighest = false
+	j.missing = make(map[uint64]time.Time)
+}
+
+// measure records the frame's transit time, adapts the depth and reports
+// whether the frame arrived too late to be presented. Called with mu held.
+func (j *JitterBuffer) measure(now time.Time, frame *media.DecodedFrame) bool {
+	transit := now.Sub(j.epoch) - media.PTSToDuration(frame.GetPTS())
+	medium := mediumOf(frame)
+
+	// RFC 3550 interarrival jitter, per medium since audio and video pass
+	// through encoders with different latency
+	if j.hasTransit[medium] {
+		d := float64(transit - j.lastTransit[medium])
+		j.jitter += (math.Abs(d) - j.jitter) / 16
+	}
+	j.lastTransit[medium] = transit
+	j.hasTransit[medium] = true
+
+	if j.settling > 0 && transit < j.refTransit {
+		// The frame the timeline was anchored on arrived late
+		j.refTransit = transit
+		j.retime()
+	}
+
+	j.windowMin = min(j.windowMin, transit)
+	j.windowMax = max(j.windowMax, transit)
+	if now.Sub(j.windowStart) >= jitterWindow {
+		j.endWindow(now)
+	}
+
+	lateness := now.Sub(j.dueTime(frame))
+	if lateness <= 0 {
+		return false
+	}
+
+	// Grow at once so that the frames behind this one make it
+	j.setDepth(transit - j.refTransit + depthMargin)
+
+	limit := maxVideoLateness
+	if medium == audioMedium {
+		limit = maxAudioLateness
+	}
+	return lateness > limit
+}
+
+// endWindow follows clock drift and lets the depth shrink once the spread of
+// transit times allows it. Called with mu held.
+func (j *JitterBuffer) endWindow(now time.Time) {
+	if j.settling > 0 {
+		j.settling--
+	}
+
+	step := j.windowMin - j.refTransit
+	step = max(-driftStep, min(driftStep, step))
+	j.refTransit += step
+	j.stats.Correction += step
+
+	if want := j.windowMax - j.refTransit + depthMargin; want < j.depth {
+		j.setDepth(max(want, j.depth-shrinkStep))
+	} else {
+		j.setDepth(want)
+	}
+
+	j.windowStart = now
+	j.windowMin = math.MaxInt64
+	j.windowMax = math.MinInt64
+}
+
+// retime moves the queued frames to the current timeline. Called with mu
+// held.
+func (j *JitterBuffer) retime() {
+	for _, item := range j.queue {
+		item.due = j.dueTime(item.frame)
+	}
+	heap.Init(&j.queue)
+}
+
+func (j *JitterBuffer) setDepth(depth time.Duration) {
+	j.depth = max(j.minDelay, min(j.maxDelay, depth))
+}
+
+// trackSequence notes gaps and late arrivals in the broadcaster's frame
+// sequence. Called with mu held.
+func (j *JitterBuffer) trackSequence(now time.Time, frameID uint64) {
+	if !j.hasHighest {
+		j.highestID = frameID
+		j.hasHighest = true
+		return
+	}
+
+	switch {
+	case frameID > j.highestID:
+		gap := frameID - j.highestID - 1
+		if gap > maxTrackedMissing || len(j.missing)+int(gap) > maxTrackedMissing {
+			j.stats.Lost += gap
+		} else {
+			for id := j.highestID + 1; id < frameID; id++ {
+				j.missing[id] = now
+			}
+		}
+		j.highestID = frameID
+	case frameID < j.highestID:
+		if _, ok := j.missing[frameID]; ok {
+			delete(j.missing, frameID)
+			j.stats.Reordered++
+		}
+	}
+}
+
+// sweepMissing counts frames missing for longer than the buffer depth as
+// lost and returns how many were lost this time. Called with mu held.
+func (j *JitterBuffer) sweepMissing(now time.Time) int {
+	var lost int
+	for id, since := range j.missing {
+		if now.Sub(since) > j.depth {
+			delete(j.missing, id)
+			lost++
+		}
+	}
+	j.stats.Lost += uint64(lost)
+	return lost
+}
+
+// dueTime places the frame on the local timeline, applying the lip-sync
+// offset. Called with mu held.
+func (j *JitterBuffer) dueTime(frame *media.DecodedFrame) time.Time {
+	due := j.epoch.Add(j.refTransit + j.depth + media.PTSToDuration(frame.GetPTS()))
+	isAudio := mediumOf(frame) == audioMedium
+	if j.lipSync > 0 && !isAudio {
+		due = due.Add(j.lipSync)
+	} else if j.lipSync < 0 && isAudio {
+		due = due.Add(-j.lipSync)
+	}
+	return due
+}
+
+func (j *JitterBuffer) run(wake chan struct{}, stopChan chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		j.mu.Lock()
+		now := j.now()
+		if item, present := j.popDue(now); item != nil {
+			j.mu.Unlock()
+			if present {
+				j.present(item.frame)
+			}
+			continue
+		}
+		// Retiming changes due times under mu
+		wait := time.Hour
+		if len(j.queue) > 0 {
+			wait = j.queue[0].due.Sub(now)
+		}
+		j.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-stopChan:
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// popDue takes the next frame off the queue if it is due by now, and
+// reports whether it is to be presented. It returns nil if no frame is due.
+// Called with mu held.
+func (j *JitterBuffer) popDue(now time.Time) (*jitterItem, bool) {
+	if len(j.queue) == 0 || j.queue[0].due.After(now) {
+		return nil, false
+	}
+	item := heap.Pop(&j.queue).(*jitterItem)
+	return item, j.inOrder(item.frame)
+}
+
+// inOrder reports whether the frame can still be presented without going
+// back in time for its medium, which happens when it was queued after the
+// depth shrank or the lip-sync offset changed. Called with mu held.
+func (j *JitterBuffer) inOrder(frame *media.DecodedFrame) bool {
+	medium := mediumOf(frame)
+	pts := frame.GetPTS()
+	if j.presented[medium] && pts < j.presentedPTS[medium] {
+		j.stats.Late++
+		return false
+	}
+	j.presentedPTS[medium] = pts
+	j.presented[medium] = true
+	j.stats.Presented++
+	return true
+}
+
+func (j *JitterBuffer) present(frame *media.DecodedFrame) {
+	if mediumOf(frame) == audioMedium {
+		if j.onAudio != nil {
+			j.onAudio(frame)
+		}
+		return
+	}
+	if j.onVideo != nil {
+		j.onVideo(frame)
+	}
+}
+
+const (
+	videoMedium = 0
+	audioMedium = 1
+)
+
+func mediumOf(frame *media.DecodedFrame) int {
+	if frame.GetCodec().IsAudio() {
+		return audioMedium
+	}
+	return videoMedium
+}
+
+func ptsDistance(a, b uint64) time.Duration {
+	if a > b {
+		return media.PTSToDuration(a - b)
+	}
+	return media.PTSToDuration(b - a)
+}
+
+type jitterItem struct {
+	frame *media.DecodedFrame
+	due   time.Time
+}
+
+// jitterQueue is a min-heap ordered by due time, then frame ID.
+type jitterQueue []*jitterItem
+
+func (q jitterQueue) Len() int { return len(q) }
+
+func (q jitterQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].frame.GetFrameID() < q[j].frame.GetFrameID()
+	}
+	return q[i].due.Before(q[j].due)
+}
+
+func (q jitterQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *jitterQueue) Push(x any) { *q = append(*q, x.(*jitterItem)) }
+
+func (q *jitterQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
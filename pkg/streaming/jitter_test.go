@@ -0,0 +1,330 @@
+package streaming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
+)
+
+func testVideoFrame(frameID uint64, pts time.Duration) *media.DecodedFrame {
+	return &media.DecodedFrame{Header: media.FrameHeader{
+		StreamID: 1,
+		FrameID:  frameID,
+		PTS:      media.DurationToPTS(pts),
+		Codec:    media.CodecH264,
+	}}
+}
+
+// A first frame that arrives late must not delay the frames after it.
+func TestJitterBufferReanchorsOnLateFirstFrame(t *testing.T) {
+	const (
+		delay     = 50 * time.Millisecond
+		keyLate   = 400 * time.Millisecond
+		tolerance = 60 * time.Millisecond
+	)
+	presented := make(chan time.Time, 16)
+	j := NewJitterBufferWithConfig(&config.MediaConfig{PlayoutDelay: int(delay / time.Millisecond)},
+		func(*media.DecodedFrame) { presented <- time.Now() }, nil)
+	j.Start()
+	defer j.Stop()
+
+	// The keyframe with PTS 0 arrives together with the frame captured
+	// keyLate after it
+	start := time.Now()
+	j.Push(testVideoFrame(0, 0))
+	j.Push(testVideoFrame(1, keyLate))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case at := <-presented:
+			if waited := at.Sub(start); waited > delay+tolerance {
+				t.Errorf("frame %d presented after %s, want about %s", i, waited, delay)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame %d never presented", i)
+		}
+	}
+	if stats := j.GetStats(); stats.Late != 0 || stats.Presented != 2 {
+		t.Errorf("GetStats() = %+v, want both frames presented", stats)
+	}
+}
+
+func testAudioFrame(frameID uint64, pts time.Duration) *media.DecodedFrame {
+	frame := testVideoFrame(frameID, pts)
+	frame.Header.Codec = media.CodecAAC
+	return frame
+}
+
+// testJitterBuffer is a running jitter buffer without its playout
+// goroutine, on a clock that only moves when the test sets it.
+type testJitterBuffer struct {
+	*JitterBuffer
+	start time.Time
+	at    time.Time
+}
+
+func newTestJitterBuffer(cfg *config.MediaConfig) *testJitterBuffer {
+	start := time.Unix(1_000_000, 0)
+	tj := &testJitterBuffer{JitterBuffer: NewJitterBufferWithConfig(cfg, nil, nil), start: start, at: start}
+	tj.now = func() time.Time { return tj.at }
+	tj.running = true
+	tj.wake = make(chan struct{}, 1)
+	return tj
+}
+
+// pushAt pushes a frame arriving at offset from the start.
+func (tj *testJitterBuffer) pushAt(offset time.Duration, frame *media.DecodedFrame) {
+	tj.at = tj.start.Add(offset)
+	tj.Push(frame)
+}
+
+// drain returns the IDs of the frames presented by offset from the start,
+// in order.
+func (tj *testJitterBuffer) drain(offset time.Duration) []uint64 {
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	var ids []uint64
+	for {
+		item, present := tj.popDue(tj.start.Add(offset))
+		if item == nil {
+			return ids
+		}
+		if present {
+			ids = append(ids, item.frame.GetFrameID())
+		}
+	}
+}
+
+func (tj *testJitterBuffer) depth() time.Duration {
+	return tj.GetStats().Depth
+}
+
+func TestJitterBufferReorders(t *testing.T) {
+	const frame = 33 * time.Millisecond
+	tests := []struct {
+		name      string
+		arrivals  []uint64 // frame IDs in arrival order, frame n captured at n*frame
+		reordered uint64
+	}{
+		{"in order", []uint64{0, 1, 2, 3}, 0},
+		{"swapped", []uint64{0, 2, 1, 3}, 1},
+		{"reversed tail", []uint64{0, 3, 2, 1}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tj := newTestJitterBuffer(nil)
+			for i, id := range tt.arrivals {
+				tj.pushAt(time.Duration(i)*frame, testVideoFrame(id, time.Duration(id)*frame))
+			}
+			got := tj.drain(time.Minute)
+			for i, id := range got {
+				if id != uint64(i) {
+					t.Fatalf("presented %v, want frames in capture order", got)
+				}
+			}
+			if len(got) != len(tt.arrivals) {
+				t.Fatalf("presented %v, want %d frames", got, len(tt.arrivals))
+			}
+			if stats := tj.GetStats(); stats.Reordered != tt.reordered || stats.Lost != 0 || stats.Late != 0 {
+				t.Errorf("GetStats() = %+v, want %d reordered and nothing lost or late", stats, tt.reordered)
+			}
+		})
+	}
+}
+
+func TestJitterBufferDropsLateFrames(t *testing.T) {
+	const pts = 100 * time.Millisecond
+	tests := []struct {
+		name     string
+		frame    *media.DecodedFrame
+		lateness time.Duration // past the frame's due time at the default depth
+		dropped  bool
+	}{
+		{"video on time", testVideoFrame(1, pts), 0, false},
+		{"video within its slack", testVideoFrame(1, pts), maxVideoLateness - 10*time.Millisecond, false},
+		{"video too late", testVideoFrame(1, pts), maxVideoLateness + 10*time.Millisecond, true},
+		{"audio within its slack", testAudioFrame(1, pts), maxAudioLateness - 10*time.Millisecond, false},
+		{"audio too late", testAudioFrame(1, pts), maxAudioLateness + 10*time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tj := newTestJitterBuffer(nil)
+			tj.pushAt(0, testVideoFrame(0, 0))
+			tj.pushAt(pts+defaultPlayoutDelay+tt.lateness, tt.frame)
+
+			presented := tj.drain(time.Minute)
+			if dropped := len(presented) == 1; dropped != tt.dropped {
+				t.Errorf("presented %v, dropped = %t, want %t", presented, dropped, tt.dropped)
+			}
+			if late := tj.GetStats().Late; (late == 1) != tt.dropped {
+				t.Errorf("Late = %d, dropped = %t", late, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestJitterBufferReportsGaps(t *testing.T) {
+	const frame = 33 * time.Millisecond
+	tests := []struct {
+		name      string
+		skipped   []uint64 // arrived but not pushed
+		straggler bool     // frame 2 arrives after frame 4
+		lost      int
+	}{
+		{"two missing", nil, false, 2},
+		{"one skipped", []uint64{2}, false, 1},
+		{"both skipped", []uint64{2, 3}, false, 0},
+		{"one straggler", nil, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tj := newTestJitterBuffer(nil)
+			var reported int
+			tj.SetOnGap(func(lost int) { reported += lost })
+
+			tj.pushAt(0, testVideoFrame(0, 0))
+			tj.pushAt(frame, testVideoFrame(1, frame))
+			tj.pushAt(4*frame, testVideoFrame(4, 4*frame))
+			for _, id := range tt.skipped {
+				tj.Skip(id)
+			}
+			if tt.straggler {
+				tj.pushAt(5*frame, testVideoFrame(2, 2*frame))
+			}
+			if reported != 0 {
+				t.Fatalf("reported %d lost before the buffer depth passed", reported)
+			}
+
+			// Missing frames count as lost once they are older than the depth
+			tj.pushAt(4*frame+tj.depth()+time.Millisecond, testVideoFrame(5, 5*frame))
+			if reported != tt.lost {
+				t.Errorf("onGap reported %d lost, want %d", reported, tt.lost)
+			}
+			if lost := tj.GetStats().Lost; lost != uint64(tt.lost) {
+				t.Errorf("Lost = %d, want %d", lost, tt.lost)
+			}
+		})
+	}
+}
+
+func TestJitterBufferAdaptsDepth(t *testing.T) {
+	const (
+		minDelay = 100 * time.Millisecond
+		interval = 100 * time.Millisecond
+		spike    = 300 * time.Millisecond
+	)
+	tj := newTestJitterBuffer(&config.MediaConfig{PlayoutDelay: int(minDelay / time.Millisecond), MaxPlayoutDelay: 1000})
+
+	// Frames arrive as they are captured, until one is held up by spike
+	var id uint64
+	push := func(transit time.Duration) {
+		pts := time.Duration(id) * interval
+		tj.pushAt(pts+transit, testVideoFrame(id, pts))
+		id++
+	}
+	for i := 0; i < 5; i++ {
+		push(0)
+	}
+	if got := tj.depth(); got != minDelay {
+		t.Fatalf("depth %s on a steady network, want %s", got, minDelay)
+	}
+	push(spike)
+	if got, want := tj.depth(), spike+depthMargin; got != want {
+		t.Fatalf("depth %s after a %s spike, want %s at once", got, spike, want)
+	}
+
+	// Once the network settles, the depth shrinks by shrinkStep a window
+	previous := tj.depth()
+	for window := 0; previous > minDelay; window++ {
+		if window > 30 {
+			t.Fatalf("depth stuck at %s", previous)
+		}
+		for i := 0; i < int(jitterWindow/interval); i++ {
+			push(0)
+		}
+		got := tj.depth()
+		if got > previous || previous-got > shrinkStep {
+			t.Fatalf("window %d: depth went from %s to %s, want a step of at most %s down", window, previous, got, shrinkStep)
+		}
+		previous = got
+	}
+	if stats := tj.GetStats(); stats.Late != 1 {
+		t.Errorf("Late = %d, want only the delayed frame", stats.Late)
+	}
+}
+
+func TestJitterBufferLipSyncOffset(t *testing.T) {
+	const pts = time.Second
+	tests := []struct {
+		name        string
+		offsetMs    int
+		videoBehind time.Duration // how much later video plays than audio
+	}{
+		{"none", 0, 0},
+		{"audio reaches the room late", 80, 80 * time.Millisecond},
+		{"video reaches the room late", -80, -80 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tj := newTestJitterBuffer(&config.MediaConfig{LipSyncOffset: tt.offsetMs})
+			tj.pushAt(0, testVideoFrame(0, 0))
+			tj.pushAt(pts, testVideoFrame(1, pts))
+			tj.pushAt(pts, testAudioFrame(2, pts))
+
+			due := make(map[int]time.Time)
+			tj.mu.Lock()
+			for _, item := range tj.queue {
+				if item.frame.GetFrameID() != 0 {
+					due[mediumOf(item.frame)] = item.due
+				}
+			}
+			tj.mu.Unlock()
+			if got := due[videoMedium].Sub(due[audioMedium]); got != tt.videoBehind {
+				t.Errorf("video due %s after audio, want %s", got, tt.videoBehind)
+			}
+		})
+	}
+}
+
+func TestJitterBufferResync(t *testing.T) {
+	const frame = 33 * time.Millisecond
+	tj := newTestJitterBuffer(nil)
+	var reported int
+	tj.SetOnGap(func(lost int) { reported += lost })
+
+	// Video 0-5 and audio 10-15 of the old rendition are queued
+	for i := 0; i < 6; i++ {
+		at := time.Duration(i) * frame
+		tj.pushAt(at, testVideoFrame(uint64(i), at))
+		tj.pushAt(at, testAudioFrame(uint64(10+i), at))
+	}
+
+	// The new rendition delivers video from frame 3 again, with its own
+	// frame IDs; the old rendition's video from there on is dropped
+	tj.Resync(media.DurationToPTS(3 * frame))
+	tj.pushAt(6*frame, testVideoFrame(100, 3*frame))
+	tj.pushAt(6*frame+time.Millisecond, testVideoFrame(101, 4*frame))
+	// Frame IDs 6-99 were never missing, so none is lost once the depth
+	// has passed
+	tj.pushAt(6*frame+tj.depth()+2*time.Millisecond, testVideoFrame(102, 5*frame))
+
+	want := map[uint64]bool{0: true, 1: true, 2: true, 100: true, 101: true, 102: true}
+	for id := uint64(10); id < 16; id++ {
+		want[id] = true
+	}
+	presented := tj.drain(2 * time.Minute)
+	for _, id := range presented {
+		if !want[id] {
+			t.Errorf("presented frame %d from the old rendition after resync", id)
+		}
+		delete(want, id)
+	}
+	if len(want) != 0 {
+		t.Errorf("frames %v were not presented", want)
+	}
+	if reported != 0 {
+		t.Errorf("onGap reported %d lost across the resync", reported)
+	}
+}
@@ -0,0 +1,96 @@
+package streaming
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/meshlink/church-streaming/internal/config"
+)
+
+// Every topic, protocol ID and the mDNS service tag is namespaced by the
+// configured discovery key, so that congregations sharing a network with
+// different keys never find each other's peers or streams.
+
+// maxNamespaceIDLength keeps the mDNS service tag within a DNS label.
+const maxNamespaceIDLength = 63
+
+// Namespace derives the names a congregation's nodes meet on from its
+// discovery key.
+type Namespace struct {
+	id string
+}
+
+// NewNamespace returns the namespace of a discovery key, or of the default
+// key if it is empty. A key that is not a valid DNS label is hashed into
+// one.
+func NewNamespace(discoveryKey string) Namespace {
+	if discoveryKey == "" {
+		discoveryKey = config.DefaultConfig().Network.DiscoveryKey
+	}
+	if isDNSLabel(discoveryKey) {
+		return Namespace{id: discoveryKey}
+	}
+	sum := sha256.Sum256([]byte(discoveryKey))
+	return Namespace{id: "meshlink-" + hex.EncodeToString(sum[:6])}
+}
+
+// namespaceOf returns the namespace configured in cfg, which may be nil.
+func namespaceOf(cfg *config.Config) Namespace {
+	if cfg == nil {
+		return NewNamespace("")
+	}
+	return NewNamespace(cfg.Network.DiscoveryKey)
+}
+
+// isDNSLabel reports whether s is lowercase letters, digits and inner
+// hyphens, short enough for a DNS label.
+func isDNSLabel(s string) bool {
+	if len(s) == 0 || len(s) > maxNamespaceIDLength || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ServiceTag returns the mDNS service tag peers are discovered under.
+func (n Namespace) ServiceTag() string {
+	return n.id
+}
+
+// StreamTopic returns the topic a broadcast is published on, or with
+// simulcast the prefix of its rendition topics.
+func (n Namespace) StreamTopic(streamID uint32) string {
+	return fmt.Sprintf("meshlink/%s/stream/%08x", n.id, streamID)
+}
+
+// ControlTopic returns the topic carrying requests from viewers back to the
+// broadcasters.
+func (n Namespace) ControlTopic() string {
+	return "meshlink/" + n.id + "/control"
+}
+
+// DirectoryTopic returns the topic carrying signed announcements of the
+// live broadcasts.
+func (n Namespace) DirectoryTopic() string {
+	return "meshlink/" + n.id + "/directory"
+}
+
+// FastStartProtocol returns the protocol serving a broadcaster's or relay's
+// cached GOP to a joining viewer over a direct stream.
+func (n Namespace) FastStartProtocol() protocol.ID {
+	return protocol.ID("/meshlink/" + n.id + "/gop/2.0.0")
+}
+
+// DirectProtocol returns the protocol a broadcaster or relay sends a
+// rendition's frames on to a viewer that opened a stream to it, with the
+// direct transport.
+func (n Namespace) DirectProtocol() protocol.ID {
+	return protocol.ID("/meshlink/" + n.id + "/stream/1.0.0")
+}
@@ -0,0 +1,423 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/meshlink/church-streaming/internal/config"
+	"github.com/meshlink/church-streaming/internal/media"
+	"github.com/sirupsen/logrus"
+)
+
+// A Relay strengthens the mesh without watching anything. GossipSub only
+// forwards a topic through peers subscribed to it, so the relay subscribes
+// to the directory, the control topic and the topics of every live stream
+// as they are announced. With the direct transport it instead receives
+// every rendition from the broadcaster over a direct stream and sends it on
+// to the viewers that open one to the relay. With GOP caching it also keeps
+// each rendition's latest GOP and serves it to viewers that cannot reach
+// the broadcaster directly. Payloads of private streams stay sealed; the
+// relay needs no key.
+type Relay struct {
+	ps         *pubsub.PubSub
+	namespace  Namespace
+	directory  *Directory
+	control    *pubsub.Topic
+	controlSub *pubsub.Subscription
+	host       host.Host
+	cacheGOPs  bool
+	direct     bool
+	logger     *logrus.Logger
+	ctx        context.Context
+
+	mu      sync.Mutex
+	streams map[uint32]*relayedStream
+
+	messagesRelayed atomic.Uint64
+	bytesRelayed    atomic.Uint64
+	gopsServed      atomic.Uint64
+}
+
+// relayedStream is a live stream the relay is subscribed to, with one
+// topic per rendition, or a single topic without simulcast.
+type relayedStream struct {
+	desc   StreamDescriptor
+	topics map[string]*relayedTopic // by topic name
+}
+
+// relayedTopic is a subscription the relay keeps to forward a topic, or
+// with the direct transport a rendition it receives and sends on, caching
+// its GOP if enabled.
+type relayedTopic struct {
+	name        string
+	rendition   string
+	topic       *pubsub.Topic
+	sub         *pubsub.Subscription
+	reassembler *Reassembler
+	gopCache    *GOPCache
+
+	// With the direct transport
+	fanout *fanout
+	cancel context.CancelFunc
+}
+
+// RelayStats describes what a relay is forwarding.
+type RelayStats struct {
+	Streams         int    // live streams subscribed to
+	Topics          int    // stream and rendition topics subscribed to
+	MeshPeers       int    // distinct peers on those topics, or sent to directly
+	MessagesRelayed uint64 // stream chunks, or direct frames, passing through
+	BytesRelayed    uint64
+	CachedFrames    int    // frames in the cached GOPs
+	GOPsServed      uint64 // cached GOPs sent to joining viewers
+}
+
+// NewRelay starts following the streams announced under the configured
+// discovery key, or only those of the trusted broadcasters if any are
+// configured, serving cached GOPs and direct streams on h.
+func NewRelay(ctx context.Context, h host.Host, ps *pubsub.PubSub, cfg *config.Config) (*Relay, error) {
+	if cfg == nil {
+		cfg = config.DefaultConfig()
+	}
+	trusted, err := ParseTrustedBroadcasters(cfg.Security.TrustedBroadcasters)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := isDirect(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := namespaceOf(cfg)
+	directory, err := NewDirectory(ctx, ps, namespace, trusted)
+	if err != nil {
+		return nil, err
+	}
+	control, err := ps.Join(namespace.ControlTopic())
+	if err != nil {
+		directory.Close()
+		return nil, fmt.Errorf("failed to join control topic: %w", err)
+	}
+	controlSub, err := control.Subscribe()
+	if err != nil {
+		control.Close()
+		directory.Close()
+		return nil, fmt.Errorf("failed to subscribe to control topic: %w", err)
+	}
+
+	r := &Relay{
+		ps:         ps,
+		namespace:  namespace,
+		directory:  directory,
+		control:    control,
+		controlSub: controlSub,
+		host:       h,
+		cacheGOPs:  cfg.Relay.CacheGOPs,
+		direct:     direct,
+		logger:     logrus.New(),
+		ctx:        ctx,
+		streams:    make(map[uint32]*relayedStream),
+	}
+	if r.cacheGOPs {
+		h.SetStreamHandler(namespace.FastStartProtocol(), r.serveGOP)
+	}
+	if r.direct {
+		h.SetStreamHandler(namespace.DirectProtocol(), r.serveDirect)
+	}
+	go r.drain(controlSub)
+	directory.SetOnChange(r.sync)
+	r.sync()
+	return r, nil
+}
+
+// serveGOP sends a relayed rendition's cached GOP to a joining viewer.
+func (r *Relay) serveGOP(s network.Stream) {
+	streamID, name, err := readRenditionRequest(s)
+	if err != nil {
+		r.logger.Debugf("Bad GOP request from %s: %v", s.Conn().RemotePeer(), err)
+		s.Reset()
+		return
+	}
+
+	var frames [][]byte
+	if t := r.findTopic(streamID, name); t != nil && t.gopCache != nil {
+		frames = t.gopCache.Snapshot()
+	}
+	if err := serveGOP(s, frames); err != nil {
+		r.logger.Debugf("Failed to send GOP to %s: %v", s.Conn().RemotePeer(), err)
+		return
+	}
+	if len(frames) > 0 {
+		r.gopsServed.Add(1)
+	}
+}
+
+// serveDirect sends a relayed rendition to a viewer over the direct
+// transport.
+func (r *Relay) serveDirect(s network.Stream) {
+	streamID, name, err := readRenditionRequest(s)
+	if err != nil {
+		r.logger.Debugf("Bad stream request from %s: %v", s.Conn().RemotePeer(), err)
+		s.Reset()
+		return
+	}
+
+	t := r.findTopic(streamID, name)
+	if t == nil || t.fanout == nil {
+		s.Reset()
+		return
+	}
+	r.logger.Debugf("Sending %s of stream %08x to %s", renditionLabel(name), streamID, s.Conn().RemotePeer())
+	t.fanout.serve(s)
+}
+
+// findTopic returns the relayed topic of a stream's rendition.
+func (r *Relay) findTopic(streamID uint32, rendition string) *relayedTopic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream, ok := r.streams[streamID]
+	if !ok {
+		return nil
+	}
+	for _, t := range stream.topics {
+		if t.rendition == rendition {
+			return t
+		}
+	}
+	return nil
+}
+
+// sync subscribes to the topics of the live streams and leaves those of
+// streams that ended.
+func (r *Relay) sync() {
+	live := r.directory.List()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := make(map[uint32]bool, len(live))
+	for _, desc := range live {
+		current[desc.StreamID] = true
+		stream, ok := r.streams[desc.StreamID]
+		if !ok {
+			stream = &relayedStream{topics: make(map[string]*relayedTopic)}
+			r.streams[desc.StreamID] = stream
+			r.logger.Infof("Relaying stream %08x: %q from %s", desc.StreamID, desc.Title, desc.ChurchName)
+		}
+		stream.desc = desc
+		r.syncTopics(stream)
+	}
+
+	for id, stream := range r.streams {
+		if current[id] {
+			continue
+		}
+		for _, t := range stream.topics {
+			r.leave(t)
+		}
+		delete(r.streams, id)
+		r.logger.Infof("Stopped relaying stream %08x", id)
+	}
+}
+
+// syncTopics subscribes to the stream's announced renditions and leaves
+// the ones it no longer publishes.
+func (r *Relay) syncTopics(stream *relayedStream) {
+	wanted := map[string]string{stream.desc.Topic: ""}
+	if len(stream.desc.Renditions) > 0 {
+		wanted = make(map[string]string, len(stream.desc.Renditions))
+		for _, name := range stream.desc.Renditions {
+			wanted[RenditionTopic(stream.desc.Topic, name)] = name
+		}
+	}
+
+	for name, t := range stream.topics {
+		if _, ok := wanted[name]; !ok {
+			r.leave(t)
+			delete(stream.topics, name)
+		}
+	}
+	for name, rendition := range wanted {
+		if _, ok := stream.topics[name]; ok {
+			continue
+		}
+		t, err := r.join(name, rendition, stream.desc)
+		if err != nil {
+			r.logger.Errorf("Failed to relay %s: %v", name, err)
+			continue
+		}
+		stream.topics[name] = t
+	}
+}
+
+// join subscribes to a stream topic, accepting only the broadcaster's
+// messages so that forged chunks are never forwarded. With the direct
+// transport it receives the rendition from the broadcaster instead.
+func (r *Relay) join(name string, rendition string, desc StreamDescriptor) (*relayedTopic, error) {
+	if r.direct {
+		ctx, cancel := context.WithCancel(r.ctx)
+		t := &relayedTopic{name: name, rendition: rendition, fanout: newFanout(), cancel: cancel}
+		if r.cacheGOPs {
+			t.gopCache = NewGOPCache()
+		}
+		go r.pull(ctx, t, desc)
+		return t, nil
+	}
+
+	if err := registerAuthorValidator(r.ps, name, desc.Broadcaster); err != nil {
+		return nil, err
+	}
+	topic, err := r.ps.Join(name)
+	if err != nil {
+		r.ps.UnregisterTopicValidator(name)
+		return nil, fmt.Errorf("failed to join topic %s: %w", name, err)
+	}
+	sub, err := topic.Subscribe(pubsub.WithBufferSize(subscriptionBufferSize))
+	if err != nil {
+		topic.Close()
+		r.ps.UnregisterTopicValidator(name)
+		return nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	t := &relayedTopic{name: name, rendition: rendition, topic: topic, sub: sub}
+	if r.cacheGOPs {
+		t.reassembler = NewReassembler(0)
+		t.gopCache = NewGOPCache()
+	}
+	go r.receive(t)
+	return t, nil
+}
+
+// leave cancels a topic's subscription, or stops receiving a direct
+// rendition. The topic is closed, or the viewers' streams, once that has
+// ended.
+func (r *Relay) leave(t *relayedTopic) {
+	if t.cancel != nil {
+		t.cancel()
+		return
+	}
+	t.sub.Cancel()
+}
+
+// pull receives a rendition from the broadcaster over the direct transport
+// and sends each frame on to the relay's viewers until the relay leaves it.
+func (r *Relay) pull(ctx context.Context, t *relayedTopic, desc StreamDescriptor) {
+	defer t.fanout.closeAll()
+
+	sources := []peer.ID{desc.Broadcaster}
+	pullFrames(ctx, r.host, r.namespace.DirectProtocol(), sources, desc.StreamID, t.rendition, func(frame []byte) bool {
+		header, err := media.PeekHeader(frame)
+		if err != nil {
+			return true
+		}
+		r.messagesRelayed.Add(1)
+		r.bytesRelayed.Add(uint64(len(frame)))
+		t.fanout.send(header, frame)
+		if t.gopCache != nil {
+			t.gopCache.Add(header, frame)
+		}
+		return true
+	}, r.logger)
+}
+
+// receive counts a topic's chunks and feeds the GOP cache until the
+// subscription is cancelled.
+func (r *Relay) receive(t *relayedTopic) {
+	defer func() {
+		if err := t.topic.Close(); err != nil {
+			r.logger.Debugf("Failed to close topic %s: %v", t.name, err)
+		}
+		r.ps.UnregisterTopicValidator(t.name)
+	}()
+
+	for {
+		msg, err := t.sub.Next(r.ctx)
+		if err != nil {
+			return
+		}
+		r.messagesRelayed.Add(1)
+		r.bytesRelayed.Add(uint64(len(msg.Data)))
+
+		if t.gopCache == nil {
+			continue
+		}
+		frame, err := t.reassembler.Add(msg.Data)
+		if err != nil || frame == nil {
+			continue
+		}
+		header, err := media.PeekHeader(frame)
+		if err != nil {
+			continue
+		}
+		t.gopCache.Add(header, frame)
+	}
+}
+
+// drain discards a subscription's messages; the subscription only keeps
+// the relay in the topic's mesh.
+func (r *Relay) drain(sub *pubsub.Subscription) {
+	for {
+		if _, err := sub.Next(r.ctx); err != nil {
+			return
+		}
+	}
+}
+
+// GetStats returns what the relay is forwarding.
+func (r *Relay) GetStats() RelayStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := RelayStats{
+		Streams:         len(r.streams),
+		MessagesRelayed: r.messagesRelayed.Load(),
+		BytesRelayed:    r.bytesRelayed.Load(),
+		GOPsServed:      r.gopsServed.Load(),
+	}
+	peers := make(map[peer.ID]struct{})
+	for _, stream := range r.streams {
+		stats.Topics += len(stream.topics)
+		for _, t := range stream.topics {
+			if t.topic != nil {
+				for _, p := range t.topic.ListPeers() {
+					peers[p] = struct{}{}
+				}
+			}
+			if t.fanout != nil {
+				for _, p := range t.fanout.peers() {
+					peers[p] = struct{}{}
+				}
+			}
+			if t.gopCache != nil {
+				stats.CachedFrames += len(t.gopCache.Snapshot())
+			}
+		}
+	}
+	stats.MeshPeers = len(peers)
+	return stats
+}
+
+// Close leaves every topic.
+func (r *Relay) Close() {
+	r.directory.SetOnChange(nil)
+	r.directory.Close()
+
+	r.mu.Lock()
+	for id, stream := range r.streams {
+		for _, t := range stream.topics {
+			r.leave(t)
+		}
+		delete(r.streams, id)
+	}
+	r.mu.Unlock()
+
+	r.controlSub.Cancel()
+	r.control.Close()
+}
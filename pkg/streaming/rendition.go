@@ -0,0 +1,98 @@
+package streaming
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/meshlink/church-streaming/internal/media"
+)
+
+// With simulcast the broadcaster encodes the video once per rendition and
+// publishes each rendition on its own topic, so that a viewer only receives
+// the one its link can carry. Every rendition topic also carries the audio,
+// so a viewer needs a single subscription. Without renditions configured the
+// broadcaster publishes one quality on the stream's own topic.
+
+// RenditionTopic returns the pubsub topic carrying a rendition such as "720p"
+// of the stream published on streamTopic.
+func RenditionTopic(streamTopic string, name string) string {
+	return streamTopic + "/" + name
+}
+
+// renditionHeight returns the picture height of a rendition name such as
+// "720p", or zero if the name is not of that form.
+func renditionHeight(name string) int {
+	if !strings.HasSuffix(name, "p") {
+		return 0
+	}
+	height, err := strconv.Atoi(strings.TrimSuffix(name, "p"))
+	if err != nil || height <= 0 {
+		return 0
+	}
+	return height
+}
+
+// sortRenditions returns the valid rendition names, lowest first and without
+// duplicates.
+func sortRenditions(names []string) []string {
+	seen := make(map[string]bool)
+	var sorted []string
+	for _, name := range names {
+		if renditionHeight(name) == 0 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return renditionHeight(sorted[i]) < renditionHeight(sorted[j])
+	})
+	return sorted
+}
+
+// rendition is one encoding of the broadcast with its own topic, frame
+// sequence and GOP cache, and its viewers with the direct transport.
+type rendition struct {
+	name     string
+	topic    *pubsub.Topic
+	gopCache *GOPCache
+	fanout   *fanout
+
+	// Guarded by the broadcaster's videoMu. The encoder is nil when the
+	// rendition is not being encoded; next replaces it at its first
+	// keyframe. changed wakes the publish loop when either changes, and
+	// publishing is the ID of the running publish loop, zero if none.
+	encoder    media.Encoder
+	next       media.Encoder
+	publishing uint64
+	changed    chan struct{}
+
+	// Serializes publishing, so that frame IDs go out in order
+	mu       sync.Mutex
+	sequence uint64
+
+	// Guarded by the broadcaster's keyframeMu
+	lastKeyframe time.Time
+	lastForced   time.Time
+}
+
+func newRendition(name string, topic *pubsub.Topic) *rendition {
+	return &rendition{
+		name:     name,
+		topic:    topic,
+		gopCache: NewGOPCache(),
+		fanout:   newFanout(),
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+func (r *rendition) notify() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
@@ -2,160 +2,1038 @@ package streaming
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
-	"github.com/sirupsen/logrus"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/meshlink/church-streaming/internal/config"
 	"github.com/meshlink/church-streaming/internal/media"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Frames arrive as bursts of chunks, so the subscription needs far more
+	// room than the default of 32 messages
+	subscriptionBufferSize = 1024
+
+	// Video frames held while a fast start is in flight
+	maxHeldFrames = 512
+
+	// Connection manager tag that keeps the connection to the broadcaster
+	// of the stream being watched from being trimmed
+	broadcasterProtectTag = "meshlink-broadcaster"
 )
 
 type Viewer struct {
-	subscription   *pubsub.Subscription
-	logger         *logrus.Logger
-	ctx            context.Context
-	onData         func([]byte)
+	ps              *pubsub.PubSub
+	namespace       Namespace
+	directory       *Directory
+	stream          StreamDescriptor // selected, zero until one is
+	topicMu         sync.Mutex
+	topics          map[string]*pubsub.Topic // joined, by name
+	subscription    feed
+	incoming        chan subscriptionMessage
+	direct          bool      // receive over direct streams
+	relays          []peer.ID // configured, for direct streams
+	controlTopic    *pubsub.Topic
+	host            host.Host
+	logger          *logrus.Logger
+	ctx             context.Context
+	onData          func([]byte)
 	onFrameReceived func(*media.DecodedFrame)
-	isViewing      bool
-	framesReceived uint64
-	bytesReceived  uint64
-	lastFrameTime  time.Time
-	stopChan       chan struct{}
-	decoder        *media.H264Decoder
+	onParamChange   func(*media.FrameHeader)
+	isViewing       bool
+	framesReceived  uint64
+	videoReceived   uint64
+	audioReceived   uint64
+	bytesReceived   uint64
+	lastFrameTime   time.Time
+	stopChan        chan struct{}
+	receiveDone     chan struct{} // closed when the receive loop exits
+	decoder         media.Decoder
+	videoCodec      string
+	audioDecoder    media.Decoder
+	audioCodec      string
+	audioPlayer     *media.AudioPlayer
+	audioPlayback   bool
+	jitterBuffer    *JitterBuffer
+	reassembler     *Reassembler
+	mediaConfig     *config.MediaConfig
+
+	// Decrypts private streams, nil without a configured key. keyError is
+	// set while frames cannot be decrypted.
+	opener     *frameOpener
+	keyMu      sync.Mutex
+	keyError   error
+	onKeyError func(error)
+
+	// The selected stream's simulcast renditions, lowest first, and the
+	// adaptive bitrate state owned by the receive loop. Empty without
+	// simulcast.
+	renditions        []string
+	rendition         atomic.Int32
+	onRenditionChange func(string)
+	abr               abrController
+	probe             *renditionProbe
+	lastAudioPTS      uint64
+	audioResumePTS    uint64
+	renditionMu       sync.Mutex
+	renditionStats    RenditionStats
+
+	// Joining: video waits for a keyframe, optionally fetched with the
+	// cached GOP
+	startMu            sync.Mutex
+	videoStream        uint32
+	waitingForKeyframe bool
+	fastStartTried     bool
+	fastStartPending   bool
+	fastStartStream    uint32
+	fastStartUntil     uint64
+	held               [][]byte
+
+	activeStream        atomic.Uint32
+	requestMu           sync.Mutex
+	lastKeyframeRequest time.Time
 }
 
 func NewViewer(ctx context.Context, ps *pubsub.PubSub, onData func([]byte)) (*Viewer, error) {
-	topic, err := ps.Join(StreamTopic)
+	return NewViewerWithConfig(ctx, ps, nil, onData)
+}
+
+// NewViewerWithConfig creates a viewer whose decoders are chosen from the
+// configured video and audio codecs. Without a host it only receives over
+// pubsub; the direct transport needs NewViewerWithHost.
+func NewViewerWithConfig(ctx context.Context, ps *pubsub.PubSub, cfg *config.Config, onData func([]byte)) (*Viewer, error) {
+	direct, err := isDirect(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to join topic: %w", err)
+		return nil, err
+	}
+	if direct {
+		return nil, errDirectNeedsHost
 	}
+	return newViewer(ctx, ps, cfg, onData)
+}
 
-	sub, err := topic.Subscribe()
+// NewViewerWithHost creates a viewer that opens streams from the host: to
+// fetch the cached GOP when it joins and, with the direct transport, to
+// receive the stream.
+func NewViewerWithHost(ctx context.Context, h host.Host, ps *pubsub.PubSub, cfg *config.Config, onData func([]byte)) (*Viewer, error) {
+	v, err := newViewer(ctx, ps, cfg, onData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to subscribe: %w", err)
+		return nil, err
+	}
+	v.EnableFastStart(h)
+	return v, nil
+}
+
+func newViewer(ctx context.Context, ps *pubsub.PubSub, cfg *config.Config, onData func([]byte)) (*Viewer, error) {
+	mediaConfig := &config.DefaultConfig().Media
+	securityConfig := &config.DefaultConfig().Security
+	if cfg != nil {
+		mediaConfig = &cfg.Media
+		securityConfig = &cfg.Security
+	}
+	trusted, err := ParseTrustedBroadcasters(securityConfig.TrustedBroadcasters)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := isDirect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	relays, err := configuredRelays(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	videoCodec := orDefault(mediaConfig.VideoCodec, "h264")
+	decoder, err := media.NewDecoder(videoCodec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decoder: %w", err)
+	}
+
+	var audioDecoder media.Decoder
+	audioCodec := orDefault(mediaConfig.AudioCodec, "aac")
+	if audioCodec != "none" {
+		audioDecoder, err = media.NewDecoder(audioCodec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create audio decoder: %w", err)
+		}
+	}
+
+	namespace := namespaceOf(cfg)
+	controlTopic, err := ps.Join(namespace.ControlTopic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to join control topic: %w", err)
+	}
+
+	// Without a key, private streams are listed but cannot be watched
+	var opener *frameOpener
+	key, err := LoadStreamKey(securityConfig, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		opener = newFrameOpener(key)
+	}
+
+	// Streams are announced on the directory topic; collect them from the
+	// start so that the list is ready when the user picks one
+	directory, err := NewDirectory(ctx, ps, namespace, trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Viewer{
+		ps:            ps,
+		namespace:     namespace,
+		directory:     directory,
+		topics:        make(map[string]*pubsub.Topic),
+		controlTopic:  controlTopic,
+		logger:        logrus.New(),
+		ctx:           ctx,
+		onData:        onData,
+		stopChan:      make(chan struct{}),
+		decoder:       decoder,
+		videoCodec:    videoCodec,
+		audioDecoder:  audioDecoder,
+		audioCodec:    audioCodec,
+		audioPlayback: true,
+		mediaConfig:   mediaConfig,
+		opener:        opener,
+		direct:        direct,
+		relays:        relays,
+	}
+	v.reassembler = NewReassembler(0)
+	v.jitterBuffer = NewJitterBufferWithConfig(mediaConfig, v.presentVideo, v.playAudio)
+	v.jitterBuffer.SetOnGap(func(lost int) {
+		v.requestKeyframe("loss")
+	})
+	return v, nil
+}
+
+// ListStreams returns the live streams announced on the network, most
+// recently started first.
+func (v *Viewer) ListStreams() []StreamDescriptor {
+	return v.directory.List()
+}
+
+// SetOnStreamsChange sets a callback for when a stream starts, ends or
+// changes its listing.
+func (v *Viewer) SetOnStreamsChange(callback func()) {
+	v.directory.SetOnChange(callback)
+}
+
+// SelectStream chooses the live stream to watch from ListStreams. It takes
+// effect at the next StartViewing.
+func (v *Viewer) SelectStream(streamID uint32) error {
+	if v.isViewing {
+		return fmt.Errorf("already viewing")
 	}
 
-	// Initialize decoder
-	decoder := media.NewH264Decoder()
+	desc, ok := v.directory.Get(streamID)
+	if !ok {
+		return fmt.Errorf("stream %08x is not live", streamID)
+	}
+	if desc.Encrypted && v.opener == nil {
+		return ErrNoKey
+	}
+	if err := v.useCodecs(&desc); err != nil {
+		return err
+	}
+	v.stream = desc
+	v.renditions = sortRenditions(desc.Renditions)
+	v.logger.Infof("Selected stream %08x: %q from %s", desc.StreamID, desc.Title, desc.ChurchName)
+	return nil
+}
 
-	return &Viewer{
-		subscription: sub,
-		logger:       logrus.New(),
-		ctx:          ctx,
-		onData:       onData,
-		stopChan:     make(chan struct{}),
-		decoder:      decoder,
-	}, nil
+// GetStream returns the selected stream, or false if none is selected.
+func (v *Viewer) GetStream() (StreamDescriptor, bool) {
+	return v.stream, v.stream.StreamID != 0
 }
 
+// useCodecs replaces the decoders with ones for the codecs a stream
+// announces. Audio stays off if the viewer turned it off.
+func (v *Viewer) useCodecs(desc *StreamDescriptor) error {
+	if desc.VideoCodec != "" && desc.VideoCodec != v.videoCodec {
+		decoder, err := media.NewDecoder(desc.VideoCodec)
+		if err != nil {
+			return fmt.Errorf("failed to create decoder: %w", err)
+		}
+		v.decoder = decoder
+		v.videoCodec = desc.VideoCodec
+	}
+	if v.audioDecoder != nil && desc.AudioCodec != "" && desc.AudioCodec != v.audioCodec {
+		decoder, err := media.NewDecoder(desc.AudioCodec)
+		if err != nil {
+			return fmt.Errorf("failed to create audio decoder: %w", err)
+		}
+		v.audioDecoder = decoder
+		v.audioCodec = desc.AudioCodec
+	}
+	return nil
+}
+
+// renditionTopic returns the topic of a rendition of the selected stream,
+// or of the stream itself without simulcast, joining it on first use. The
+// topic only accepts messages from the stream's announced broadcaster.
+func (v *Viewer) renditionTopic(index int) (*pubsub.Topic, error) {
+	name := v.stream.Topic
+	if len(v.renditions) > 0 {
+		name = RenditionTopic(name, v.renditions[index])
+	}
+
+	v.topicMu.Lock()
+	defer v.topicMu.Unlock()
+	if topic, ok := v.topics[name]; ok {
+		return topic, nil
+	}
+	if err := registerAuthorValidator(v.ps, name, v.stream.Broadcaster); err != nil {
+		return nil, err
+	}
+	topic, err := v.ps.Join(name)
+	if err != nil {
+		v.ps.UnregisterTopicValidator(name)
+		return nil, fmt.Errorf("failed to join topic %s: %w", name, err)
+	}
+	v.topics[name] = topic
+	return topic, nil
+}
+
+// StartViewing starts watching the selected stream, or the most recently
+// started one if none is selected.
 func (v *Viewer) StartViewing() error {
 	if v.isViewing {
 		return fmt.Errorf("already viewing")
 	}
-	
+
+	if v.stream.StreamID == 0 {
+		streams := v.directory.List()
+		if len(streams) == 0 {
+			return fmt.Errorf("no live streams found")
+		}
+		if err := v.SelectStream(streams[0].StreamID); err != nil {
+			return err
+		}
+	}
+
 	v.logger.Info("Starting stream viewer...")
-	
+
+	// Viewers start on the lowest rendition and work their way up
+	sub, err := v.subscribe(0)
+	if err != nil {
+		return err
+	}
+
 	// Start decoder
 	if err := v.decoder.Start(); err != nil {
+		sub.Cancel()
 		return fmt.Errorf("failed to start decoder: %w", err)
 	}
-	
+	if v.audioDecoder != nil {
+		if err := v.audioDecoder.Start(); err != nil {
+			v.decoder.Stop()
+			sub.Cancel()
+			return fmt.Errorf("failed to start audio decoder: %w", err)
+		}
+	}
+
+	v.jitterBuffer.Start()
+
 	v.isViewing = true
 	v.framesReceived = 0
+	v.videoReceived = 0
+	v.audioReceived = 0
 	v.bytesReceived = 0
 	v.lastFrameTime = time.Now()
-	
-	go v.receiveLoop()
+	v.reassembler = NewReassembler(0)
+	v.subscription = sub
+	v.incoming = make(chan subscriptionMessage, subscriptionBufferSize)
+	v.stopChan = make(chan struct{})
+
+	v.activeStream.Store(v.stream.StreamID)
+	v.setKeyError(nil)
+	v.rendition.Store(0)
+	v.abr = newABRController()
+	v.probe = nil
+	v.lastAudioPTS = 0
+	v.audioResumePTS = 0
+	v.setRenditionStats(RenditionStats{Active: v.renditionName(0)})
+
+	v.startMu.Lock()
+	v.videoStream = 0
+	v.waitingForKeyframe = true
+	v.fastStartTried = false
+	v.fastStartStream = 0
+	v.fastStartUntil = 0
+	v.startMu.Unlock()
+
+	if v.host != nil {
+		v.host.ConnManager().Protect(v.stream.Broadcaster, broadcasterProtectTag)
+	}
+
+	go v.read(sub, v.stopChan)
+	v.receiveDone = make(chan struct{})
+	go v.receiveLoop(v.stopChan, v.receiveDone)
+	if v.host == nil {
+		v.requestKeyframe("join")
+	}
+	if v.onRenditionChange != nil && len(v.renditions) > 0 {
+		v.onRenditionChange(v.renditionName(0))
+	}
 	return nil
 }
 
-func (v *Viewer) receiveLoop() {
+// feed delivers a rendition to the viewer: a pubsub subscription yielding
+// chunks, or with the direct transport a directFeed yielding whole frames.
+type feed interface {
+	Cancel()
+}
+
+// directFeed receives a rendition over direct streams until cancelled.
+type directFeed struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	rendition string
+}
+
+func (f *directFeed) Cancel() {
+	f.cancel()
+}
+
+// subscriptionMessage is a chunk, or a whole frame, from one of the
+// viewer's feeds.
+type subscriptionMessage struct {
+	sub   feed
+	data  []byte
+	frame bool
+}
+
+// subscribe starts receiving a rendition of the selected stream, by index.
+// The feed delivers nothing until read.
+func (v *Viewer) subscribe(index int) (feed, error) {
+	if v.direct {
+		if v.host == nil {
+			return nil, errDirectNeedsHost
+		}
+		ctx, cancel := context.WithCancel(v.ctx)
+		return &directFeed{ctx: ctx, cancel: cancel, rendition: v.renditionName(index)}, nil
+	}
+
+	topic, err := v.renditionTopic(index)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := topic.Subscribe(pubsub.WithBufferSize(subscriptionBufferSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	return sub, nil
+}
+
+// read forwards a feed's chunks or frames to the receive loop until the
+// feed is cancelled.
+func (v *Viewer) read(sub feed, stopChan chan struct{}) {
+	switch sub := sub.(type) {
+	case *pubsub.Subscription:
+		v.readSubscription(sub, stopChan)
+	case *directFeed:
+		v.readDirect(sub, stopChan)
+	}
+}
+
+func (v *Viewer) readSubscription(sub *pubsub.Subscription, stopChan chan struct{}) {
+	for {
+		msg, err := sub.Next(v.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case v.incoming <- subscriptionMessage{sub: sub, data: msg.Data}:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// readDirect receives frames from the broadcaster or, if it cannot be
+// reached, from one of the configured relays. Every frame must carry the
+// broadcaster's signature; those that do not verify are dropped.
+func (v *Viewer) readDirect(sub *directFeed, stopChan chan struct{}) {
+	key, err := v.stream.Broadcaster.ExtractPublicKey()
+	if err != nil {
+		v.logger.Errorf("Cannot receive directly: failed to get broadcaster key: %v", err)
+		return
+	}
+	sources := append([]peer.ID{v.stream.Broadcaster}, v.relays...)
+	pullFrames(sub.ctx, v.host, v.namespace.DirectProtocol(), sources, v.stream.StreamID, sub.rendition,
+		func(data []byte) bool {
+			frame, err := verifyFrame(data, key)
+			if err != nil {
+				v.logger.Debugf("Dropped direct frame: %v", err)
+				return true
+			}
+			select {
+			case v.incoming <- subscriptionMessage{sub: sub, data: frame, frame: true}:
+				return true
+			case <-stopChan:
+				return false
+			}
+		}, v.logger)
+}
+
+// receiveLoop handles messages from the active rendition and from a
+// rendition being probed, and adapts the rendition once per window. It owns
+// the subscriptions and cancels them when it exits.
+func (v *Viewer) receiveLoop(stopChan chan struct{}, done chan struct{}) {
+	defer close(done)
+	defer v.cancelSubscriptions()
+
+	ticker := time.NewTicker(abrWindow)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-v.ctx.Done():
 			v.logger.Info("Viewer stopped - context cancelled")
 			return
-		case <-v.stopChan:
+		case <-stopChan:
 			v.logger.Info("Viewer stopped - stop signal received")
 			return
-		default:
-			msg, err := v.subscription.Next(v.ctx)
-			if err != nil {
-				if v.ctx.Err() != nil {
-					return // Context cancelled
-				}
-				v.logger.Errorf("Failed to receive message: %v", err)
-				continue
+		case now := <-ticker.C:
+			v.adaptRendition(now)
+		case in := <-v.incoming:
+			switch {
+			case in.sub == v.subscription:
+				v.receive(in)
+			case v.probe != nil && in.sub == v.probe.sub:
+				v.receiveProbe(in)
 			}
-
-			// Process received frame
-			v.processFrame(msg.Data)
 		}
 	}
 }
 
+// receive handles a chunk or frame from the active rendition.
+func (v *Viewer) receive(in subscriptionMessage) {
+	// The first message shows the stream is flowing; the GOP is fetched
+	// from the announced broadcaster, the only author the topic accepts
+	if v.host != nil && !v.fastStartTried {
+		v.fastStartTried = true
+		v.startFastStart(v.stream.Broadcaster)
+	}
+
+	if in.frame {
+		v.processFrame(in.data)
+		return
+	}
+	frame, err := v.reassembler.Add(in.data)
+	if err != nil {
+		v.logger.Debugf("Dropped chunk: %v", err)
+		return
+	}
+	if frame != nil {
+		v.processFrame(frame)
+	}
+}
+
+func (v *Viewer) cancelSubscriptions() {
+	v.subscription.Cancel()
+	if v.probe != nil {
+		v.probe.sub.Cancel()
+		v.probe = nil
+	}
+}
+
 func (v *Viewer) processFrame(data []byte) {
+	// Frames on the stream topics are authenticated by GossipSub, and
+	// direct ones have had their signature verified by readDirect, so a
+	// signature left on a frame is only stripped
+	frame, _, err := splitFrameSignature(data)
+	if err != nil {
+		v.logger.Debugf("Dropped frame: %v", err)
+		return
+	}
+	plain, err := v.decryptFrame(frame)
+	if err != nil {
+		v.logger.Debugf("Dropped frame: %v", err)
+		if header, err := media.PeekHeader(data); err == nil {
+			v.jitterBuffer.Skip(header.FrameID)
+		}
+		return
+	}
+	data = plain
+
 	// Update statistics
 	v.framesReceived++
 	v.bytesReceived += uint64(len(data))
 	v.lastFrameTime = time.Now()
-	
-	// Decode frame using H.264 decoder
+
+	codec := media.CodecUnknown
+	header, err := media.PeekHeader(data)
+	if err == nil {
+		codec = header.Codec
+		v.activeStream.Store(header.StreamID)
+	}
+
+	// Route audio frames to the audio decoder
+	if codec.IsAudio() {
+		v.processAudio(header, data)
+	} else {
+		v.videoReceived++
+		v.processVideo(data)
+	}
+
+	// Call legacy data callback
+	if v.onData != nil {
+		v.onData(data)
+	}
+
+	// Log statistics periodically
+	if v.framesReceived%30 == 0 { // Every second at 30fps
+		recovered, unrecoverable := v.reassembler.GetFECStats()
+		v.logger.Infof("Received %d frames, %d bytes total, codec: %s, last frame: %v, FEC: %d recovered, %d lost",
+			v.framesReceived, v.bytesReceived, codec, v.lastFrameTime.Format("15:04:05.000"), recovered, unrecoverable)
+	}
+}
+
+func (v *Viewer) processAudio(header *media.FrameHeader, data []byte) {
+	if v.audioDecoder == nil {
+		v.jitterBuffer.Skip(header.FrameID)
+		return
+	}
+	v.audioReceived++
+
+	// After a rendition switch the new topic repeats audio already played
+	if v.audioResumePTS != 0 {
+		if header.PTS <= v.audioResumePTS {
+			v.jitterBuffer.Skip(header.FrameID)
+			return
+		}
+		v.audioResumePTS = 0
+	}
+	v.lastAudioPTS = header.PTS
+
+	decodedFrame, err := v.audioDecoder.DecodeFrame(data)
+	if err != nil {
+		v.logger.Errorf("Failed to decode audio frame: %v", err)
+		return
+	}
+
+	// Frames are reordered, and audio and video released in sync, at
+	// presentation time
+	v.jitterBuffer.Push(decodedFrame)
+}
+
+// processVideo decodes a video frame, or holds it while a fast start is
+// fetching the frames that come before it.
+func (v *Viewer) processVideo(data []byte) {
+	v.startMu.Lock()
+	defer v.startMu.Unlock()
+
+	if v.fastStartPending {
+		if len(v.held) < maxHeldFrames {
+			v.held = append(v.held, data)
+		}
+		return
+	}
+	v.decodeVideoLocked(data)
+}
+
+// decodeVideoLocked decodes a video frame and queues it for presentation.
+// Until a keyframe arrives there is nothing to decode against, so earlier
+// frames are dropped and a keyframe is requested. Called with startMu held.
+func (v *Viewer) decodeVideoLocked(data []byte) {
+	if header, err := media.PeekHeader(data); err == nil && header.IsParamChange() {
+		v.handleParamChange(header)
+	}
+
 	decodedFrame, err := v.decoder.DecodeFrame(data)
 	if err != nil {
 		v.logger.Errorf("Failed to decode frame: %v", err)
-		// Still call legacy callback with raw data
-		if v.onData != nil {
-			v.onData(data)
+		return
+	}
+
+	if streamID := decodedFrame.GetStreamID(); streamID != v.videoStream {
+		v.videoStream = streamID
+		v.waitingForKeyframe = true
+	}
+	if v.videoStream == v.fastStartStream && decodedFrame.GetFrameID() <= v.fastStartUntil {
+		return // already presented from the cached GOP
+	}
+	if v.waitingForKeyframe {
+		if !decodedFrame.IsKeyframe() {
+			v.jitterBuffer.Skip(decodedFrame.GetFrameID())
+			v.requestKeyframe("join")
+			return
 		}
+		v.waitingForKeyframe = false
+	}
+
+	v.jitterBuffer.Push(decodedFrame)
+}
+
+// handleParamChange restarts the video decoder when the broadcaster starts
+// encoding with new parameters, so that no state from the old resolution
+// carries over. Called with startMu held.
+func (v *Viewer) handleParamChange(header *media.FrameHeader) {
+	v.logger.Infof("Stream parameters changed at frame %d", header.FrameID)
+	v.decoder.Stop()
+	if err := v.decoder.Start(); err != nil {
+		v.logger.Errorf("Failed to restart decoder: %v", err)
+	}
+	if v.onParamChange != nil {
+		v.onParamChange(header)
+	}
+}
+
+// startFastStart fetches the broadcaster's cached GOP in the background.
+// Video frames arriving meanwhile are held and decoded after it.
+func (v *Viewer) startFastStart(broadcaster peer.ID) {
+	v.startMu.Lock()
+	v.fastStartPending = true
+	v.held = nil
+	v.startMu.Unlock()
+
+	go func() {
+		frames, err := v.fetchGOP(broadcaster)
+		v.finishFastStart(frames, err)
+	}()
+}
+
+// fetchGOP fetches the active rendition's cached GOP from the broadcaster
+// or, if it cannot be reached directly, from one of the configured relays
+// it is connected to. Every frame must carry the broadcaster's signature;
+// a GOP with one that does not verify is discarded whole. The frames are
+// returned without their signatures.
+func (v *Viewer) fetchGOP(broadcaster peer.ID) ([][]byte, error) {
+	key, err := broadcaster.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get broadcaster key: %w", err)
+	}
+	proto := v.namespace.FastStartProtocol()
+	streamID, rendition := v.activeStream.Load(), v.activeRendition()
+
+	frames, err := fetchGOP(v.ctx, v.host, proto, broadcaster, streamID, rendition)
+	if err == nil {
+		return verifyGOP(frames, key)
+	}
+	for _, p := range v.relays {
+		if p == broadcaster || v.host.Network().Connectedness(p) != network.Connected {
+			continue
+		}
+		relayed, relayErr := fetchGOP(v.ctx, v.host, proto, p, streamID, rendition)
+		if relayErr == nil {
+			relayed, relayErr = verifyGOP(relayed, key)
+		}
+		if relayErr != nil {
+			v.logger.Warnf("Ignoring the cached GOP from relay %s: %v", p, relayErr)
+			continue
+		}
+		if len(relayed) > 0 {
+			v.logger.Infof("Fetched the cached GOP from relay %s", p)
+			return relayed, nil
+		}
+	}
+	return nil, err
+}
+
+// verifyGOP checks every frame of a cached GOP against the broadcaster's
+// key and returns them without their signatures.
+func verifyGOP(frames [][]byte, key crypto.PubKey) ([][]byte, error) {
+	verified := make([][]byte, 0, len(frames))
+	for _, data := range frames {
+		frame, err := verifyFrame(data, key)
+		if err != nil {
+			return nil, err
+		}
+		verified = append(verified, frame)
+	}
+	return verified, nil
+}
+
+// finishFastStart presents the cached GOP at once, so that the picture
+// starts without waiting for the next keyframe, then resumes normal
+// playout with the frames held meanwhile.
+func (v *Viewer) finishFastStart(frames [][]byte, err error) {
+	v.startMu.Lock()
+	defer v.startMu.Unlock()
+
+	v.fastStartPending = false
+	held := v.held
+	v.held = nil
+	if !v.isViewing {
 		return
 	}
-	
-	// Call frame callback if set
+
+	var presented int
+	if err != nil {
+		v.logger.Warnf("Fast start failed: %v", err)
+	}
+	for _, data := range frames {
+		data, err := v.decryptFrame(data)
+		if err != nil {
+			continue
+		}
+		frame, err := v.decoder.DecodeFrame(data)
+		if err != nil || (presented == 0 && !frame.IsKeyframe()) {
+			continue
+		}
+		v.videoStream = frame.GetStreamID()
+		v.fastStartStream = frame.GetStreamID()
+		v.fastStartUntil = frame.GetFrameID()
+		v.waitingForKeyframe = false
+		v.presentVideo(frame)
+		presented++
+	}
+
+	if presented > 0 {
+		v.logger.Infof("Fast start: presented %d frames from the cached GOP", presented)
+	} else {
+		v.requestKeyframe("join")
+	}
+	for _, data := range held {
+		v.decodeVideoLocked(data)
+	}
+}
+
+// requestKeyframe asks the broadcaster for a keyframe on the active
+// rendition, at most once per keyframeRequestInterval.
+func (v *Viewer) requestKeyframe(reason string) {
+	v.requestMu.Lock()
+	if time.Since(v.lastKeyframeRequest) < keyframeRequestInterval {
+		v.requestMu.Unlock()
+		return
+	}
+	v.lastKeyframeRequest = time.Now()
+	v.requestMu.Unlock()
+
+	v.sendKeyframeRequest(v.activeRendition(), reason)
+}
+
+// sendKeyframeRequest publishes a keyframe request on the control topic.
+func (v *Viewer) sendKeyframeRequest(rendition string, reason string) {
+	msg := &ControlMessage{
+		Type:      ControlKeyframeRequest,
+		StreamID:  v.activeStream.Load(),
+		Rendition: rendition,
+		Reason:    reason,
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		v.logger.Errorf("Failed to encode keyframe request: %v", err)
+		return
+	}
+	if err := v.controlTopic.Publish(v.ctx, data); err != nil {
+		v.logger.Errorf("Failed to send keyframe request: %v", err)
+	}
+}
+
+// decryptFrame returns a private stream's frame in the clear, and passes
+// other streams' frames through. A private stream's frame that is not
+// encrypted is rejected, as anyone on the topic could have published it.
+// Failing for want of the right key puts the viewer in the key error state
+// until a frame decrypts again.
+func (v *Viewer) decryptFrame(data []byte) ([]byte, error) {
+	header, err := media.PeekHeader(data)
+	if err != nil || !header.IsEncrypted() {
+		if v.stream.Encrypted {
+			return nil, ErrUnencrypted
+		}
+		return data, nil
+	}
+
+	if v.opener == nil {
+		err = ErrNoKey
+	} else {
+		data, err = v.opener.Open(data)
+	}
+	switch {
+	case err == nil:
+		v.setKeyError(nil)
+	case errors.Is(err, ErrNoKey), errors.Is(err, ErrWrongKey):
+		v.setKeyError(err)
+	}
+	return data, err
+}
+
+// setKeyError records whether frames can be decrypted and reports changes
+// to the key error callback.
+func (v *Viewer) setKeyError(err error) {
+	v.keyMu.Lock()
+	changed := err != v.keyError
+	v.keyError = err
+	callback := v.onKeyError
+	v.keyMu.Unlock()
+
+	if !changed {
+		return
+	}
+	if err != nil {
+		v.logger.Warnf("Cannot decrypt stream: %v", err)
+	} else {
+		v.logger.Info("Stream decrypts with the configured key")
+	}
+	if callback != nil {
+		callback(err)
+	}
+}
+
+// KeyError returns ErrWrongKey or ErrNoKey while the stream's frames cannot
+// be decrypted, and nil otherwise.
+func (v *Viewer) KeyError() error {
+	v.keyMu.Lock()
+	defer v.keyMu.Unlock()
+	return v.keyError
+}
+
+// SetOnKeyError sets a callback for when the stream's frames stop
+// decrypting, with ErrWrongKey or ErrNoKey, and for when they decrypt again,
+// with nil. A broadcaster rotating its key does not trigger it.
+func (v *Viewer) SetOnKeyError(callback func(error)) {
+	v.keyMu.Lock()
+	defer v.keyMu.Unlock()
+	v.onKeyError = callback
+}
+
+// EnableFastStart lets the viewer fetch the broadcaster's cached GOP over a
+// direct stream when it joins, instead of waiting for the next keyframe.
+// While viewing, the host's connection to the broadcaster is also kept when
+// the host trims connections. The direct transport needs it to open its
+// streams.
+func (v *Viewer) EnableFastStart(h host.Host) {
+	v.host = h
+}
+
+// presentVideo hands a video frame to the frame callback at its
+// presentation time.
+func (v *Viewer) presentVideo(frame *media.DecodedFrame) {
 	if v.onFrameReceived != nil {
-		v.onFrameReceived(decodedFrame)
+		v.onFrameReceived(frame)
 	}
-	
-	// Call legacy data callback
-	if v.onData != nil {
-		v.onData(data)
+}
+
+// playAudio sends an audio frame to the local player at its presentation
+// time, starting the player on the first frame once the stream's codec is
+// known. Audio frames are also passed to the frame callback.
+func (v *Viewer) playAudio(frame *media.DecodedFrame) {
+	if v.onFrameReceived != nil {
+		v.onFrameReceived(frame)
 	}
-	
-	// Log statistics periodically
-	if v.framesReceived%30 == 0 { // Every second at 30fps
-		v.logger.Infof("Received %d frames, %d bytes total, quality: %s, last frame: %v", 
-			v.framesReceived, v.bytesReceived, decodedFrame.GetQuality(), v.lastFrameTime.Format("15:04:05.000"))
+	if !v.audioPlayback {
+		return
+	}
+
+	if v.audioPlayer == nil {
+		player := media.NewAudioPlayer(frame.GetCodec(), v.mediaConfig.SampleRate, v.mediaConfig.Channels)
+		if err := player.Start(); err != nil {
+			v.logger.Warnf("Audio playback unavailable: %v", err)
+			v.audioPlayback = false
+			return
+		}
+		v.audioPlayer = player
+	}
+
+	if err := v.audioPlayer.PlayFrame(frame); err != nil {
+		v.logger.Errorf("Failed to play audio frame %d: %v", frame.GetFrameID(), err)
 	}
 }
 
+// SetAudioPlayback enables or disables local audio output. It is enabled by
+// default; frames are still delivered to callbacks either way.
+func (v *Viewer) SetAudioPlayback(enabled bool) {
+	v.audioPlayback = enabled
+	if !enabled && v.audioPlayer != nil {
+		v.audioPlayer.Stop()
+		v.audioPlayer = nil
+	}
+}
+
+// SetOnFrameReceived sets the callback for decoded audio and video frames.
+// It is called from the jitter buffer in presentation order, at each
+// frame's presentation time.
 func (v *Viewer) SetOnFrameReceived(callback func(*media.DecodedFrame)) {
 	v.onFrameReceived = callback
 }
 
+// SetOnParamChange sets a callback for the in-band signal that the
+// broadcaster changed resolution or bitrate. It is called with the header
+// of the first frame encoded with the new parameters, before that frame is
+// decoded.
+func (v *Viewer) SetOnParamChange(callback func(*media.FrameHeader)) {
+	v.onParamChange = callback
+}
+
 func (v *Viewer) Stop() {
 	if !v.isViewing {
 		return
 	}
-	
+
 	v.logger.Info("Stopping stream viewer...")
 	v.isViewing = false
-	
-	// Stop decoder
+
+	// Signal stop to the receive loop, which cancels the subscriptions, and
+	// let it finish with the decoders
+	close(v.stopChan)
+	<-v.receiveDone
+
+	// Stop presenting before the player goes away
+	v.jitterBuffer.Stop()
+
+	// Stop decoders
 	v.decoder.Stop()
-	
-	// Signal stop to receive loop
-	select {
-	case v.stopChan <- struct{}{}:
-	default:
+	if v.audioDecoder != nil {
+		v.audioDecoder.Stop()
+	}
+	if v.audioPlayer != nil {
+		v.audioPlayer.Stop()
+		v.audioPlayer = nil
+	}
+
+	if v.host != nil {
+		v.host.ConnManager().Unprotect(v.stream.Broadcaster, broadcasterProtectTag)
 	}
-	
-	v.subscription.Cancel()
 }
 
 func (v *Viewer) GetStats() (framesReceived uint64, bytesReceived uint64, isViewing bool, lastFrameTime time.Time) {
 	return v.framesReceived, v.bytesReceived, v.isViewing, v.lastFrameTime
 }
 
+// SetLipSyncOffset adjusts the lip-sync offset while viewing. A positive
+// offset delays video relative to audio, a negative one delays audio.
+func (v *Viewer) SetLipSyncOffset(offset time.Duration) {
+	v.jitterBuffer.SetLipSyncOffset(offset)
+}
+
+// GetJitterStats returns the jitter buffer's counters and current depth.
+func (v *Viewer) GetJitterStats() JitterStats {
+	return v.jitterBuffer.GetStats()
+}
+
+// GetReassemblyStats returns the frames rebuilt from chunks, the frames
+// discarded because chunks were still missing at the timeout, and the
+// duplicate chunks ignored.
+func (v *Viewer) GetReassemblyStats() (completed uint64, incomplete uint64, duplicates uint64) {
+	return v.reassembler.GetStats()
+}
+
+// GetFECStats returns the chunks rebuilt from FEC parity and the frames
+// that could not be recovered.
+func (v *Viewer) GetFECStats() (recovered uint64, unrecoverable uint64) {
+	return v.reassembler.GetFECStats()
+}
+
+// GetAudioFrameCount returns the number of audio frames received.
+func (v *Viewer) GetAudioFrameCount() uint64 {
+	return v.audioReceived
+}
+
 func (v *Viewer) GetFrameRate() float64 {
 	if v.framesReceived == 0 {
 		return 0
@@ -163,4 +1041,4 @@ func (v *Viewer) GetFrameRate() float64 {
 	// Simple frame rate calculation
 	duration := time.Since(v.lastFrameTime.Add(-time.Duration(v.framesReceived) * 33 * time.Millisecond))
 	return float64(v.framesReceived) / duration.Seconds()
-}
\ No newline at end of file
+}